@@ -36,6 +36,7 @@ func main() {
 	batchConcurrency := flag.Int("batchConcurrency", 1, "Number of concurrent database operations to do during batch bundle processing (1 to disable)")
 	databaseSuffix := flag.String("databaseSuffix", "", "Request-specific MongoDB database name has to end with this (optional, e.g. '_fhir')")
 	dontCreateIndexes := flag.Bool("dontCreateIndexes", false, "Don't create indexes for the 'fhr' database on startup")
+	killLongRunningOps := flag.Bool("killLongRunningOps", false, "Kill database operations running for longer than 90s (the database user needs the inprog and killop privileges)")
 	disableSearchTotals := flag.Bool("disableSearchTotals", false, "Don't query for all results of a search to return Bundle.total, only do paging")
 	enableXML := flag.Bool("enableXML", false, "Enable support for the FHIR XML encoding")
 	validatorURL := flag.String("validatorURL", "", "A FHIR validation endpoint to proxy validation requests to")
@@ -111,7 +112,8 @@ func main() {
 		DatabaseSuffix:               *databaseSuffix,
 		DatabaseSocketTimeout:        2 * time.Minute,
 		DatabaseOpTimeout:            90 * time.Second,
-		DatabaseKillOpPeriod:         10 * time.Second,
+		DatabaseOpPollInterval:       10 * time.Second,
+		KillLongRunningOps:           *killLongRunningOps,
 		Auth:                         auth.None(),
 		EnableCISearches:             true,
 		TokenParametersCaseSensitive: *tokenParametersCaseSensitive,
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"errors"
+)
+
+type annotation Annotation
+
+// GetBSON enforces author[x] being either a Reference or a string, not both
+func (a Annotation) GetBSON() (interface{}, error) {
+	if a.AuthorReference != nil && a.AuthorString != "" {
+		return nil, errors.New("Annotation can't have both authorReference and authorString")
+	}
+	return annotation(a), nil
+}
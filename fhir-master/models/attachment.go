@@ -29,7 +29,7 @@ package models
 type Attachment struct {
 	ContentType string        `bson:"contentType,omitempty" json:"contentType,omitempty"`
 	Language    string        `bson:"language,omitempty" json:"language,omitempty"`
-	Data        string        `bson:"data,omitempty" json:"data,omitempty"`
+	Data        []byte        `bson:"data,omitempty" json:"data,omitempty"`
 	Url         string        `bson:"url,omitempty" json:"url,omitempty"`
 	Size        *uint32       `bson:"size,omitempty" json:"size,omitempty"`
 	Hash        string        `bson:"hash,omitempty" json:"hash,omitempty"`
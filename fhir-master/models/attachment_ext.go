@@ -0,0 +1,48 @@
+package models
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type attachment Attachment
+
+// SetBSON reads data stored either as BSON binary or, as it was before, as a base64 string
+func (a *Attachment) SetBSON(raw bson.Raw) error {
+	var att attachment
+	if err := raw.Unmarshal(&att); err != nil {
+		return err
+	}
+	if err := decodeLegacyBase64Binary(raw, "data", &att.Data); err != nil {
+		return err
+	}
+	*a = Attachment(att)
+	return nil
+}
+
+// decodeLegacyBase64Binary replaces *value with the decoded contents of the element named key in
+// the document raw if it was stored as a base64 string, which mgo would otherwise read as the bytes
+// of the base64 text. Values stored as BSON binary are left as they are.
+func decodeLegacyBase64Binary(raw bson.Raw, key string, value *[]byte) error {
+	var elems bson.RawD
+	if err := raw.Unmarshal(&elems); err != nil {
+		return err
+	}
+	for _, elem := range elems {
+		if elem.Name != key || elem.Value.Kind != 0x02 {
+			continue
+		}
+		var encoded string
+		if err := elem.Value.Unmarshal(&encoded); err != nil {
+			return err
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("Couldn't decode base64 %s: %s", key, err)
+		}
+		*value = decoded
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"encoding/json"
+
+	"github.com/pebbe/util"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type AttachmentSuite struct {
+}
+
+var _ = check.Suite(&AttachmentSuite{})
+
+func (s *AttachmentSuite) TestUnmarshalLegacyBase64Data(c *check.C) {
+	// data was stored as a base64 string before it was stored as binary
+	data, err := bson.Marshal(bson.M{"contentType": "text/plain", "data": "aGVsbG8="})
+	util.CheckErr(err)
+
+	var attachment Attachment
+	err = bson.Unmarshal(data, &attachment)
+	util.CheckErr(err)
+	c.Assert(attachment.Data, check.DeepEquals, []byte("hello"))
+
+	jsonBytes, err := json.Marshal(&attachment)
+	util.CheckErr(err)
+	c.Assert(string(jsonBytes), check.Equals, `{"contentType":"text/plain","data":"aGVsbG8="}`)
+
+	// binary is read as it is
+	data, err = bson.Marshal(bson.M{"data": []byte("hello")})
+	util.CheckErr(err)
+	attachment = Attachment{}
+	err = bson.Unmarshal(data, &attachment)
+	util.CheckErr(err)
+	c.Assert(attachment.Data, check.DeepEquals, []byte("hello"))
+
+	data, err = bson.Marshal(bson.M{"data": "not base64!"})
+	util.CheckErr(err)
+	err = bson.Unmarshal(data, &attachment)
+	c.Assert(err, check.ErrorMatches, "Couldn't decode base64 data: .*")
+}
@@ -1,5 +1,12 @@
 package models
 
+import (
+	"strings"
+	"unicode"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
 type CodeableConcepts []CodeableConcept
 
 func (slice CodeableConcepts) AnyMatchesCode(system string, code string) bool {
@@ -39,3 +46,78 @@ func (c *CodeableConcept) MatchesCode(system string, code string) bool {
 	}
 	return false
 }
+
+// Whether HasCoding ignores the case of codes
+var caseInsensitiveCodes = false
+
+// SetCaseInsensitiveCodes turns on (or off) HasCoding matching codes that differ only in case,
+// for code systems (e.g. some local ones) that don't treat case as significant
+func SetCaseInsensitiveCodes(enabled bool) {
+	caseInsensitiveCodes = enabled
+}
+
+// HasCoding reports whether the concept has a coding with the system and code,
+// ignoring the case of the code if SetCaseInsensitiveCodes is enabled
+func (c *CodeableConcept) HasCoding(system string, code string) bool {
+	for _, coding := range c.Coding {
+		if coding.System != system {
+			continue
+		}
+		if coding.Code == code || (caseInsensitiveCodes && strings.EqualFold(coding.Code, code)) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindCoding returns the concept's first coding in the system
+func (c *CodeableConcept) FindCoding(system string) (*Coding, bool) {
+	for i := range c.Coding {
+		if c.Coding[i].System == system {
+			return &c.Coding[i], true
+		}
+	}
+	return nil, false
+}
+
+type codeableConcept CodeableConcept
+
+type codeableConceptWithTokens struct {
+	codeableConcept `bson:",inline"`
+	Tokens          []string `bson:"__tokens,omitempty"`
+}
+
+// GetBSON adds a __tokens array with the lowercased words of the text so that
+// Mongo queries can match on parts of it
+func (c CodeableConcept) GetBSON() (interface{}, error) {
+	return codeableConceptWithTokens{
+		codeableConcept: codeableConcept(c),
+		Tokens:          textTokens(c.Text),
+	}, nil
+}
+
+// SetBSON ignores the __tokens added by GetBSON
+func (c *CodeableConcept) SetBSON(raw bson.Raw) error {
+	var concept codeableConcept
+	if err := raw.Unmarshal(&concept); err != nil {
+		return err
+	}
+	*c = CodeableConcept(concept)
+	return nil
+}
+
+// textTokens splits text into distinct lowercased words
+func textTokens(text string) []string {
+	var tokens []string
+	seen := map[string]bool{}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
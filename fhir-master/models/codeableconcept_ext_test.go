@@ -0,0 +1,63 @@
+package models
+
+import (
+	"github.com/pebbe/util"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type CodeableConceptSuite struct {
+}
+
+var _ = check.Suite(&CodeableConceptSuite{})
+
+func (s *CodeableConceptSuite) TestCodeableConceptTextTokens(c *check.C) {
+	ext := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueCodeableConcept: &CodeableConcept{
+			Coding: []Coding{{System: "http://snomed.info/sct", Code: "57054005"}},
+			Text:   "Acute Myocardial Infarction",
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["foo"].(bson.M)["__tokens"], check.DeepEquals, []interface{}{"acute", "myocardial", "infarction"})
+
+	// __tokens are dropped on the way back
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(unmarshalled, check.DeepEquals, *ext)
+}
+
+func (s *CodeableConceptSuite) TestCodeableConceptHasCoding(c *check.C) {
+	concept := CodeableConcept{Coding: []Coding{
+		{System: "http://loinc.org", Code: "8480-6", Display: "Systolic blood pressure"},
+		{System: "http://example.org/codes", Code: "BP-SYS"},
+		{System: "http://example.org/codes", Code: "bp-systolic"},
+	}}
+
+	c.Assert(concept.HasCoding("http://loinc.org", "8480-6"), check.Equals, true)
+	c.Assert(concept.HasCoding("http://example.org/codes", "bp-systolic"), check.Equals, true)
+	c.Assert(concept.HasCoding("http://loinc.org", "8462-4"), check.Equals, false)
+	c.Assert(concept.HasCoding("http://snomed.info/sct", "8480-6"), check.Equals, false)
+	c.Assert(concept.HasCoding("http://example.org/codes", "bp-sys"), check.Equals, false)
+
+	SetCaseInsensitiveCodes(true)
+	defer SetCaseInsensitiveCodes(false)
+	c.Assert(concept.HasCoding("http://example.org/codes", "bp-sys"), check.Equals, true)
+	c.Assert(concept.HasCoding("http://example.org/codes", "BP-SYSTOLIC"), check.Equals, true)
+	c.Assert(concept.HasCoding("http://loinc.org", "8462-4"), check.Equals, false)
+
+	coding, found := concept.FindCoding("http://example.org/codes")
+	c.Assert(found, check.Equals, true)
+	c.Assert(coding, check.Equals, &concept.Coding[1])
+	coding, found = concept.FindCoding("http://snomed.info/sct")
+	c.Assert(found, check.Equals, false)
+	c.Assert(coding, check.IsNil)
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type coding Coding
+
+type codingWithLowercaseDisplay struct {
+	coding       `bson:",inline"`
+	DisplayLower string `bson:"__displayLower,omitempty"`
+}
+
+// GetBSON adds a lowercased copy of the display as __displayLower so that
+// Mongo queries can match it case-insensitively without a regex
+func (c Coding) GetBSON() (interface{}, error) {
+	return codingWithLowercaseDisplay{
+		coding:       coding(c),
+		DisplayLower: strings.ToLower(c.Display),
+	}, nil
+}
+
+// SetBSON ignores the __displayLower added by GetBSON
+func (c *Coding) SetBSON(raw bson.Raw) error {
+	var cd coding
+	if err := raw.Unmarshal(&cd); err != nil {
+		return err
+	}
+	*c = Coding(cd)
+	return nil
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"encoding/json"
+
+	"github.com/pebbe/util"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type CodingSuite struct {
+}
+
+var _ = check.Suite(&CodingSuite{})
+
+func (s *CodingSuite) TestCodingLowercaseDisplay(c *check.C) {
+	ext := &Extension{
+		Url:         "http://example.org/fhir/extensions/foo",
+		ValueCoding: &Coding{System: "http://snomed.info/sct", Code: "22298006", Display: "Myocardial INFARCTION"},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["foo"], check.DeepEquals, bson.M{
+		"system":         "http://snomed.info/sct",
+		"code":           "22298006",
+		"display":        "Myocardial INFARCTION",
+		"__displayLower": "myocardial infarction",
+	})
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(&unmarshalled, check.DeepEquals, ext)
+
+	// nothing is added without a display
+	ext.ValueCoding.Display = ""
+	data, err = bson.Marshal(ext)
+	util.CheckErr(err)
+	m = bson.M{}
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	_, found := m["foo"].(bson.M)["__displayLower"]
+	c.Assert(found, check.Equals, false)
+}
+
+func (s *CodingSuite) TestCodingUserSelected(c *check.C) {
+	selected, notSelected := true, false
+	for _, test := range []struct {
+		userSelected *bool
+		stored       interface{}
+	}{
+		{nil, nil},
+		{&notSelected, false},
+		{&selected, true},
+	} {
+		coding := Coding{System: "http://loinc.org", Code: "8480-6", UserSelected: test.userSelected}
+		data, err := bson.Marshal(CodeableConcept{Coding: []Coding{coding}})
+		util.CheckErr(err)
+
+		var m bson.M
+		util.CheckErr(bson.Unmarshal(data, &m))
+		stored := m["coding"].([]interface{})[0].(bson.M)
+		userSelected, found := stored["userSelected"]
+		c.Assert(found, check.Equals, test.userSelected != nil)
+		c.Assert(userSelected, check.Equals, test.stored)
+
+		var concept CodeableConcept
+		util.CheckErr(bson.Unmarshal(data, &concept))
+		c.Assert(concept.Coding, check.DeepEquals, []Coding{coding})
+
+		// and likewise in JSON
+		data, err = json.Marshal(coding)
+		util.CheckErr(err)
+		var fromJSON Coding
+		util.CheckErr(json.Unmarshal(data, &fromJSON))
+		c.Assert(fromJSON, check.DeepEquals, coding)
+	}
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type contactPoint ContactPoint
+
+// GetBSON rejects a rank that isn't a valid positiveInt
+func (c ContactPoint) GetBSON() (interface{}, error) {
+	if err := c.checkRank(); err != nil {
+		return nil, err
+	}
+	return contactPoint(c), nil
+}
+
+// SetBSON rejects a stored rank that isn't a valid positiveInt
+func (c *ContactPoint) SetBSON(raw bson.Raw) error {
+	var cp contactPoint
+	if err := raw.Unmarshal(&cp); err != nil {
+		return err
+	}
+	*c = ContactPoint(cp)
+	return c.checkRank()
+}
+
+func (c *ContactPoint) checkRank() error {
+	if c.Rank != nil && (*c.Rank == 0 || *c.Rank > maxFHIRInteger) {
+		return fmt.Errorf("Invalid ContactPoint rank: %d is outside the range 1 to %d", *c.Rank, maxFHIRInteger)
+	}
+	return nil
+}
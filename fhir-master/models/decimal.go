@@ -2,7 +2,13 @@ package models
 
 import (
 	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
 	"github.com/eug48/fhir/utils"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type Decimal struct {
@@ -10,6 +16,7 @@ type Decimal struct {
 	To   float64 `bson:"__to,omitempty"     json:"__to,omitempty"`
 	Num  float64 `bson:"__num,omitempty"    json:"__num,omitempty"`
 	Str  string  `bson:"__strNum,omitempty" json:"__strNum,omitempty"`
+	Sig  int     `bson:"__sig"              json:"__sig"` // decimal places given, for reporting precision
 }
 
 func (d *Decimal) UnmarshalJSON(data []byte) (err error) {
@@ -37,10 +44,319 @@ func NewDecimal(str string) (*Decimal, error) {
 	numFrom, _ := number.RangeLowIncl().Float64()
 	numTo, _ := number.RangeHighExcl().Float64()
 
-	return &Decimal{
+	d := &Decimal{
 		Str:  str,
 		Num:  num,
 		From: numFrom,
 		To:   numTo,
-	}, nil
+		Sig:  number.Precision,
+	}
+	if err := d.checkFinite(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewDecimals parses a batch of strings, giving the same results as calling NewDecimal on each.
+// It is faster for large batches (e.g. when ingesting observations) as it reuses the intermediate
+// values and computes the __from/__to band once for each number of decimal places.
+func NewDecimals(strs []string) ([]*Decimal, []error) {
+	decimals := make([]*Decimal, len(strs))
+	errs := make([]error, len(strs))
+
+	value, bound := new(big.Rat), new(big.Rat)
+	deltas := map[int]*big.Rat{}
+	for i, str := range strs {
+		trimmed := strings.TrimSpace(str)
+		if _, ok := value.SetString(trimmed); !ok {
+			errs[i] = fmt.Errorf("NewDecimal: failed to parse string (%s)", str)
+			continue
+		}
+		places := decimalPlaces(trimmed)
+
+		delta := bandDelta(places)
+		if delta == nil {
+			if delta = deltas[places]; delta == nil {
+				delta = newBandDelta(places)
+				deltas[places] = delta
+			}
+		}
+
+		d := &Decimal{Str: str, Sig: places}
+		d.Num, _ = value.Float64()
+		d.From, _ = bound.Sub(value, delta).Float64()
+		d.To, _ = bound.Add(value, delta).Float64()
+		if errs[i] = d.checkFinite(); errs[i] == nil {
+			decimals[i] = d
+		}
+	}
+	return decimals, errs
+}
+
+// Half the width of the __from/__to band for each number of decimal places up to maxSharedBandPlaces
+// (0.5, 0.05, ...), shared by all calls of NewDecimals. They are never modified after being built,
+// so can be read by many goroutines at once.
+const maxSharedBandPlaces = 20
+
+var sharedBandDeltas = func() []*big.Rat {
+	deltas := make([]*big.Rat, maxSharedBandPlaces+1)
+	for places := range deltas {
+		deltas[places] = newBandDelta(places)
+	}
+	return deltas
+}()
+
+// bandDelta returns the shared half-width of the band for a number of decimal places, or nil if it
+// has too many; it must not be modified
+func bandDelta(places int) *big.Rat {
+	if places < len(sharedBandDeltas) {
+		return sharedBandDeltas[places]
+	}
+	return nil
+}
+
+func newBandDelta(places int) *big.Rat {
+	return (&utils.Number{Value: new(big.Rat), Precision: places}).RangeHighExcl()
+}
+
+// NewDecimalWithoutBand parses str like NewDecimal but leaves out the __from/__to band used for
+// range searches, so that only __num and __strNum are stored. It is for collections such as code
+// tables that are never searched by range, where the band only makes documents bigger.
+func NewDecimalWithoutBand(str string) (*Decimal, error) {
+	trimmed := strings.TrimSpace(str)
+	value, ok := new(big.Rat).SetString(trimmed)
+	if !ok {
+		return nil, fmt.Errorf("NewDecimal: failed to parse string (%s)", str)
+	}
+	d := &Decimal{Str: str, Sig: decimalPlaces(trimmed)}
+	d.Num, _ = value.Float64()
+	if err := d.checkFinite(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewDecimalWithUncertainty parses value like NewDecimal but with the __from/__to band set to
+// value ± uncertainty, for measurements reported with an explicit uncertainty (e.g. "5.0 ± 0.3"),
+// rather than derived from the number of decimal places given. The uncertainty can't be negative.
+func NewDecimalWithUncertainty(value string, uncertainty string) (*Decimal, error) {
+	d, err := NewDecimal(value)
+	if err != nil {
+		return nil, err
+	}
+	exact, ok := new(big.Rat).SetString(strings.TrimSpace(value))
+	if !ok {
+		return nil, fmt.Errorf("NewDecimal: failed to parse string (%s)", value)
+	}
+	delta, ok := new(big.Rat).SetString(strings.TrimSpace(uncertainty))
+	if !ok {
+		return nil, fmt.Errorf("NewDecimalWithUncertainty: failed to parse uncertainty (%s)", uncertainty)
+	}
+	if delta.Sign() < 0 {
+		return nil, fmt.Errorf("NewDecimalWithUncertainty: uncertainty (%s) is negative", uncertainty)
+	}
+
+	bound := new(big.Rat)
+	d.From, _ = bound.Sub(exact, delta).Float64()
+	d.To, _ = bound.Add(exact, delta).Float64()
+	if err := d.checkFinite(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// HasBand reports whether the decimal has the __from/__to band, i.e. wasn't made by NewDecimalWithoutBand
+func (d *Decimal) HasBand() bool {
+	return d.From != 0 || d.To != 0
+}
+
+func decimalPlaces(trimmed string) int {
+	if dot := strings.Index(trimmed, "."); dot != -1 {
+		return len(trimmed) - dot - 1
+	}
+	return 0
+}
+
+// EqualFHIR reports whether the decimals are equal in the FHIR sense: the same value given to the same
+// number of decimal places, so 1.0 equals 1.0 but not 1.00 or 1
+func (d *Decimal) EqualFHIR(other *Decimal) bool {
+	if d == nil || other == nil {
+		return d == other
+	}
+	return d.Sig == other.Sig && d.EqualValue(other)
+}
+
+// EqualValue reports whether the decimals have the same value, regardless of precision, so 1.0 equals 1.00 and 1
+func (d *Decimal) EqualValue(other *Decimal) bool {
+	if d == nil || other == nil {
+		return d == other
+	}
+	a, aOK := d.rat()
+	b, bOK := other.rat()
+	if !aOK || !bOK {
+		return d.Num == other.Num
+	}
+	return a.Cmp(b) == 0
+}
+
+// rat returns the exact value of the decimal from its string form, if it has one
+func (d *Decimal) rat() (*big.Rat, bool) {
+	if d.Str == "" {
+		return nil, false
+	}
+	return new(big.Rat).SetString(strings.TrimSpace(d.Str))
+}
+
+// storedDecimal is how a Decimal is stored: __num is an int64 for integral values so that large
+// integers aren't rounded to the nearest float64, and a float64 otherwise
+type storedDecimal struct {
+	From float64     `bson:"__from,omitempty"`
+	To   float64     `bson:"__to,omitempty"`
+	Num  interface{} `bson:"__num,omitempty"`
+	Str  string      `bson:"__strNum,omitempty"`
+	Sig  *int        `bson:"__sig,omitempty"` // left out with the band
+}
+
+// GetBSON refuses to store NaN or infinite numbers, which would break range queries on __num, __from and __to
+func (d Decimal) GetBSON() (interface{}, error) {
+	if err := d.checkFinite(); err != nil {
+		return nil, err
+	}
+	stored := storedDecimal{From: d.From, To: d.To, Str: d.Str}
+	if d.HasBand() || d.Str == "" {
+		stored.Sig = &d.Sig
+	}
+	if num, integral := d.int64(); integral {
+		if num != 0 {
+			stored.Num = num
+		}
+	} else if d.Num != 0 {
+		stored.Num = d.Num
+	}
+	return stored, nil
+}
+
+// int64 returns the value as an int64 if it is an integer within range
+func (d Decimal) int64() (int64, bool) {
+	if d.Str == "" {
+		// not parsed from a string, so the float is all there is
+		if d.Num == math.Trunc(d.Num) && math.Abs(d.Num) < math.MaxInt64 {
+			return int64(d.Num), true
+		}
+		return 0, false
+	}
+	value, ok := new(big.Rat).SetString(strings.TrimSpace(d.Str))
+	if !ok || !value.IsInt() || !value.Num().IsInt64() {
+		return 0, false
+	}
+	return value.Num().Int64(), true
+}
+
+// SetBSON also reads decimals stored as a plain number, as they were before __num, __from and __to,
+// recomputing the band from the shortest string that represents the number. A Decimal128 (as
+// written by newer drivers) keeps all of its digits, so its band follows its own precision.
+func (d *Decimal) SetBSON(raw bson.Raw) error {
+	switch raw.Kind {
+	case 0x01, 0x10, 0x12:
+		var num float64
+		if err := raw.Unmarshal(&num); err != nil {
+			return err
+		}
+		parsed, err := NewDecimal(strconv.FormatFloat(num, 'f', -1, 64))
+		if err != nil {
+			return err
+		}
+		*d = *parsed
+		return nil
+	case 0x13:
+		var num bson.Decimal128
+		if err := raw.Unmarshal(&num); err != nil {
+			return err
+		}
+		parsed, err := NewDecimal(decimal128String(num))
+		if err != nil {
+			return err
+		}
+		*d = *parsed
+		return nil
+	}
+
+	var stored storedDecimal
+	if err := raw.Unmarshal(&stored); err != nil {
+		return err
+	}
+	*d = Decimal{From: stored.From, To: stored.To, Str: stored.Str}
+	if stored.Sig != nil {
+		d.Sig = *stored.Sig
+	} else {
+		d.Sig = decimalPlaces(strings.TrimSpace(stored.Str))
+	}
+	switch num := stored.Num.(type) {
+	case nil:
+	case int64:
+		d.Num = float64(num)
+	case int:
+		d.Num = float64(num)
+	case float64:
+		d.Num = num
+	case bson.Decimal128:
+		parsed, err := strconv.ParseFloat(decimal128String(num), 64)
+		if err != nil {
+			return fmt.Errorf("Decimal.SetBSON: invalid __num %s", num)
+		}
+		d.Num = parsed
+	default:
+		return fmt.Errorf("Decimal.SetBSON: __num has unexpected type %T", stored.Num)
+	}
+	return nil
+}
+
+// decimal128String writes out a BSON Decimal128 in full without an exponent, keeping its trailing
+// zeros as they give its precision, e.g. 1.050E+3 as "1050" and 1.00E-6 as "0.00000100"
+func decimal128String(num bson.Decimal128) string {
+	str := num.String()
+	e := strings.IndexByte(str, 'E')
+	if e == -1 {
+		return str
+	}
+	exponent, err := strconv.Atoi(str[e+1:])
+	if err != nil {
+		return str
+	}
+	mantissa, sign := str[:e], ""
+	if strings.HasPrefix(mantissa, "-") {
+		mantissa, sign = mantissa[1:], "-"
+	}
+	point := strings.IndexByte(mantissa, '.')
+	if point == -1 {
+		point = len(mantissa)
+	}
+	digits := strings.Replace(mantissa, ".", "", 1)
+	point += exponent
+	switch {
+	case point <= 0:
+		return sign + "0." + strings.Repeat("0", -point) + digits
+	case point >= len(digits):
+		digits += strings.Repeat("0", point-len(digits))
+	default:
+		digits = digits[:point] + "." + digits[point:]
+	}
+	if trimmed := strings.TrimLeft(digits, "0"); trimmed == "" || trimmed[0] == '.' {
+		digits = "0" + trimmed
+	} else {
+		digits = trimmed
+	}
+	return sign + digits
+}
+
+func (d *Decimal) checkFinite() error {
+	for _, f := range []struct {
+		name  string
+		value float64
+	}{{"__num", d.Num}, {"__from", d.From}, {"__to", d.To}} {
+		if math.IsNaN(f.value) || math.IsInf(f.value, 0) {
+			return fmt.Errorf("Decimal %q can't be stored: %s is %v (out of range for a 64-bit float)", d.Str, f.name, f.value)
+		}
+	}
+	return nil
 }
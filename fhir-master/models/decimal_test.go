@@ -0,0 +1,423 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/pebbe/util"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type DecimalSuite struct {
+}
+
+var _ = check.Suite(&DecimalSuite{})
+
+func (s *DecimalSuite) TestDecimalPlacesAreStored(c *check.C) {
+	for _, test := range []struct {
+		str string
+		sig int
+	}{
+		{"10", 0},
+		{"10.0", 1},
+		{"0.001", 3},
+	} {
+		value, err := NewDecimal(test.str)
+		util.CheckErr(err)
+		c.Assert(value.Sig, check.Equals, test.sig)
+
+		ext := &Extension{Url: "http://example.org/fhir/extensions/foo", ValueQuantity: &Quantity{Value: value}}
+		data, err := bson.Marshal(ext)
+		util.CheckErr(err)
+		var m bson.M
+		err = bson.Unmarshal(data, &m)
+		util.CheckErr(err)
+		stored := m["foo"].(bson.M)["value"].(bson.M)
+		c.Assert(stored["__sig"], check.Equals, test.sig)
+		c.Assert(stored["__strNum"], check.Equals, test.str)
+
+		var unmarshalled Extension
+		err = bson.Unmarshal(data, &unmarshalled)
+		util.CheckErr(err)
+		c.Assert(unmarshalled.ValueQuantity.Value, check.DeepEquals, value)
+	}
+}
+
+func (s *DecimalSuite) TestDecimalStoresIntegersAsInt64(c *check.C) {
+	stored := func(d *Decimal) bson.M {
+		data, err := bson.Marshal(bson.M{"value": d})
+		util.CheckErr(err)
+		var m bson.M
+		util.CheckErr(bson.Unmarshal(data, &m))
+		return m["value"].(bson.M)
+	}
+	roundTrip := func(d *Decimal) Decimal {
+		data, err := bson.Marshal(bson.M{"value": d})
+		util.CheckErr(err)
+		var m struct{ Value Decimal }
+		util.CheckErr(bson.Unmarshal(data, &m))
+		return m.Value
+	}
+
+	// 2^53 + 1 can't be represented exactly as a float64
+	large, err := NewDecimal("9007199254740993")
+	util.CheckErr(err)
+	c.Assert(stored(large)["__num"], check.Equals, int64(9007199254740993))
+	c.Assert(roundTrip(large), check.DeepEquals, *large)
+
+	fractional, err := NewDecimal("12.345")
+	util.CheckErr(err)
+	c.Assert(stored(fractional)["__num"], check.Equals, 12.345)
+	c.Assert(roundTrip(fractional), check.DeepEquals, *fractional)
+
+	// integers too large for an int64 are stored as floats
+	huge, err := NewDecimal("92233720368547758070")
+	util.CheckErr(err)
+	c.Assert(stored(huge)["__num"], check.Equals, 92233720368547758070.0)
+	c.Assert(roundTrip(huge), check.DeepEquals, *huge)
+
+	// documents stored before are still read
+	data, err := bson.Marshal(bson.M{"value": bson.M{"__from": 49.5, "__to": 50.5, "__num": 50.0, "__strNum": "50", "__sig": 0}})
+	util.CheckErr(err)
+	var old struct{ Value Decimal }
+	util.CheckErr(bson.Unmarshal(data, &old))
+	fifty, err := NewDecimal("50")
+	util.CheckErr(err)
+	c.Assert(old.Value, check.DeepEquals, *fifty)
+}
+
+func (s *DecimalSuite) TestDecimalWithoutBand(c *check.C) {
+	for _, test := range []struct {
+		str string
+		num interface{}
+		sig int
+	}{
+		{"12.50", 12.5, 2},
+		{"100", int64(100), 0},
+		{"-0.001", -0.001, 3},
+	} {
+		d, err := NewDecimalWithoutBand(test.str)
+		util.CheckErr(err)
+		c.Assert(d.HasBand(), check.Equals, false)
+		c.Assert(d.Sig, check.Equals, test.sig)
+
+		data, err := bson.Marshal(Quantity{Value: d, Unit: "mg"})
+		util.CheckErr(err)
+		var m bson.M
+		util.CheckErr(bson.Unmarshal(data, &m))
+		c.Assert(m["value"], check.DeepEquals, bson.M{"__num": test.num, "__strNum": test.str})
+
+		var q Quantity
+		util.CheckErr(bson.Unmarshal(data, &q))
+		c.Assert(q, check.DeepEquals, Quantity{Value: d, Unit: "mg"})
+
+		// the same as NewDecimal apart from the band
+		banded, err := NewDecimal(test.str)
+		util.CheckErr(err)
+		c.Assert(banded.HasBand(), check.Equals, true)
+		banded.From, banded.To = 0, 0
+		c.Assert(d, check.DeepEquals, banded)
+	}
+
+	_, err := NewDecimalWithoutBand("abc")
+	c.Assert(err, check.ErrorMatches, `NewDecimal: failed to parse string \(abc\)`)
+	_, err = NewDecimalWithoutBand("1e400")
+	c.Assert(err, check.ErrorMatches, `Decimal "1e400" can't be stored: __num is \+Inf .*`)
+}
+
+func (s *DecimalSuite) TestUnmarshalLegacyFloatDecimal(c *check.C) {
+	// a quantity stored before decimals had __num, __from and __to
+	data, err := bson.Marshal(bson.M{"value": 5.25, "unit": "mg", "system": ucumSystem, "code": "mg"})
+	util.CheckErr(err)
+	var quantity Quantity
+	util.CheckErr(bson.Unmarshal(data, &quantity))
+	expected, err := NewDecimal("5.25")
+	util.CheckErr(err)
+	c.Assert(quantity.Value, check.DeepEquals, expected)
+	c.Assert(quantity.Value.From, check.Equals, 5.245)
+	c.Assert(quantity.Value.To, check.Equals, 5.255)
+	c.Assert(quantity.Unit, check.Equals, "mg")
+
+	// and in an extension
+	data, err = bson.Marshal(bson.M{
+		"@context": bson.M{"foo": bson.M{"@id": "http://example.org/fhir/extensions/foo", "@type": "Quantity"}},
+		"foo":      bson.M{"value": 120.0, "unit": "mmHg"},
+	})
+	util.CheckErr(err)
+	var ext Extension
+	util.CheckErr(bson.Unmarshal(data, &ext))
+	c.Assert(ext.ValueQuantity.Value.Str, check.Equals, "120")
+	c.Assert(ext.ValueQuantity.Value.From, check.Equals, 119.5)
+	c.Assert(ext.ValueQuantity.Value.To, check.Equals, 120.5)
+
+	// integers too
+	data, err = bson.Marshal(bson.M{"value": 3})
+	util.CheckErr(err)
+	quantity = Quantity{}
+	util.CheckErr(bson.Unmarshal(data, &quantity))
+	c.Assert(quantity.Value.Str, check.Equals, "3")
+	c.Assert(quantity.Value.Num, check.Equals, 3.0)
+}
+
+func (s *DecimalSuite) TestUnmarshalDecimal128Quantity(c *check.C) {
+	decimal128 := func(str string) bson.Decimal128 {
+		d, err := bson.ParseDecimal128(str)
+		util.CheckErr(err)
+		return d
+	}
+	data, err := bson.Marshal(bson.M{"value": decimal128("5.250"), "unit": "mg", "system": ucumSystem, "code": "mg"})
+	util.CheckErr(err)
+	var quantity Quantity
+	util.CheckErr(bson.Unmarshal(data, &quantity))
+	expected, err := NewDecimal("5.250")
+	util.CheckErr(err)
+	c.Assert(quantity.Value, check.DeepEquals, expected)
+	c.Assert(quantity.Value.From, check.Equals, 5.2495)
+	c.Assert(quantity.Value.To, check.Equals, 5.2505)
+	c.Assert(quantity.Unit, check.Equals, "mg")
+
+	// more digits than a float64 can hold
+	data, err = bson.Marshal(bson.M{"value": decimal128("12345678901234567890.123")})
+	util.CheckErr(err)
+	quantity = Quantity{}
+	util.CheckErr(bson.Unmarshal(data, &quantity))
+	c.Assert(quantity.Value.Str, check.Equals, "12345678901234567890.123")
+	c.Assert(quantity.Value.Sig, check.Equals, 3)
+
+	// exponents are written out
+	for stored, str := range map[string]string{
+		"1.050E+3": "1050",
+		"1E+3":     "1000",
+		"-1.00E-6": "-0.00000100",
+		"1.5E-1":   "0.15",
+		"0E+3":     "0",
+		"0.000":    "0.000",
+	} {
+		data, err = bson.Marshal(bson.M{"value": decimal128(stored)})
+		util.CheckErr(err)
+		quantity = Quantity{}
+		util.CheckErr(bson.Unmarshal(data, &quantity))
+		c.Assert(quantity.Value.Str, check.Equals, str, check.Commentf(stored))
+	}
+
+	// and __num written as a Decimal128
+	data, err = bson.Marshal(bson.M{"value": bson.M{"__num": decimal128("2.5"), "__strNum": "2.5", "__from": 2.45, "__to": 2.55}})
+	util.CheckErr(err)
+	quantity = Quantity{}
+	util.CheckErr(bson.Unmarshal(data, &quantity))
+	c.Assert(quantity.Value.Num, check.Equals, 2.5)
+
+	data, err = bson.Marshal(bson.M{"value": decimal128("NaN")})
+	util.CheckErr(err)
+	c.Assert(bson.Unmarshal(data, &quantity), check.NotNil)
+}
+
+func (s *DecimalSuite) TestDecimalWithUncertainty(c *check.C) {
+	d, err := NewDecimalWithUncertainty("5.0", "0.3")
+	util.CheckErr(err)
+	c.Assert(d, check.DeepEquals, &Decimal{Str: "5.0", Num: 5, Sig: 1, From: 4.7, To: 5.3})
+
+	// the band can be narrower than the decimal places given would make it
+	d, err = NewDecimalWithUncertainty("120", "0.25")
+	util.CheckErr(err)
+	c.Assert(d.From, check.Equals, 119.75)
+	c.Assert(d.To, check.Equals, 120.25)
+	c.Assert(d.Str, check.Equals, "120")
+
+	d, err = NewDecimalWithUncertainty("-2", "0")
+	util.CheckErr(err)
+	c.Assert(d.From, check.Equals, -2.0)
+	c.Assert(d.To, check.Equals, -2.0)
+
+	// stored with the band
+	d, err = NewDecimalWithUncertainty("5.0", "0.3")
+	util.CheckErr(err)
+	data, err := bson.Marshal(bson.M{"value": d})
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m["value"], check.DeepEquals, bson.M{"__from": 4.7, "__to": 5.3, "__num": int64(5), "__strNum": "5.0", "__sig": 1})
+	var read struct{ Value Decimal }
+	util.CheckErr(bson.Unmarshal(data, &read))
+	c.Assert(read.Value, check.DeepEquals, Decimal{Str: "5.0", Num: 5, Sig: 1, From: 4.7, To: 5.3})
+
+	_, err = NewDecimalWithUncertainty("5.0", "-0.3")
+	c.Assert(err, check.ErrorMatches, `NewDecimalWithUncertainty: uncertainty \(-0.3\) is negative`)
+	_, err = NewDecimalWithUncertainty("5.0", "a bit")
+	c.Assert(err, check.ErrorMatches, `NewDecimalWithUncertainty: failed to parse uncertainty \(a bit\)`)
+	_, err = NewDecimalWithUncertainty("five", "0.3")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *DecimalSuite) TestDecimalEquality(c *check.C) {
+	decimal := func(str string) *Decimal {
+		d, err := NewDecimal(str)
+		util.CheckErr(err)
+		return d
+	}
+
+	for _, test := range []struct {
+		a, b         string
+		fhir, values bool
+	}{
+		{"1.0", "1.0", true, true},
+		{"1.0", "1.00", false, true},
+		{"1.0", "1", false, true},
+		{"1.0", "1.1", false, false},
+		{"100", "1e2", true, true},
+		{"0.1", "0.10", false, true},
+		{"-0", "0", true, true},
+		{"0.30000000000000004", "0.3", false, false},
+	} {
+		comment := check.Commentf("%s and %s", test.a, test.b)
+		c.Assert(decimal(test.a).EqualFHIR(decimal(test.b)), check.Equals, test.fhir, comment)
+		c.Assert(decimal(test.b).EqualFHIR(decimal(test.a)), check.Equals, test.fhir, comment)
+		c.Assert(decimal(test.a).EqualValue(decimal(test.b)), check.Equals, test.values, comment)
+	}
+
+	// decimals without a string form are compared by their float
+	c.Assert((&Decimal{Num: 1}).EqualValue(decimal("1.00")), check.Equals, true)
+
+	var none *Decimal
+	c.Assert(none.EqualFHIR(nil), check.Equals, true)
+	c.Assert(none.EqualValue(decimal("1")), check.Equals, false)
+	c.Assert(decimal("1").EqualFHIR(nil), check.Equals, false)
+}
+
+func (s *DecimalSuite) TestDecimalRejectsNaNAndInf(c *check.C) {
+	for _, str := range []string{"NaN", "Inf", "-Inf", "1e400", "-1e400"} {
+		d, err := NewDecimal(str)
+		c.Assert(err, check.NotNil, check.Commentf("NewDecimal(%q) = %+v", str, d))
+	}
+
+	// a tiny exponent underflows to zero, which can still be stored
+	d, err := NewDecimal("1e-400")
+	util.CheckErr(err)
+	_, err = bson.Marshal(d)
+	util.CheckErr(err)
+
+	_, err = bson.Marshal(bson.M{"value": Decimal{Str: "1e400", Num: math.Inf(1)}})
+	c.Assert(err, check.ErrorMatches, `Decimal "1e400" can't be stored: __num is \+Inf .*`)
+
+	q := Quantity{Value: &Decimal{Str: "?", Num: math.NaN()}, Unit: "mg"}
+	_, err = bson.Marshal(q)
+	c.Assert(err, check.ErrorMatches, `Decimal "\?" can't be stored: __num is NaN .*`)
+
+	ext := Extension{Url: "http://example.org/fhir/extensions/foo", ValueQuantity: &q}
+	_, err = bson.Marshal(ext)
+	c.Assert(err, check.NotNil)
+
+	// a canonical value that overflows is left out rather than failing
+	SetCanonicalUnits(true)
+	defer SetCanonicalUnits(false)
+	large, err := NewDecimal("1e306")
+	util.CheckErr(err)
+	q = Quantity{Value: large, System: ucumSystem, Code: "kg"}
+	data, err := bson.Marshal(q)
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m["__canonValue"], check.IsNil)
+}
+
+var decimalBatch = []string{"1", "1.0", "0.001", "-42.50", " 7.25 ", "1e3", "1.5e-3", "100", "abc", "", "1e400", "3.14159", "-0", "0.5"}
+
+func (s *DecimalSuite) TestNewDecimalsMatchesNewDecimal(c *check.C) {
+	decimals, errs := NewDecimals(decimalBatch)
+	c.Assert(decimals, check.HasLen, len(decimalBatch))
+	c.Assert(errs, check.HasLen, len(decimalBatch))
+	for i, str := range decimalBatch {
+		expected, expectedErr := NewDecimal(str)
+		c.Assert(decimals[i], check.DeepEquals, expected, check.Commentf("%q", str))
+		if expectedErr == nil {
+			c.Assert(errs[i], check.IsNil)
+		} else {
+			c.Assert(errs[i], check.ErrorMatches, regexp.QuoteMeta(expectedErr.Error()))
+		}
+	}
+}
+
+// Run with -race to check that the tables shared by NewDecimals and quantities are safe to use concurrently
+func (s *DecimalSuite) TestConcurrentDecimalsAndQuantities(c *check.C) {
+	SetCanonicalUnits(true)
+	SetUCUMUnitValidation(true)
+	defer SetCanonicalUnits(false)
+	defer SetUCUMUnitValidation(false)
+
+	batch := append([]string{"0.1234567890123456789012345"}, decimalBatch...)
+	expected, _ := NewDecimals(batch)
+	quantity := func(value, unit string) Quantity {
+		d, err := NewDecimal(value)
+		util.CheckErr(err)
+		return Quantity{Value: d, Unit: unit, System: ucumSystem, Code: unit}
+	}
+	expectedQuantity, err := bson.Marshal(bson.M{"q": quantity("250", "mg")})
+	util.CheckErr(err)
+
+	const goroutines = 16
+	var wg sync.WaitGroup
+	failures := make(chan string, goroutines*2)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if decimals, _ := NewDecimals(batch); !reflect.DeepEqual(decimals, expected) {
+					failures <- "NewDecimals gave different results"
+					return
+				}
+				data, err := bson.Marshal(bson.M{"q": quantity("250", "mg")})
+				if err != nil || !bytes.Equal(data, expectedQuantity) {
+					failures <- fmt.Sprintf("quantity stored differently (%v)", err)
+					return
+				}
+				grams := quantity("1.5", "g")
+				converted, err := grams.Convert("mg")
+				if err != nil || converted.Value.Str != "1500" {
+					failures <- fmt.Sprintf("conversion failed: %v", err)
+					return
+				}
+				if g == 0 {
+					// the tables can be added to meanwhile
+					if err := AddUnitConversion(fmt.Sprintf("[test_mass_%d]", i), "2", "g"); err != nil {
+						failures <- err.Error()
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(failures)
+	for failure := range failures {
+		c.Error(failure)
+	}
+
+	ucumTablesLock.Lock()
+	defer ucumTablesLock.Unlock()
+	for i := 0; i < 20; i++ {
+		unit := fmt.Sprintf("[test_mass_%d]", i)
+		delete(ucumConversions, unit)
+		delete(ucumUnits, unit)
+	}
+}
+
+func BenchmarkNewDecimal(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, str := range decimalBatch {
+			NewDecimal(str)
+		}
+	}
+}
+
+func BenchmarkNewDecimals(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		NewDecimals(decimalBatch)
+	}
+}
@@ -28,7 +28,11 @@ package models
 
 type Extension struct {
 	Url                  string           `bson:"url,omitempty" json:"url,omitempty"`
+	ElementID            string           `bson:"-" json:"-"` // id of the value element, stored as __elementId
+	EmptyString          bool             `bson:"-" json:"-"` // ValueString is set, to "", rather than unset; ignored if another value is set
+	IsModifier           bool             `bson:"-" json:"-"` // a modifierExtension, stored with @modifier instead of @context
 	ValueAddress         *Address         `bson:"valueAddress,omitempty" json:"valueAddress,omitempty"`
+	ValueAge             *Age             `bson:"valueAge,omitempty" json:"valueAge,omitempty"`
 	ValueAnnotation      *Annotation      `bson:"valueAnnotation,omitempty" json:"valueAnnotation,omitempty"`
 	ValueAttachment      *Attachment      `bson:"valueAttachment,omitempty" json:"valueAttachment,omitempty"`
 	ValueBase64Binary    string           `bson:"valueBase64Binary,omitempty" json:"valueBase64Binary,omitempty"`
@@ -37,9 +41,13 @@ type Extension struct {
 	ValueCodeableConcept *CodeableConcept `bson:"valueCodeableConcept,omitempty" json:"valueCodeableConcept,omitempty"`
 	ValueCoding          *Coding          `bson:"valueCoding,omitempty" json:"valueCoding,omitempty"`
 	ValueContactPoint    *ContactPoint    `bson:"valueContactPoint,omitempty" json:"valueContactPoint,omitempty"`
+	ValueCount           *Count           `bson:"valueCount,omitempty" json:"valueCount,omitempty"`
 	ValueDate            *FHIRDateTime    `bson:"valueDate,omitempty" json:"valueDate,omitempty"`
 	ValueDateTime        *FHIRDateTime    `bson:"valueDateTime,omitempty" json:"valueDateTime,omitempty"`
 	ValueDecimal         *float64         `bson:"valueDecimal,omitempty" json:"valueDecimal,omitempty"`
+	ValueDistance        *Distance        `bson:"valueDistance,omitempty" json:"valueDistance,omitempty"`
+	ValueDosage          *Dosage          `bson:"valueDosage,omitempty" json:"valueDosage,omitempty"`
+	ValueDuration        *Duration        `bson:"valueDuration,omitempty" json:"valueDuration,omitempty"`
 	ValueHumanName       *HumanName       `bson:"valueHumanName,omitempty" json:"valueHumanName,omitempty"`
 	ValueId              string           `bson:"valueId,omitempty" json:"valueId,omitempty"`
 	ValueIdentifier      *Identifier      `bson:"valueIdentifier,omitempty" json:"valueIdentifier,omitempty"`
@@ -47,13 +55,17 @@ type Extension struct {
 	ValueInteger         *int32           `bson:"valueInteger,omitempty" json:"valueInteger,omitempty"`
 	ValueMarkdown        string           `bson:"valueMarkdown,omitempty" json:"valueMarkdown,omitempty"`
 	ValueMeta            *Meta            `bson:"valueMeta,omitempty" json:"valueMeta,omitempty"`
+	ValueMoney           *Money           `bson:"valueMoney,omitempty" json:"valueMoney,omitempty"`
 	ValueOid             string           `bson:"valueOid,omitempty" json:"valueOid,omitempty"`
 	ValuePeriod          *Period          `bson:"valuePeriod,omitempty" json:"valuePeriod,omitempty"`
 	ValuePositiveInt     *uint32          `bson:"valuePositiveInt,omitempty" json:"valuePositiveInt,omitempty"`
 	ValueQuantity        *Quantity        `bson:"valueQuantity,omitempty" json:"valueQuantity,omitempty"`
 	ValueRange           *Range           `bson:"valueRange,omitempty" json:"valueRange,omitempty"`
 	ValueRatio           *Ratio           `bson:"valueRatio,omitempty" json:"valueRatio,omitempty"`
+	ValueRaw             *RawValue        `bson:"-" json:"-"`
 	ValueReference       *Reference       `bson:"valueReference,omitempty" json:"valueReference,omitempty"`
+	ValueReferenceRange  *ReferenceRange  `bson:"valueReferenceRange,omitempty" json:"valueReferenceRange,omitempty"`
+	ValueReferences      []Reference      `bson:"valueReferences,omitempty" json:"valueReferences,omitempty"` // not FHIR; @type References
 	ValueSampledData     *SampledData     `bson:"valueSampledData,omitempty" json:"valueSampledData,omitempty"`
 	ValueSignature       *Signature       `bson:"valueSignature,omitempty" json:"valueSignature,omitempty"`
 	ValueString          string           `bson:"valueString,omitempty" json:"valueString,omitempty"`
@@ -0,0 +1,194 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultMaxExtensionDepth is the default for SetMaxExtensionDepth
+const defaultMaxExtensionDepth = 20
+
+// How deeply extensions can be nested within the values of other extensions; see SetMaxExtensionDepth
+var maxExtensionDepth = defaultMaxExtensionDepth
+
+// SetMaxExtensionDepth limits how deeply extensions can be nested within each other's values
+// (e.g. in the extensions of a Meta value) when they're stored or read, so that a deep tree
+// from a buggy or malicious client can't exhaust the stack. An extension without nested ones
+// has a depth of 1. A depth of 0 or less restores the default of 20.
+func SetMaxExtensionDepth(depth int) {
+	if depth <= 0 {
+		depth = defaultMaxExtensionDepth
+	}
+	maxExtensionDepth = depth
+}
+
+var extensionType = reflect.TypeOf(Extension{})
+
+// Whether values of each type can contain an Extension, so that extensionDepth can skip the ones that can't
+var typesWithExtensions sync.Map // reflect.Type -> bool
+
+func mayContainExtension(t reflect.Type) bool {
+	if contains, found := typesWithExtensions.Load(t); found {
+		return contains.(bool)
+	}
+	contains := containsExtension(t, map[reflect.Type]bool{})
+	typesWithExtensions.Store(t, contains)
+	return contains
+}
+
+func containsExtension(t reflect.Type, visited map[reflect.Type]bool) bool {
+	if t == extensionType {
+		return true
+	}
+	if visited[t] {
+		return false
+	}
+	visited[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return containsExtension(t.Elem(), visited)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath == "" && containsExtension(t.Field(i).Type, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extensionDepth returns how deeply extensions are nested in v, counting from depth,
+// giving up as soon as it passes limit
+func extensionDepth(v reflect.Value, depth int, limit int) int {
+	deepest := depth
+	if !mayContainExtension(v.Type()) {
+		return deepest
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			deepest = extensionDepth(v.Elem(), depth, limit)
+		}
+	case reflect.Slice, reflect.Array, reflect.Map:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			break
+		}
+		var elems []reflect.Value
+		if v.Kind() == reflect.Map {
+			elems = make([]reflect.Value, 0, v.Len())
+			for _, key := range v.MapKeys() {
+				elems = append(elems, v.MapIndex(key))
+			}
+		} else {
+			for i := 0; i < v.Len(); i++ {
+				elems = append(elems, v.Index(i))
+			}
+		}
+		for _, elem := range elems {
+			if d := extensionDepth(elem, depth, limit); d > deepest {
+				deepest = d
+			}
+			if deepest > limit {
+				break
+			}
+		}
+	case reflect.Struct:
+		if v.Type() == extensionType {
+			depth++
+			deepest = depth
+			if depth > limit {
+				return depth
+			}
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				// unexported, e.g. time.Time's
+				continue
+			}
+			if d := extensionDepth(v.Field(i), depth, limit); d > deepest {
+				deepest = d
+			}
+			if deepest > limit {
+				break
+			}
+		}
+	}
+	return deepest
+}
+
+// checkExtensionDepth returns an error if the value of the extension with extensionUrl has extensions
+// nested in it deeper than the limit set with SetMaxExtensionDepth
+func checkExtensionDepth(extensionUrl string, value interface{}) error {
+	if value == nil || !mayContainExtension(reflect.TypeOf(value)) {
+		return nil
+	}
+	if extensionDepth(reflect.ValueOf(value), 1, maxExtensionDepth) > maxExtensionDepth {
+		return fmt.Errorf("Couldn't marshal extension %s: extensions are nested more than %d deep", extensionUrl, maxExtensionDepth)
+	}
+	return nil
+}
+
+// rawExtensionDepth is extensionDepth for a stored value, in which extensions are the elements of
+// "extension" and "modifierExtension" arrays, or of raw itself if it is such an array (extensions).
+func rawExtensionDepth(raw bson.Raw, depth int, limit int, extensions bool) (int, error) {
+	if raw.Kind != 0x03 && raw.Kind != 0x04 {
+		return depth, nil
+	}
+	var elems bson.RawD
+	if raw.Kind == 0x04 {
+		var items []bson.Raw
+		if err := raw.Unmarshal(&items); err != nil {
+			return depth, err
+		}
+		elems = make(bson.RawD, len(items))
+		for i := range items {
+			elems[i].Value = items[i]
+		}
+	} else if err := raw.Unmarshal(&elems); err != nil {
+		return depth, err
+	}
+
+	deepest := depth
+	for _, elem := range elems {
+		elemDepth, nested := depth, false
+		if extensions {
+			elemDepth++
+		} else if raw.Kind == 0x03 && (elem.Name == "extension" || elem.Name == "modifierExtension") {
+			nested = true
+		}
+		d, err := rawExtensionDepth(elem.Value, elemDepth, limit, nested)
+		if err != nil {
+			return depth, err
+		}
+		if d > deepest {
+			deepest = d
+		}
+		if deepest > limit {
+			// no need to look any further
+			break
+		}
+	}
+	return deepest, nil
+}
+
+// checkRawExtensionDepth returns an error if the stored value of an extension has extensions nested
+// deeper than the limit set with SetMaxExtensionDepth. Values whose Go type can't contain extensions
+// aren't walked; goType is nil if it isn't known.
+func checkRawExtensionDepth(goType reflect.Type, value bson.Raw) error {
+	if goType != nil && !mayContainExtension(goType) {
+		return nil
+	}
+	depth, err := rawExtensionDepth(value, 1, maxExtensionDepth, false)
+	if err != nil {
+		return err
+	}
+	if depth > maxExtensionDepth {
+		return fmt.Errorf("Couldn't unmarshal extension: extensions are nested more than %d deep", maxExtensionDepth)
+	}
+	return nil
+}
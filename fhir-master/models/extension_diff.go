@@ -0,0 +1,60 @@
+package models
+
+// ExtensionChangeKind is how an extension differs between two versions of a resource, named as in JSON Patch
+type ExtensionChangeKind string
+
+const (
+	ExtensionAdded   ExtensionChangeKind = "add"
+	ExtensionRemoved ExtensionChangeKind = "remove"
+	ExtensionChanged ExtensionChangeKind = "replace"
+)
+
+// ExtensionChange is one difference found by DiffExtensions. Old is nil for added extensions
+// and New is nil for removed ones.
+type ExtensionChange struct {
+	Url       string
+	ElementID string
+	Kind      ExtensionChangeKind
+	Old       *Extension
+	New       *Extension
+}
+
+type extensionKey struct {
+	url       string
+	elementID string
+}
+
+// DiffExtensions compares two versions of a list of extensions. Extensions are matched by url and
+// element id, in order if the same url appears more than once, and compared with Extension.Equal.
+// Changes and removals are returned in the order of oldExts, followed by additions in the order of newExts.
+func DiffExtensions(oldExts, newExts []Extension) []ExtensionChange {
+	unmatched := make(map[extensionKey][]int, len(newExts))
+	for i := range newExts {
+		key := extensionKey{newExts[i].Url, newExts[i].ElementID}
+		unmatched[key] = append(unmatched[key], i)
+	}
+
+	var changes []ExtensionChange
+	matched := make([]bool, len(newExts))
+	for i := range oldExts {
+		key := extensionKey{oldExts[i].Url, oldExts[i].ElementID}
+		candidates := unmatched[key]
+		if len(candidates) == 0 {
+			changes = append(changes, ExtensionChange{Url: key.url, ElementID: key.elementID, Kind: ExtensionRemoved, Old: &oldExts[i]})
+			continue
+		}
+		j := candidates[0]
+		unmatched[key] = candidates[1:]
+		matched[j] = true
+		if !oldExts[i].Equal(newExts[j]) {
+			changes = append(changes, ExtensionChange{Url: key.url, ElementID: key.elementID, Kind: ExtensionChanged, Old: &oldExts[i], New: &newExts[j]})
+		}
+	}
+
+	for j := range newExts {
+		if !matched[j] {
+			changes = append(changes, ExtensionChange{Url: newExts[j].Url, ElementID: newExts[j].ElementID, Kind: ExtensionAdded, New: &newExts[j]})
+		}
+	}
+	return changes
+}
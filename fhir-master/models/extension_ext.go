@@ -1,11 +1,19 @@
 package models
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/golang/glog"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -27,18 +35,164 @@ import (
 //   },
 //   "foo": "bar",
 // }
+//
+// If SetPlainExtensionFormat is enabled it instead becomes
+//
+// bson.D {
+//   {"url", "http://example.org/fhir/extensions/foo"},
+//   {"value", "bar"},
+//   {"__type", "string"},
+// }
+//
+// An ElementID is kept as __elementId, in the @context definition or after __type respectively.
+//
+// Modifier extensions (IsModifier) have their definition under @modifier instead of @context,
+// or __modifier: true at the end in the plain format, so that queries can tell them apart.
 func (e Extension) GetBSON() (interface{}, error) {
-	value := reflect.ValueOf(e)
-	for i := 0; i < value.NumField(); i++ {
-		field := value.Field(i)
-		fieldName := value.Type().Field(i).Name
-		if !strings.HasPrefix(fieldName, "Value") {
-			continue
+	if err := validateExtensionUrl(e.Url); err != nil {
+		return nil, err
+	}
+
+	val, fhirType, err := e.storedValue()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExtensionDepth(e.Url, val); err != nil {
+		return nil, err
+	}
+
+	if plainExtensionFormat {
+		plain := bson.D{
+			{Name: "url", Value: storedExtensionUrl(e.Url)},
+			{Name: "value", Value: val},
+			{Name: "__type", Value: fhirType},
+		}
+		if e.ElementID != "" {
+			plain = append(plain, bson.DocElem{Name: "__elementId", Value: e.ElementID})
+		}
+		if e.IsModifier {
+			plain = append(plain, bson.DocElem{Name: "__modifier", Value: true})
+		}
+		return plain, nil
+	}
+	return bsonExtension(e.Url, fhirType, e.ElementID, e.IsModifier, val)
+}
+
+// contextKey is the name of the document holding an extension's definition
+func contextKey(modifier bool) string {
+	if modifier {
+		return "@modifier"
+	}
+	return "@context"
+}
+
+// Whether GetBSON stores extensions as url, value and __type fields rather than with a JSON-LD @context
+var plainExtensionFormat = false
+
+// SetPlainExtensionFormat switches GetBSON between the default JSON-LD format and a plain one
+// that is smaller and easier for other tools to read. SetBSON reads either format, so existing
+// documents don't need to be migrated when this is changed. MarshalExtensions has no plain
+// equivalent, so it returns an error while this is enabled.
+func SetPlainExtensionFormat(enabled bool) {
+	plainExtensionFormat = enabled
+}
+
+// Extension urls starting with this are stored relative to it; see SetExtensionBaseURL
+var extensionBaseURL = ""
+
+// SetExtensionBaseURL makes extensions whose urls start with base (e.g. "http://example.org/fhir/extensions/")
+// be stored with the rest of the url only, which is expanded again when they are read. Other urls are
+// stored in full. Stored urls that aren't absolute are taken to be relative to base, so it shouldn't
+// be changed once extensions have been stored with it. An empty base turns this off.
+func SetExtensionBaseURL(base string) {
+	extensionBaseURL = base
+	// cached @contexts have the stored form of the url
+	clearCachedContexts()
+}
+
+// Derives the names extensions are stored under from their urls; see SetExtensionKeyFunc
+var extensionKeyFunc func(url string) string
+
+// SetExtensionKeyFunc replaces how the name an extension's value is stored under is derived from its url,
+// which by default is the last segment of the url (e.g. "foo" for "http://example.org/fhir/extensions/foo"),
+// e.g. with a hash to keep the urls out of the keys. The url is always read from the @context, so the
+// function doesn't need to be reversible, but it should give different extensions different names.
+// Names can't be empty, start with $ or @, or contain a dot. A nil fn restores the default.
+// It doesn't apply to the plain format (see SetPlainExtensionFormat), which stores the url itself.
+func SetExtensionKeyFunc(fn func(url string) string) {
+	extensionKeyFunc = fn
+	// cached @contexts include the name
+	clearCachedContexts()
+}
+
+// storedExtensionUrl returns the url relative to the base set with SetExtensionBaseURL, if it has it
+func storedExtensionUrl(extensionUrl string) string {
+	if extensionBaseURL != "" && len(extensionUrl) > len(extensionBaseURL) && strings.HasPrefix(extensionUrl, extensionBaseURL) {
+		return extensionUrl[len(extensionBaseURL):]
+	}
+	return extensionUrl
+}
+
+// expandExtensionUrl is the inverse of storedExtensionUrl
+func expandExtensionUrl(storedUrl string) string {
+	if extensionBaseURL == "" || storedUrl == "" {
+		return storedUrl
+	}
+	if parsed, err := url.Parse(storedUrl); err == nil && parsed.Scheme != "" {
+		return storedUrl
+	}
+	return extensionBaseURL + storedUrl
+}
+
+// Value returns the extension's value (dereferenced if it's a pointer) and its FHIR type as used in @context,
+// or (nil, "") if no value is set.
+func (e *Extension) Value() (interface{}, string) {
+	values, fhirTypes := e.values()
+	if len(values) == 0 {
+		return nil, ""
+	}
+	return values[0], fhirTypes[0]
+}
+
+// storedValue is like Value but for an extension without a value returns an empty string,
+// which is how they have always been stored, or an error if strict validation is enabled.
+// Use EmptyString (or SetValue) to store an empty string deliberately.
+func (e *Extension) storedValue() (interface{}, string, error) {
+	val, fhirType := e.Value()
+	if val == nil {
+		if strictValueValidation {
+			return nil, "", fmt.Errorf("Couldn't marshal extension %s: it has no value", e.Url)
+		}
+		val, fhirType = "", "string"
+	}
+	if n, ok := val.(uint32); ok {
+		// so that nothing is stored that couldn't be read back
+		if err := checkExtensionInteger(fhirType, e.Url, int64(n)); err != nil {
+			return nil, "", err
 		}
+	}
+	return val, fhirType, nil
+}
+
+// values returns all the values set (normally only one), in the order of the fields
+func (e *Extension) values() (values []interface{}, fhirTypes []string) {
+	if e.ValueRaw != nil {
+		values = append(values, e.ValueRaw.Value)
+		fhirTypes = append(fhirTypes, e.ValueRaw.Type)
+	}
+
+	value := reflect.ValueOf(e).Elem()
+	for _, t := range extensionValueTypes {
+		field := value.Field(t.index)
 
 		var val interface{}
 		switch field.Kind() {
-		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		case reflect.Slice:
+			// e.g. ValueReferences
+			if field.Len() > 0 {
+				val = field.Interface()
+			}
+		case reflect.Ptr, reflect.Map, reflect.Interface:
 			if !field.IsNil() {
 				val = field.Elem().Interface()
 				break
@@ -51,26 +205,384 @@ func (e Extension) GetBSON() (interface{}, error) {
 		}
 
 		if val != nil {
-			return bsonExtension(e.Url, getTypeFromValueXFieldName(fieldName), val)
+			values = append(values, val)
+			fhirTypes = append(fhirTypes, t.FHIRType)
 		}
 	}
 
-	// If we got this far, then all values were nil or zero.  This is likely an empty string.
-	return bsonExtension(e.Url, "string", "")
+	// nothing clears EmptyString when another value field is assigned directly, so it only
+	// counts if no other value is set
+	if len(values) == 0 && e.EmptyString {
+		values, fhirTypes = []interface{}{""}, []string{"string"}
+	}
+	return
+}
+
+// Clone returns a deep copy of the extension, so that changes to values behind pointers
+// (e.g. a ValueDecimal or a coding in a ValueCodeableConcept) don't affect the original
+func (e *Extension) Clone() *Extension {
+	return deepCopy(reflect.ValueOf(e)).Interface().(*Extension)
+}
+
+// deepCopy copies pointers, slices, maps and interfaces recursively. Unexported struct fields
+// (e.g. time.Time's location) are copied shallowly.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.New(v.Type().Elem())
+		copied.Elem().Set(deepCopy(v.Elem()))
+		return copied
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			copied.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return copied
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, key := range v.MapKeys() {
+			copied.SetMapIndex(deepCopy(key), deepCopy(v.MapIndex(key)))
+		}
+		return copied
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(deepCopy(v.Elem()))
+		return copied
+	case reflect.Struct:
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if copied.Field(i).CanSet() {
+				copied.Field(i).Set(deepCopy(v.Field(i)))
+			}
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// Equal compares extensions by the meaning of their values rather than their representation:
+// times by the instant they refer to (not their location), decimals by their string form (ignoring
+// the derived search range) and references by the resource type and id they resolve to.
+func (e Extension) Equal(other Extension) bool {
+	return semanticEqual(reflect.ValueOf(e), reflect.ValueOf(other))
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	decimalType   = reflect.TypeOf(Decimal{})
+	referenceType = reflect.TypeOf(Reference{})
+)
+
+func semanticEqual(a, b reflect.Value) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+
+	switch a.Type() {
+	case timeType:
+		return a.Interface().(time.Time).Equal(b.Interface().(time.Time))
+	case decimalType:
+		decimalA, decimalB := a.Interface().(Decimal), b.Interface().(Decimal)
+		if decimalA.Str == "" && decimalB.Str == "" {
+			return decimalA.Num == decimalB.Num
+		}
+		return decimalA.Str == decimalB.Str
+	case referenceType:
+		refA, refB := reference(a.Interface().(Reference)), reference(b.Interface().(Reference))
+		refA.expand()
+		refB.expand()
+		if refA.ReferencedID != "" || refB.ReferencedID != "" {
+			if refA.Type != refB.Type || refA.ReferencedID != refB.ReferencedID || refA.Version != refB.Version {
+				return false
+			}
+		} else if refA.Reference != refB.Reference {
+			return false
+		}
+		return refA.Display == refB.Display && semanticEqual(reflect.ValueOf(refA.Identifier), reflect.ValueOf(refB.Identifier))
+	}
+
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() && b.IsNil()
+		}
+		return semanticEqual(a.Elem(), b.Elem())
+	case reflect.Slice:
+		// nil and empty slices are the same when stored
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !semanticEqual(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for _, key := range a.MapKeys() {
+			valueB := b.MapIndex(key)
+			if !valueB.IsValid() || !semanticEqual(a.MapIndex(key), valueB) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !semanticEqual(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.String:
+		return a.String() == b.String()
+	default:
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	}
+}
+
+// MarshalExtensions builds a single document with one combined @context for all the extensions,
+// equivalent to merging the documents produced by GetBSON for each of them. Modifier extensions
+// are defined in a combined @modifier instead, which is left out if there are none.
+// UnmarshalMergedExtensions reads the document back.
+//
+// In the plain format (see SetPlainExtensionFormat) each extension is a document of its own, so
+// while it is enabled extensions can't be combined and MarshalExtensions returns an error.
+func MarshalExtensions(extensions []Extension) (bson.M, error) {
+	if plainExtensionFormat {
+		return nil, errors.New("Couldn't marshal extensions; the plain extension format doesn't combine them into one document")
+	}
+	context := make(bson.M, len(extensions))
+	modifiers := bson.M{}
+	merged := make(bson.M, len(extensions)+1)
+	merged["@context"] = context
+
+	for i := range extensions {
+		if err := validateExtensionUrl(extensions[i].Url); err != nil {
+			return nil, err
+		}
+		name, err := extensionName(extensions[i].Url)
+		if err != nil {
+			return nil, err
+		}
+		if _, duplicate := merged[name]; duplicate || name == "@context" || name == "@modifier" {
+			return nil, fmt.Errorf("Couldn't marshal extensions; more than one is named %s", name)
+		}
+
+		value, fhirType, err := extensions[i].storedValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkExtensionDepth(extensions[i].Url, value); err != nil {
+			return nil, err
+		}
+		definition := contextDefinition{ID: storedExtensionUrl(extensions[i].Url), Type: fhirType, ElementID: extensions[i].ElementID}
+		if extensions[i].IsModifier {
+			modifiers[name] = definition
+			merged["@modifier"] = modifiers
+		} else {
+			context[name] = definition
+		}
+		merged[name] = value
+	}
+	return merged, nil
+}
+
+// UnmarshalMergedExtensions reads a document written by MarshalExtensions (or MarshalExtensionsCanonical)
+// back into the extensions, in the order their values are stored
+func UnmarshalMergedExtensions(raw bson.Raw) ([]Extension, error) {
+	if raw.Kind != 0x03 {
+		return nil, fmt.Errorf("Couldn't unmarshal extensions; expected a document, not BSON kind 0x%02X", raw.Kind)
+	}
+	var rd bson.RawD
+	if err := raw.Unmarshal(&rd); err != nil {
+		return nil, err
+	}
+
+	var context, modifiers map[string]contextDefinition
+	for i := range rd {
+		var err error
+		switch rd[i].Name {
+		case "@context":
+			err = rd[i].Value.Unmarshal(&context)
+		case "@modifier":
+			err = rd[i].Value.Unmarshal(&modifiers)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't unmarshal extensions; invalid %s: %s", rd[i].Name, err)
+		}
+	}
+
+	extensions := make([]Extension, 0, len(rd))
+	for i := range rd {
+		if rd[i].Name == "@context" || rd[i].Name == "@modifier" {
+			continue
+		}
+		definition, found := context[rd[i].Name]
+		_, modifier := modifiers[rd[i].Name]
+		if modifier {
+			definition, found = modifiers[rd[i].Name], true
+		}
+		if !found {
+			return nil, fmt.Errorf("Couldn't unmarshal extensions; key %s not found in @context", rd[i].Name)
+		}
+
+		var ext Extension
+		if err := ext.setStoredValue(expandExtensionUrl(definition.ID), definition.Type, rd[i]); err != nil {
+			return nil, err
+		}
+		ext.ElementID = definition.ElementID
+		ext.IsModifier = modifier
+		extensions = append(extensions, ext)
+	}
+	return extensions, nil
+}
+
+// SortExtensions puts extensions into a canonical order, by url and then by element id, so that
+// the same extensions always serialize the same way whatever order they were built in
+func SortExtensions(extensions []Extension) {
+	sort.SliceStable(extensions, func(i, j int) bool {
+		if extensions[i].Url != extensions[j].Url {
+			return extensions[i].Url < extensions[j].Url
+		}
+		return extensions[i].ElementID < extensions[j].ElementID
+	})
+}
+
+// MarshalExtensionsCanonical is like MarshalExtensions but sorts (a copy of) the extensions with
+// SortExtensions and returns an ordered document, as a bson.M is marshalled in random order.
+// The same extensions in any order therefore marshal to the same bytes.
+func MarshalExtensionsCanonical(extensions []Extension) (bson.D, error) {
+	sorted := append([]Extension(nil), extensions...)
+	SortExtensions(sorted)
+	merged, err := MarshalExtensions(sorted)
+	if err != nil {
+		return nil, err
+	}
+
+	var context, modifiers, values bson.D
+	for i := range sorted {
+		name, err := extensionName(sorted[i].Url)
+		if err != nil {
+			return nil, err
+		}
+		if sorted[i].IsModifier {
+			modifiers = append(modifiers, bson.DocElem{Name: name, Value: merged["@modifier"].(bson.M)[name]})
+		} else {
+			context = append(context, bson.DocElem{Name: name, Value: merged["@context"].(bson.M)[name]})
+		}
+		values = append(values, bson.DocElem{Name: name, Value: merged[name]})
+	}
+
+	doc := bson.D{{Name: "@context", Value: context}}
+	if modifiers != nil {
+		doc = append(doc, bson.DocElem{Name: "@modifier", Value: modifiers})
+	}
+	return append(doc, values...), nil
+}
+
+// validateExtensionUrl checks that url is absolute (as FHIR requires) when strict validation is enabled
+func validateExtensionUrl(extensionUrl string) error {
+	if !strictValueValidation {
+		return nil
+	}
+	return checkAbsoluteUrl(extensionUrl)
+}
+
+func checkAbsoluteUrl(extensionUrl string) error {
+	parsed, err := url.Parse(extensionUrl)
+	if err != nil {
+		return fmt.Errorf("Invalid extension url %q: %s", extensionUrl, err)
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return fmt.Errorf("Invalid extension url %q: must be an absolute URL with a scheme and host", extensionUrl)
+	}
+	return nil
+}
+
+// UnmarshalExtensions decodes a stored array of extensions one at a time, calling fn with each
+// in order, so that the whole array never has to be held in memory at once.
+// It stops at the first error, from decoding or from fn.
+func UnmarshalExtensions(raw bson.Raw, fn func(Extension) error) error {
+	if raw.Kind != 0x04 {
+		return fmt.Errorf("Couldn't unmarshal extensions; expected an array, not BSON kind 0x%02X", raw.Kind)
+	}
+	// the elements of the array are left as slices of raw
+	var elements []bson.Raw
+	if err := raw.Unmarshal(&elements); err != nil {
+		return err
+	}
+	for _, element := range elements {
+		var extension Extension
+		if err := extension.SetBSON(element); err != nil {
+			return err
+		}
+		if err := fn(extension); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extensionName(url string) (string, error) {
+	if extensionKeyFunc != nil {
+		name := extensionKeyFunc(url)
+		if name == "" || strings.HasPrefix(name, "$") || strings.HasPrefix(name, "@") || strings.Contains(name, ".") {
+			return "", fmt.Errorf("Couldn't store extension %s under the name %q from the extension key function", url, name)
+		}
+		return name, nil
+	}
+	i := strings.LastIndex(url, "/")
+	if i < 0 || i == (len(url)-1) {
+		return "", fmt.Errorf("Couldn't determine extension name for %s", url)
+	}
+	return url[i+1:], nil
 }
 
-func bsonExtension(url string, fhirType string, value interface{}) (extension bson.M, err error) {
-	var i int
-	if i = strings.LastIndex(url, "/"); i < 0 || i == (len(url)-1) {
-		err = fmt.Errorf("Couldn't determine extension name for %s", url)
+func bsonExtension(url string, fhirType string, elementID string, modifier bool, value interface{}) (extension bson.M, err error) {
+	if elementID == "" {
+		if context, found := cachedContext(url, fhirType); found {
+			return bson.M{contextKey(modifier): context.clone(), context.name: value}, nil
+		}
+	}
+
+	name, err := extensionName(url)
+	if err != nil {
 		return
 	}
-	name := url[i+1:]
+	if elementID == "" {
+		cacheContext(url, fhirType, name)
+	}
 	extension = bson.M{
-		"@context": bson.M{
+		contextKey(modifier): bson.M{
 			name: contextDefinition{
-				ID:   url,
-				Type: fhirType,
+				ID:        storedExtensionUrl(url),
+				Type:      fhirType,
+				ElementID: elementID,
 			},
 		},
 		name: value,
@@ -78,6 +590,59 @@ func bsonExtension(url string, fhirType string, value interface{}) (extension bs
 	return
 }
 
+// A marshalled @context for an extension url and type, which is the same for every extension
+// with them, so that bulk ingest doesn't build and marshal the same @context over and over
+type extensionContext struct {
+	name    string
+	context bson.Raw
+}
+
+type extensionContextKey struct {
+	url      string
+	fhirType string
+}
+
+// The cache stops growing at maxCachedContexts, as extension urls come from clients
+const maxCachedContexts = 1000
+
+var extensionContexts sync.Map // extensionContextKey -> *extensionContext
+var cachedContexts int32
+
+func cachedContext(url string, fhirType string) (*extensionContext, bool) {
+	context, found := extensionContexts.Load(extensionContextKey{url, fhirType})
+	if !found {
+		return nil, false
+	}
+	return context.(*extensionContext), true
+}
+
+func cacheContext(url string, fhirType string, name string) {
+	if atomic.LoadInt32(&cachedContexts) >= maxCachedContexts {
+		return
+	}
+	data, err := bson.Marshal(bson.M{name: contextDefinition{ID: storedExtensionUrl(url), Type: fhirType}})
+	if err != nil {
+		return
+	}
+	context := &extensionContext{name: name, context: bson.Raw{Kind: 0x03, Data: data}}
+	if _, loaded := extensionContexts.LoadOrStore(extensionContextKey{url, fhirType}, context); !loaded {
+		atomic.AddInt32(&cachedContexts, 1)
+	}
+}
+
+func clearCachedContexts() {
+	extensionContexts.Range(func(key, _ interface{}) bool {
+		extensionContexts.Delete(key)
+		return true
+	})
+	atomic.StoreInt32(&cachedContexts, 0)
+}
+
+// clone copies the marshalled @context so that the cached one can't be changed through the returned document
+func (c *extensionContext) clone() bson.Raw {
+	return bson.Raw{Kind: c.context.Kind, Data: append([]byte(nil), c.context.Data...)}
+}
+
 // SetBSON translates the stored extension syntax to the FHIR extension syntax.
 //
 // bson.M {
@@ -96,69 +661,403 @@ func bsonExtension(url string, fhirType string, value interface{}) (extension bs
 //   Url: "http://example.org/fhir/extensions/foo",
 //   ValueString: "bar",
 // }
+//
+// Extensions stored in the plain format (see SetPlainExtensionFormat) are also recognised,
+// and ones with @modifier instead of @context are modifier extensions.
 func (e *Extension) SetBSON(raw bson.Raw) error {
 	// Since we don't know the exact structure (property names), use a streaming approach with bson.RawD
 	var rd bson.RawD
-	err := raw.Unmarshal(&rd)
-	if err != nil {
+	if err := raw.Unmarshal(&rd); err != nil {
 		return err
 	}
 
-	// Ensure there are only two sub-documents, then identify them
+	if plain, err := e.setPlainBSON(rd); plain || err != nil {
+		return err
+	}
+
+	// Ensure there are only two sub-documents (or just the data, see setInferredBSON), then identify them
+	if len(rd) == 1 && rd[0].Name != "@context" && rd[0].Name != "@modifier" {
+		return e.setInferredBSON(rd[0])
+	}
 	if len(rd) != 2 {
 		return errors.New("Couldn't properly unmarshal extension; unrecognized format in BSON")
 	}
-	var context map[string]contextDefinition
-	var dataElement bson.RawDocElem
+	var contextElement, dataElement *bson.RawDocElem
 	for i := range rd {
 		switch rd[i].Name {
-		case "@context":
-			rd[i].Value.Unmarshal(&context)
+		case "@context", "@modifier":
+			contextElement = &rd[i]
+		default:
+			dataElement = &rd[i]
+		}
+	}
+	if contextElement == nil || dataElement == nil {
+		return errors.New("Couldn't properly unmarshal extension; unrecognized format in BSON")
+	}
+
+	// Only the definition of the data element is needed, so avoid building a map of the whole @context
+	var definition contextDefinition
+	found, err := findContextDefinition(contextElement.Value, dataElement.Name, &definition)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return e.setInferredBSON(*dataElement)
+	}
+
+	if err := e.setStoredValue(expandExtensionUrl(definition.ID), definition.Type, *dataElement); err != nil {
+		return err
+	}
+	e.ElementID = definition.ElementID
+	e.IsModifier = contextElement.Name == "@modifier"
+	return nil
+}
+
+// warningf reports stored data that can still be read but isn't as it should be; replaced in tests
+var warningf = glog.Warningf
+
+// setInferredBSON unmarshals an extension whose @context definition is missing (e.g. in hand-written
+// test data), working out the type from the kind of BSON value. Without the @id, the url is
+// the name of the value (relative to the base set with SetExtensionBaseURL, if any).
+func (e *Extension) setInferredBSON(dataElement bson.RawDocElem) error {
+	fhirType, err := inferExtensionType(dataElement.Value)
+	if err != nil {
+		return fmt.Errorf("Couldn't properly unmarshal extension; key %s not found in @context and %s", dataElement.Name, err)
+	}
+	warningf("extension %s has no @context definition; treating it as a %s", dataElement.Name, fhirType)
+	return e.setStoredValue(expandExtensionUrl(dataElement.Name), fhirType, dataElement)
+}
+
+// inferExtensionType guesses the @type of a stored value from its BSON kind
+func inferExtensionType(value bson.Raw) (string, error) {
+	switch value.Kind {
+	case 0x01:
+		return "decimal", nil
+	case 0x02:
+		return "string", nil
+	case 0x08:
+		return "boolean", nil
+	case 0x09:
+		return "dateTime", nil
+	case 0x10, 0x12:
+		return "integer", nil
+	case 0x03:
+		// FHIRDateTime.GetBSON's {__from, __to, __strDate}
+		var date struct {
+			StrDate string `bson:"__strDate"`
+		}
+		if err := value.Unmarshal(&date); err == nil && date.StrDate != "" {
+			return "dateTime", nil
+		}
+		return "", errors.New("the type of a document can't be inferred")
+	}
+	return "", fmt.Errorf("the type of BSON kind 0x%02X can't be inferred", value.Kind)
+}
+
+// setPlainBSON unmarshals the format written when SetPlainExtensionFormat is enabled,
+// returning false if the document is in some other format
+func (e *Extension) setPlainBSON(rd []bson.RawDocElem) (plain bool, err error) {
+	if len(rd) < 3 || len(rd) > 5 {
+		return false, nil
+	}
+	var url, fhirType, elementID string
+	var modifier bool
+	var valueElement *bson.RawDocElem
+	for i := range rd {
+		switch rd[i].Name {
+		case "url":
+			err = rd[i].Value.Unmarshal(&url)
+		case "__type":
+			err = rd[i].Value.Unmarshal(&fhirType)
+		case "__elementId":
+			err = rd[i].Value.Unmarshal(&elementID)
+		case "__modifier":
+			err = rd[i].Value.Unmarshal(&modifier)
+		case "value":
+			valueElement = &rd[i]
 		default:
-			dataElement = rd[i]
+			return false, nil
 		}
+		if err != nil {
+			return true, fmt.Errorf("Couldn't properly unmarshal extension; invalid %s: %s", rd[i].Name, err)
+		}
+	}
+	extra := 0
+	if elementID != "" {
+		extra++
+	}
+	if modifier {
+		extra++
 	}
-	if _, ok := context[dataElement.Name]; !ok {
-		return fmt.Errorf("Couldn't properly unmarshal extension; key %s not found in @context", dataElement.Name)
+	if valueElement == nil || len(rd) != 3+extra {
+		return false, nil
 	}
+	if err = e.setStoredValue(expandExtensionUrl(url), fhirType, *valueElement); err != nil {
+		return true, err
+	}
+	e.ElementID = elementID
+	e.IsModifier = modifier
+	return true, nil
+}
 
+// setStoredValue sets the URL and the Value[x] field for fhirType from its stored form
+func (e *Extension) setStoredValue(url string, fhirType string, dataElement bson.RawDocElem) error {
 	// Use reflection to find the value field we must set
-	fhirType := context[dataElement.Name].Type
-	fieldName := fmt.Sprintf("Value%s%s", strings.ToUpper(fhirType[:1]), fhirType[1:])
-	field := reflect.ValueOf(e).Elem().FieldByName(fieldName)
-	if !field.IsValid() {
-		return fmt.Errorf("Couldn't find extension field %s", fieldName)
-	} else if !field.CanSet() {
-		return fmt.Errorf("Couldn't set a value for field %s", fieldName)
-	}
-
-	// Use reflection to set the field
-	val := reflect.New(field.Type())
-	if err := dataElement.Value.Unmarshal(val.Interface()); err != nil {
+	valueType, known := LookupExtensionValueType(fhirType)
+	if err := checkRawExtensionDepth(valueType.GoType, dataElement.Value); err != nil {
 		return err
 	}
-	field.Set(val.Elem())
+	if !known {
+		if preserveUnknownExtensionTypes {
+			var value interface{}
+			if err := dataElement.Value.Unmarshal(&value); err != nil {
+				return err
+			}
+			e.Url = url
+			e.ValueRaw = &RawValue{Type: fhirType, Value: value}
+			return nil
+		}
+		return fmt.Errorf("Couldn't unmarshal extension %s: unknown @type %q", url, fhirType)
+	}
+
+	if err := validateExtensionInteger(fhirType, dataElement); err != nil {
+		return err
+	}
+
+	// Unmarshal straight into the field
+	field := reflect.ValueOf(e).Elem().Field(valueType.index)
+	if err := dataElement.Value.Unmarshal(field.Addr().Interface()); err != nil {
+		return err
+	}
+	if e.ValueInstant != nil {
+		e.ValueInstant.Precision = Instant
+	}
+	e.EmptyString = valueType.FieldName == "ValueString" && e.ValueString == ""
 
 	// Now set the URL
-	e.Url = context[dataElement.Name].ID
+	e.Url = url
 
 	return nil
 }
 
-type contextDefinition struct {
-	ID   string `bson:"@id,omitempty"`
-	Type string `bson:"@type,omitempty"`
+// FHIR integers (including unsignedInt and positiveInt) are limited to 32-bit signed values
+const maxFHIRInteger = 1<<31 - 1
+
+// validateExtensionInteger checks the range constraints of unsignedInt (0 or more) and positiveInt (1 or more)
+func validateExtensionInteger(fhirType string, dataElement bson.RawDocElem) error {
+	if fhirType != "unsignedInt" && fhirType != "positiveInt" {
+		return nil
+	}
+	var value int64
+	if err := dataElement.Value.Unmarshal(&value); err != nil {
+		return fmt.Errorf("Couldn't unmarshal %s extension %s: %s", fhirType, dataElement.Name, err)
+	}
+	return checkExtensionInteger(fhirType, dataElement.Name, value)
 }
 
-// getTypeFromValueXFieldName takes in a FHIR type with an uppercase letter and fixes it so it is lowercase if
-// it is a FHIR "primitive". This function has little to no value outside of the intended use case -- which is
-// to create the right type based on the field names for extension Value[x] properties.
-func getTypeFromValueXFieldName(valueField string) string {
-	fhirType := strings.TrimPrefix(valueField, "Value")
+// checkExtensionInteger checks that an unsignedInt or positiveInt value is within its range, up to
+// the largest FHIR integer. Other types are ignored.
+func checkExtensionInteger(fhirType string, name string, value int64) error {
+	var min int64
 	switch fhirType {
-	case "Instant", "Time", "Date", "DateTime", "Decimal", "Boolean", "Integer", "String", "Uri", "Base64Binary",
-		"UnsignedInt", "PositiveInt", "Code", "Id", "Markdown", "Oid":
-		fhirType = fmt.Sprintf("%s%s", strings.ToLower(fhirType[:1]), fhirType[1:])
+	case "unsignedInt":
+		min = 0
+	case "positiveInt":
+		min = 1
+	default:
+		return nil
+	}
+	if value < min || value > maxFHIRInteger {
+		return fmt.Errorf("Invalid %s extension %s: %d is outside the range %d to %d", fhirType, name, value, min, maxFHIRInteger)
+	}
+	return nil
+}
+
+func findContextDefinition(context bson.Raw, name string, definition *contextDefinition) (found bool, err error) {
+	var rd bson.RawD
+	if err := context.Unmarshal(&rd); err != nil {
+		return false, err
+	}
+	for i := range rd {
+		if rd[i].Name == name {
+			return true, rd[i].Value.Unmarshal(definition)
+		}
+	}
+	return false, nil
+}
+
+// SetValue sets the Value[x] field for fhirType (e.g. "string" or "CodeableConcept"), clearing any other value.
+// v can be of the field's type or, for pointer fields, the type pointed to.
+func (e *Extension) SetValue(fhirType string, v interface{}) error {
+	if fhirType == "" {
+		return errors.New("SetValue: missing FHIR type")
+	}
+	valueType, known := LookupExtensionValueType(strings.TrimPrefix(valueFieldName(fhirType), "Value"))
+	if !known {
+		return fmt.Errorf("SetValue: unsupported extension type %s", fhirType)
+	}
+	field := reflect.ValueOf(e).Elem().Field(valueType.index)
+
+	val := reflect.ValueOf(v)
+	if !val.IsValid() {
+		return fmt.Errorf("SetValue: nil value for extension type %s", fhirType)
+	}
+	if field.Kind() == reflect.Ptr && val.Type() == field.Type().Elem() {
+		ptr := reflect.New(val.Type())
+		ptr.Elem().Set(val)
+		val = ptr
+	}
+	if val.Type() != field.Type() {
+		return fmt.Errorf("SetValue: a %T can't be used as an extension value of type %s (%s)", v, fhirType, field.Type())
+	}
+
+	// clear the existing value
+	ext := reflect.ValueOf(e).Elem()
+	for i := 0; i < ext.NumField(); i++ {
+		if strings.HasPrefix(ext.Type().Field(i).Name, "Value") {
+			ext.Field(i).Set(reflect.Zero(ext.Field(i).Type()))
+		}
+	}
+	field.Set(val)
+	e.EmptyString = valueType.FieldName == "ValueString" && e.ValueString == ""
+	return nil
+}
+
+func valueFieldName(fhirType string) string {
+	if fhirType == "" {
+		return ""
+	}
+	return fmt.Sprintf("Value%s%s", strings.ToUpper(fhirType[:1]), fhirType[1:])
+}
+
+// Whether SetBSON keeps values of an unrecognised @type in ValueRaw rather than failing
+var preserveUnknownExtensionTypes = false
+
+// SetPreserveUnknownExtensionTypes controls what happens to stored extensions with an @type this
+// version doesn't know about (e.g. written by a newer version): when enabled they are kept in ValueRaw
+// and written back unchanged, otherwise unmarshalling them fails.
+func SetPreserveUnknownExtensionTypes(enabled bool) {
+	preserveUnknownExtensionTypes = enabled
+}
+
+// MarshalJSON writes the extension in the FHIR JSON format, e.g. {"url": "...", "valueString": "bar"},
+// regardless of how it is stored. An ElementID is written as {"_valueString": {"id": "..."}}.
+func (e Extension) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"url":`)
+	urlJSON, err := json.Marshal(e.Url)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(urlJSON)
+
+	var value interface{}
+	var key string
+	if e.ValueRaw != nil {
+		value, key = e.ValueRaw.Value, "v"+valueFieldName(e.ValueRaw.Type)[1:]
+	} else if _, fhirType := e.Value(); fhirType != "" {
+		// marshal the field itself, as some types (e.g. Reference) only implement json.Marshaler on pointers
+		valueType, _ := LookupExtensionValueType(fhirType)
+		value, key = reflect.ValueOf(&e).Elem().Field(valueType.index).Interface(), valueType.JSONKey()
+	}
+	if key == "" {
+		buf.WriteString("}")
+		return buf.Bytes(), nil
 	}
-	return fhirType
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't marshal extension %s: %s", e.Url, err)
+	}
+	fmt.Fprintf(&buf, `,"%s":`, key)
+	buf.Write(data)
+
+	if e.ElementID != "" {
+		id, err := json.Marshal(e.ElementID)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, `,"_%s":{"id":%s}`, key, id)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON reads an extension in the FHIR JSON format. Values of an unknown type are an error
+// unless SetPreserveUnknownExtensionTypes is enabled, in which case they are kept in ValueRaw.
+func (e *Extension) UnmarshalJSON(data []byte) error {
+	var elements map[string]json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return err
+	}
+
+	ext := Extension{}
+	if urlJSON, found := elements["url"]; found {
+		if err := json.Unmarshal(urlJSON, &ext.Url); err != nil {
+			return fmt.Errorf("Couldn't unmarshal extension; invalid url: %s", err)
+		}
+	}
+
+	var valueKey string
+	for key, raw := range elements {
+		if !strings.HasPrefix(key, "value") || len(key) == len("value") {
+			continue
+		}
+		if valueKey != "" {
+			return fmt.Errorf("Couldn't unmarshal extension %s; it has both %s and %s", ext.Url, valueKey, key)
+		}
+		valueKey = key
+
+		valueType, known := LookupExtensionValueType(key[len("value"):])
+		if !known {
+			fhirType := key[len("value"):]
+			if !preserveUnknownExtensionTypes {
+				return fmt.Errorf("Couldn't unmarshal extension %s: unknown type %s", ext.Url, key)
+			}
+			var value interface{}
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return err
+			}
+			if _, isObject := value.(map[string]interface{}); !isObject {
+				// primitive type names start with a lowercase letter
+				fhirType = strings.ToLower(fhirType[:1]) + fhirType[1:]
+			}
+			ext.ValueRaw = &RawValue{Type: fhirType, Value: value}
+			continue
+		}
+
+		field := reflect.ValueOf(&ext).Elem().Field(valueType.index)
+		if err := json.Unmarshal(raw, field.Addr().Interface()); err != nil {
+			return fmt.Errorf("Couldn't unmarshal extension %s: invalid %s: %s", ext.Url, key, err)
+		}
+	}
+	if ext.ValueInstant != nil {
+		ext.ValueInstant.Precision = Instant
+	}
+	ext.EmptyString = valueKey == "valueString" && ext.ValueString == ""
+
+	if raw, found := elements["_"+valueKey]; found && valueKey != "" {
+		var element struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(raw, &element); err != nil {
+			return fmt.Errorf("Couldn't unmarshal extension %s: invalid _%s: %s", ext.Url, valueKey, err)
+		}
+		ext.ElementID = element.ID
+	}
+
+	*e = ext
+	return nil
+}
+
+// RawValue holds an extension value of an unrecognised @type
+type RawValue struct {
+	Type  string
+	Value interface{}
+}
+
+type contextDefinition struct {
+	ID        string `bson:"@id,omitempty"`
+	Type      string `bson:"@type,omitempty"`
+	ElementID string `bson:"__elementId,omitempty"`
 }
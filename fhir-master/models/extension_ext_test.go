@@ -1,8 +1,18 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
 	"time"
 
+	"github.com/golang/glog"
 	"github.com/pebbe/util"
 	check "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2/bson"
@@ -203,7 +213,8 @@ func (e *ExtensionSuite) TestMarshalCodeableConceptExtension(c *check.C) {
 				bson.M{"system": "http://example.org/fhir/valuesets/foo", "code": "bar"},
 				bson.M{"system": "http://example.org/fhir/valuesets/fooz", "code": "barz"},
 			},
-			"text": "bar",
+			"text":     "bar",
+			"__tokens": []interface{}{"bar"},
 		},
 	}
 
@@ -398,6 +409,29 @@ func (e *ExtensionSuite) TestUnmarshalDateTimeExtension(c *check.C) {
 	c.Assert(ext.ValueDateTime.Time.Unix(), check.Equals, expected.ValueDateTime.Time.Unix())
 }
 
+func (e *ExtensionSuite) TestMarshalAndUnmarshalPlainInstantExtension(c *check.C) {
+	SetPlainInstantDates(true)
+	defer SetPlainInstantDates(false)
+
+	ext := &Extension{
+		Url:          "http://example.org/fhir/extensions/recorded",
+		ValueInstant: &FHIRDateTime{Time: time.Date(2012, time.March, 1, 12, 0, 0, 125000000, time.UTC), Precision: Instant},
+	}
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	_, isTime := m["recorded"].(time.Time)
+	c.Assert(isTime, check.Equals, true, check.Commentf("stored as %T", m["recorded"]))
+
+	var read Extension
+	util.CheckErr(bson.Unmarshal(data, &read))
+	c.Assert(read.Url, check.Equals, ext.Url)
+	c.Assert(read.ValueInstant.Precision, check.Equals, Precision(Instant))
+	c.Assert(read.ValueInstant.Time.Equal(ext.ValueInstant.Time), check.Equals, true)
+}
+
 func (e *ExtensionSuite) TestMarshalRangeExtension(c *check.C) {
 	// l := float64(10)
 	// h := float64(20)
@@ -426,16 +460,18 @@ func (e *ExtensionSuite) TestMarshalRangeExtension(c *check.C) {
 				"value": bson.M{
 							"__to": float64(10.5),
 							"__from": float64(9.5),
-							"__num": float64(10),
+							"__num": int64(10),
 							"__strNum": "10",
+							"__sig": 0,
 						},
 				"unit": "mm"},
 			"high":  bson.M{
 				"value": bson.M{
 							"__to": float64(20.5),
 							"__from": float64(19.5),
-							"__num": float64(20),
+							"__num": int64(20),
 							"__strNum": "20",
+							"__sig": 0,
 						},
 				"unit": "mm"},
 		},
@@ -507,3 +543,2553 @@ func (e *ExtensionSuite) TestUnmarshalRangeExtension(c *check.C) {
 
 	c.Assert(ext, check.DeepEquals, expected)
 }
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalStringTypedExtensions(c *check.C) {
+	tests := []struct {
+		fhirType string
+		ext      Extension
+	}{
+		{"uri", Extension{Url: "http://example.org/fhir/extensions/foo", ValueUri: "http://example.org/bar"}},
+		{"code", Extension{Url: "http://example.org/fhir/extensions/foo", ValueCode: "bar"}},
+		{"markdown", Extension{Url: "http://example.org/fhir/extensions/foo", ValueMarkdown: "*bar*"}},
+		{"id", Extension{Url: "http://example.org/fhir/extensions/foo", ValueId: "bar-1"}},
+		{"oid", Extension{Url: "http://example.org/fhir/extensions/foo", ValueOid: "urn:oid:1.2.3"}},
+		{"base64Binary", Extension{Url: "http://example.org/fhir/extensions/foo", ValueBase64Binary: "YmFy"}},
+	}
+
+	for _, test := range tests {
+		data, err := bson.Marshal(&test.ext)
+		util.CheckErr(err)
+
+		var m bson.M
+		err = bson.Unmarshal(data, &m)
+		util.CheckErr(err)
+
+		c.Assert(m["@context"], check.DeepEquals, bson.M{
+			"foo": bson.M{
+				"@id":   "http://example.org/fhir/extensions/foo",
+				"@type": test.fhirType,
+			},
+		}, check.Commentf("type %s", test.fhirType))
+
+		var ext Extension
+		err = bson.Unmarshal(data, &ext)
+		util.CheckErr(err)
+
+		c.Assert(ext, check.DeepEquals, test.ext, check.Commentf("type %s", test.fhirType))
+	}
+}
+
+func (e *ExtensionSuite) TestMarshalUnsignedAndPositiveIntExtensions(c *check.C) {
+	tests := []struct {
+		fhirType string
+		value    uint32
+		valid    bool
+	}{
+		{"unsignedInt", 0, true},
+		{"unsignedInt", 2147483647, true},
+		{"unsignedInt", 2147483648, false},
+		{"positiveInt", 0, false},
+		{"positiveInt", 1, true},
+		{"positiveInt", 2147483647, true},
+		{"positiveInt", 2147483648, false},
+	}
+
+	for _, test := range tests {
+		value := test.value
+		ext := Extension{Url: "http://example.org/fhir/extensions/foo"}
+		if test.fhirType == "unsignedInt" {
+			ext.ValueUnsignedInt = &value
+		} else {
+			ext.ValuePositiveInt = &value
+		}
+		comment := check.Commentf("%s %d", test.fhirType, test.value)
+
+		data, err := bson.Marshal(ext)
+		_, batchErr := MarshalExtensions([]Extension{ext})
+		if !test.valid {
+			expected := "Invalid " + test.fhirType + " extension http://example.org/fhir/extensions/foo: .* is outside the range .*"
+			c.Assert(err, check.ErrorMatches, expected, comment)
+			c.Assert(batchErr, check.ErrorMatches, expected, comment)
+			continue
+		}
+		util.CheckErr(err)
+		util.CheckErr(batchErr)
+
+		var unmarshalled Extension
+		util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+		c.Assert(unmarshalled, check.DeepEquals, ext, comment)
+	}
+}
+
+func (e *ExtensionSuite) TestUnmarshalUnsignedAndPositiveIntExtensions(c *check.C) {
+	tests := []struct {
+		fhirType string
+		value    int64
+		valid    bool
+	}{
+		{"unsignedInt", 0, true},
+		{"unsignedInt", 1, true},
+		{"unsignedInt", 2147483647, true},
+		{"unsignedInt", 2147483648, false},
+		{"unsignedInt", -1, false},
+		{"positiveInt", 0, false},
+		{"positiveInt", 1, true},
+		{"positiveInt", 2147483647, true},
+		{"positiveInt", 2147483648, false},
+	}
+
+	for _, test := range tests {
+		data, err := bson.Marshal(bson.M{
+			"@context": bson.M{
+				"foo": bson.M{
+					"@id":   "http://example.org/fhir/extensions/foo",
+					"@type": test.fhirType,
+				},
+			},
+			"foo": test.value,
+		})
+		util.CheckErr(err)
+
+		var ext Extension
+		err = bson.Unmarshal(data, &ext)
+		comment := check.Commentf("%s %d", test.fhirType, test.value)
+		if !test.valid {
+			c.Assert(err, check.ErrorMatches, "Invalid "+test.fhirType+" extension foo: .* is outside the range .*", comment)
+			continue
+		}
+		util.CheckErr(err)
+
+		value := uint32(test.value)
+		expected := Extension{Url: "http://example.org/fhir/extensions/foo"}
+		if test.fhirType == "unsignedInt" {
+			expected.ValueUnsignedInt = &value
+		} else {
+			expected.ValuePositiveInt = &value
+		}
+		c.Assert(ext, check.DeepEquals, expected, comment)
+	}
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalHumanNameExtension(c *check.C) {
+	ext := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueHumanName: &HumanName{
+			Use:    "official",
+			Text:   "Dr John Smith",
+			Family: "Smith",
+			Given:  []string{"John"},
+			Prefix: []string{},
+			Suffix: []string{"Jr"},
+		},
+	}
+
+	expected := bson.M{
+		"@context": bson.M{
+			"foo": bson.M{
+				"@id":   "http://example.org/fhir/extensions/foo",
+				"@type": "HumanName",
+			},
+		},
+		"foo": bson.M{
+			"use":    "official",
+			"text":   "Dr John Smith",
+			"family": "Smith",
+			"given":  []interface{}{"John"},
+			"suffix": []interface{}{"Jr"},
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	// The empty prefix should be omitted rather than stored as an empty array
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m, check.DeepEquals, expected)
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+
+	ext.ValueHumanName.Prefix = nil
+	c.Assert(unmarshalled, check.DeepEquals, *ext)
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalAddressExtension(c *check.C) {
+	ext := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueAddress: &Address{
+			Use:        "home",
+			Line:       []string{},
+			City:       "Melbourne",
+			State:      "VIC",
+			PostalCode: "3000",
+			Country:    "AU",
+			Period: &Period{
+				Start: &FHIRDateTime{Time: time.Date(2010, time.March, 1, 0, 0, 0, 0, time.UTC), Precision: Precision(Date)},
+				End:   &FHIRDateTime{Time: time.Date(2012, time.June, 1, 0, 0, 0, 0, time.UTC), Precision: Precision(YearMonth)},
+			},
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+
+	c.Assert(m["@context"], check.DeepEquals, bson.M{
+		"foo": bson.M{
+			"@id":   "http://example.org/fhir/extensions/foo",
+			"@type": "Address",
+		},
+	})
+	address := m["foo"].(bson.M)
+	c.Assert(address["city"], check.Equals, "Melbourne")
+	_, hasLine := address["line"]
+	c.Assert(hasLine, check.Equals, false)
+
+	// The period is stored using the same date envelope as other dates
+	period := address["period"].(bson.M)
+	start := period["start"].(bson.M)
+	c.Assert(start["__strDate"], check.Equals, "2010-03-01")
+	c.Assert(start["__from"].(time.Time).Unix(), check.Equals, time.Date(2010, time.March, 1, 0, 0, 0, 0, time.UTC).Unix())
+	c.Assert(start["__to"].(time.Time).Unix(), check.Equals, time.Date(2010, time.March, 2, 0, 0, 0, 0, time.UTC).Unix())
+	end := period["end"].(bson.M)
+	c.Assert(end["__strDate"], check.Equals, "2012-06")
+	c.Assert(end["__to"].(time.Time).Unix(), check.Equals, time.Date(2012, time.July, 1, 0, 0, 0, 0, time.UTC).Unix())
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+
+	c.Assert(unmarshalled.Url, check.Equals, ext.Url)
+	c.Assert(unmarshalled.ValueAddress.Line, check.IsNil)
+	c.Assert(unmarshalled.ValueAddress.City, check.Equals, "Melbourne")
+	c.Assert(unmarshalled.ValueAddress.PostalCode, check.Equals, "3000")
+	c.Assert(unmarshalled.ValueAddress.Period.Start.Precision, check.Equals, Precision(Date))
+	c.Assert(unmarshalled.ValueAddress.Period.Start.Time.Format("2006-01-02"), check.Equals, "2010-03-01")
+	c.Assert(unmarshalled.ValueAddress.Period.End.Precision, check.Equals, Precision(YearMonth))
+	c.Assert(unmarshalled.ValueAddress.Period.End.Time.Format("2006-01"), check.Equals, "2012-06")
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalAttachmentExtension(c *check.C) {
+	size := uint32(6)
+	ext := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueAttachment: &Attachment{
+			ContentType: "image/png",
+			Data:        []byte{0x89, 'P', 'N', 'G', 0x00, 0xff},
+			Size:        &size,
+			Title:       "signature",
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	// The data should be stored as BSON binary rather than a base64 string
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["@context"], check.DeepEquals, bson.M{
+		"foo": bson.M{
+			"@id":   "http://example.org/fhir/extensions/foo",
+			"@type": "Attachment",
+		},
+	})
+	c.Assert(m["foo"].(bson.M)["data"], check.DeepEquals, []byte{0x89, 'P', 'N', 'G', 0x00, 0xff})
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(unmarshalled, check.DeepEquals, *ext)
+
+	// JSON has the data base64-encoded
+	jsonBytes, err := json.Marshal(ext.ValueAttachment)
+	util.CheckErr(err)
+	c.Assert(string(jsonBytes), check.Equals, `{"contentType":"image/png","data":"iVBORwD/","size":6,"title":"signature"}`)
+
+	var fromJSON Attachment
+	err = json.Unmarshal(jsonBytes, &fromJSON)
+	util.CheckErr(err)
+	c.Assert(fromJSON.Data, check.DeepEquals, ext.ValueAttachment.Data)
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalCodingMetadataInCodeableConceptExtension(c *check.C) {
+	selected := true
+	ext := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueCodeableConcept: &CodeableConcept{
+			Coding: []Coding{
+				{System: "http://snomed.info/sct", Version: "http://snomed.info/sct/32506021000036107/version/20180731", Code: "22298006"},
+				{System: "http://loinc.org", Code: "LA14035-4", Display: "Myocardial infarction", UserSelected: &selected},
+				{System: "http://hl7.org/fhir/sid/icd-10", Code: "I21"},
+			},
+		},
+	}
+
+	expected := bson.M{
+		"@context": bson.M{
+			"foo": bson.M{
+				"@id":   "http://example.org/fhir/extensions/foo",
+				"@type": "CodeableConcept",
+			},
+		},
+		"foo": bson.M{
+			"coding": []interface{}{
+				bson.M{"system": "http://snomed.info/sct", "version": "http://snomed.info/sct/32506021000036107/version/20180731", "code": "22298006"},
+				bson.M{"system": "http://loinc.org", "code": "LA14035-4", "display": "Myocardial infarction", "__displayLower": "myocardial infarction", "userSelected": true},
+				bson.M{"system": "http://hl7.org/fhir/sid/icd-10", "code": "I21"},
+			},
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	// userSelected is only stored when set
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m, check.DeepEquals, expected)
+
+	// and the codings come back in their original order
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(unmarshalled, check.DeepEquals, *ext)
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalOpenRangeExtensions(c *check.C) {
+	l, err := NewDecimal("10")
+	util.CheckErr(err)
+	h, err := NewDecimal("20")
+	util.CheckErr(err)
+
+	tests := []struct {
+		name  string
+		value Range
+	}{
+		{"low-only", Range{Low: &Quantity{Value: l, Unit: "mm"}}},
+		{"high-only", Range{High: &Quantity{Value: h, Unit: "mm"}}},
+		{"both", Range{Low: &Quantity{Value: l, Unit: "mm"}, High: &Quantity{Value: h, Unit: "mm"}}},
+	}
+
+	for _, test := range tests {
+		value := test.value
+		ext := Extension{Url: "http://example.org/fhir/extensions/foo", ValueRange: &value}
+		comment := check.Commentf(test.name)
+
+		data, err := bson.Marshal(&ext)
+		util.CheckErr(err)
+
+		// a missing bound shouldn't be stored at all
+		var m bson.M
+		err = bson.Unmarshal(data, &m)
+		util.CheckErr(err)
+		stored := m["foo"].(bson.M)
+		_, hasLow := stored["low"]
+		_, hasHigh := stored["high"]
+		c.Assert(hasLow, check.Equals, value.Low != nil, comment)
+		c.Assert(hasHigh, check.Equals, value.High != nil, comment)
+
+		var unmarshalled Extension
+		err = bson.Unmarshal(data, &unmarshalled)
+		util.CheckErr(err)
+		c.Assert(unmarshalled, check.DeepEquals, ext, comment)
+	}
+}
+
+func (e *ExtensionSuite) TestMarshalRangeExtensionUnitsMustMatch(c *check.C) {
+	l, err := NewDecimal("10")
+	util.CheckErr(err)
+	h, err := NewDecimal("20")
+	util.CheckErr(err)
+
+	matching := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueRange: &Range{
+			Low:  &Quantity{Value: l, Unit: "mm", System: "http://unitsofmeasure.org", Code: "mm"},
+			High: &Quantity{Value: h, Unit: "millimetres", System: "http://unitsofmeasure.org", Code: "mm"},
+		},
+	}
+	_, err = bson.Marshal(matching)
+	c.Assert(err, check.IsNil)
+
+	mismatchedUnits := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueRange: &Range{
+			Low:  &Quantity{Value: l, Unit: "mm"},
+			High: &Quantity{Value: h, Unit: "cm"},
+		},
+	}
+	_, err = bson.Marshal(mismatchedUnits)
+	c.Assert(err, check.ErrorMatches, `Range bounds have different units: low "mm" and high "cm"`)
+
+	mismatchedCodes := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueRange: &Range{
+			Low:  &Quantity{Value: l, Unit: "mm", System: "http://unitsofmeasure.org", Code: "mm"},
+			High: &Quantity{Value: h, Unit: "mm", System: "http://unitsofmeasure.org", Code: "cm"},
+		},
+	}
+	_, err = bson.Marshal(mismatchedCodes)
+	c.Assert(err, check.ErrorMatches, `Range bounds have different units: low mm \(.*\) and high cm \(.*\)`)
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalReferenceRangeExtension(c *check.C) {
+	low, err := NewDecimal("3.5")
+	util.CheckErr(err)
+	high, err := NewDecimal("5.5")
+	util.CheckErr(err)
+	start, err := NewFHIRDateTime("2018-01-01")
+	util.CheckErr(err)
+	end, err := NewFHIRDateTime("2018-06-30")
+	util.CheckErr(err)
+
+	ext := Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueReferenceRange: &ReferenceRange{
+			Low:    &Quantity{Value: low, Unit: "mmol/L"},
+			High:   &Quantity{Value: high, Unit: "mmol/L"},
+			Period: &Period{Start: start, End: end},
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m["@context"], check.DeepEquals, bson.M{
+		"foo": bson.M{"@id": "http://example.org/fhir/extensions/foo", "@type": "ReferenceRange"},
+	})
+	stored := m["foo"].(bson.M)
+	c.Assert(stored["low"].(bson.M)["value"].(bson.M)["__strNum"], check.Equals, "3.5")
+	c.Assert(stored["high"].(bson.M)["unit"], check.Equals, "mmol/L")
+	c.Assert(stored["period"].(bson.M)["start"].(bson.M)["__strDate"], check.Equals, "2018-01-01")
+
+	var unmarshalled Extension
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled, check.DeepEquals, ext)
+
+	// open-ended, without a period
+	openEnded := Extension{
+		Url:                 "http://example.org/fhir/extensions/foo",
+		ValueReferenceRange: &ReferenceRange{High: &Quantity{Value: high, Unit: "mmol/L"}},
+	}
+	data, err = bson.Marshal(openEnded)
+	util.CheckErr(err)
+	unmarshalled = Extension{}
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled, check.DeepEquals, openEnded)
+
+	// and in JSON
+	data, err = json.Marshal(ext)
+	util.CheckErr(err)
+	unmarshalled = Extension{}
+	util.CheckErr(json.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled.ValueReferenceRange.Low.Value.Str, check.Equals, "3.5")
+	c.Assert(unmarshalled.ValueReferenceRange.Period.End, check.DeepEquals, end)
+
+	// bounds are checked like a Range's
+	ext.ValueReferenceRange.High.Unit = "mg/dL"
+	_, err = bson.Marshal(ext)
+	c.Assert(err, check.ErrorMatches, `.*Range bounds have different units: low "mmol/L" and high "mg/dL"`)
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalDosageExtension(c *check.C) {
+	dose, err := NewDecimal("500")
+	util.CheckErr(err)
+	start, err := NewFHIRDateTime("2018-03-01")
+	util.CheckErr(err)
+	frequency, period := int32(2), float64(1)
+
+	ext := Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueDosage: &Dosage{
+			Text: "500 mg twice a day",
+			Timing: &Timing{
+				Repeat: &TimingRepeatComponent{
+					BoundsPeriod: &Period{Start: start},
+					Frequency:    &frequency,
+					Period:       &period,
+					PeriodUnit:   "d",
+				},
+			},
+			Route:              &CodeableConcept{Coding: []Coding{{System: "http://snomed.info/sct", Code: "26643006", Display: "Oral route"}}},
+			DoseSimpleQuantity: &Quantity{Value: dose, Unit: "mg", System: ucumSystem, Code: "mg"},
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m["@context"], check.DeepEquals, bson.M{
+		"foo": bson.M{"@id": "http://example.org/fhir/extensions/foo", "@type": "Dosage"},
+	})
+
+	// the dose keeps its band and the timing its window
+	stored := m["foo"].(bson.M)
+	storedDose := stored["doseSimpleQuantity"].(bson.M)["value"].(bson.M)
+	c.Assert(storedDose["__from"], check.Equals, 499.5)
+	c.Assert(storedDose["__to"], check.Equals, 500.5)
+	storedStart := stored["timing"].(bson.M)["repeat"].(bson.M)["boundsPeriod"].(bson.M)["start"].(bson.M)
+	c.Assert(storedStart["__strDate"], check.Equals, "2018-03-01")
+	c.Assert(storedStart["__from"].(time.Time).Equal(start.Time), check.Equals, true)
+	c.Assert(storedStart["__to"].(time.Time).Equal(start.Time.AddDate(0, 0, 1)), check.Equals, true)
+
+	var unmarshalled Extension
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled, check.DeepEquals, ext)
+
+	// and in JSON
+	data, err = json.Marshal(ext)
+	util.CheckErr(err)
+	unmarshalled = Extension{}
+	util.CheckErr(json.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled.ValueDosage.DoseSimpleQuantity.Value.Str, check.Equals, "500")
+	c.Assert(unmarshalled.ValueDosage.Timing.Repeat.BoundsPeriod.Start, check.DeepEquals, start)
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalMoneyExtension(c *check.C) {
+	for _, amount := range []struct {
+		value, currency string
+		num             interface{}
+	}{{"-50.00", "AUD", int64(-50)}, {"12.345", "KWD", 12.345}} {
+		value, err := NewDecimal(amount.value)
+		util.CheckErr(err)
+		ext := &Extension{
+			Url:        "http://example.org/fhir/extensions/foo",
+			ValueMoney: &Money{Quantity{Value: value, System: "urn:iso:std:iso:4217", Code: amount.currency}},
+		}
+
+		data, err := bson.Marshal(ext)
+		util.CheckErr(err)
+
+		var m bson.M
+		err = bson.Unmarshal(data, &m)
+		util.CheckErr(err)
+		c.Assert(m["@context"], check.DeepEquals, bson.M{
+			"foo": bson.M{
+				"@id":   "http://example.org/fhir/extensions/foo",
+				"@type": "Money",
+			},
+		})
+		stored := m["foo"].(bson.M)
+		c.Assert(stored["code"], check.Equals, amount.currency)
+		c.Assert(stored["value"].(bson.M)["__strNum"], check.Equals, amount.value)
+		c.Assert(stored["value"].(bson.M)["__num"], check.Equals, amount.num)
+
+		var unmarshalled Extension
+		err = bson.Unmarshal(data, &unmarshalled)
+		util.CheckErr(err)
+		c.Assert(unmarshalled, check.DeepEquals, *ext)
+	}
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalQuantitySpecialisationExtensions(c *check.C) {
+	newQuantity := func(value, code string) Quantity {
+		d, err := NewDecimal(value)
+		util.CheckErr(err)
+		return Quantity{Value: d, Unit: code, System: "http://unitsofmeasure.org", Code: code}
+	}
+
+	tests := []struct {
+		fhirType string
+		ext      Extension
+	}{
+		{"Age", Extension{Url: "http://example.org/fhir/extensions/foo", ValueAge: &Age{newQuantity("42", "a")}}},
+		{"Count", Extension{Url: "http://example.org/fhir/extensions/foo", ValueCount: &Count{newQuantity("3", "1")}}},
+		{"Distance", Extension{Url: "http://example.org/fhir/extensions/foo", ValueDistance: &Distance{newQuantity("1.5", "km")}}},
+		{"Duration", Extension{Url: "http://example.org/fhir/extensions/foo", ValueDuration: &Duration{newQuantity("30", "min")}}},
+	}
+
+	SetStrictValueValidation(true)
+	defer SetStrictValueValidation(false)
+
+	for _, test := range tests {
+		comment := check.Commentf("type %s", test.fhirType)
+		data, err := bson.Marshal(&test.ext)
+		util.CheckErr(err)
+
+		var m bson.M
+		err = bson.Unmarshal(data, &m)
+		util.CheckErr(err)
+		c.Assert(m["@context"], check.DeepEquals, bson.M{
+			"foo": bson.M{
+				"@id":   "http://example.org/fhir/extensions/foo",
+				"@type": test.fhirType,
+			},
+		}, comment)
+		c.Assert(m["foo"].(bson.M)["value"].(bson.M)["__strNum"], check.NotNil, comment)
+
+		var ext Extension
+		err = bson.Unmarshal(data, &ext)
+		util.CheckErr(err)
+		c.Assert(ext, check.DeepEquals, test.ext, comment)
+	}
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalIdentifierExtension(c *check.C) {
+	ext := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueIdentifier: &Identifier{
+			Use:    "secondary",
+			Type:   &CodeableConcept{Coding: []Coding{{System: "http://hl7.org/fhir/v2/0203", Code: "MR"}}},
+			System: "http://example.org/mrn",
+			Value:  "12345",
+			Period: &Period{
+				Start: &FHIRDateTime{Time: time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: Precision(Date)},
+			},
+			// not unmarshalled from JSON, so only the reference is set
+			Assigner: &Reference{Reference: "Organization/456", Display: "Example Hospital"},
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["@context"], check.DeepEquals, bson.M{
+		"foo": bson.M{
+			"@id":   "http://example.org/fhir/extensions/foo",
+			"@type": "Identifier",
+		},
+	})
+	identifier := m["foo"].(bson.M)
+	c.Assert(identifier["value"], check.Equals, "12345")
+	c.Assert(identifier["period"].(bson.M)["start"].(bson.M)["__strDate"], check.Equals, "2015-01-01")
+	c.Assert(identifier["assigner"], check.DeepEquals, bson.M{
+		"reference":           "Organization/456",
+		"display":             "Example Hospital",
+		"reference__display":  "Example Hospital",
+		"reference__id":       "456",
+		"reference__type":     "Organization",
+		"reference__external": false,
+	})
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+
+	f := false
+	c.Assert(unmarshalled.ValueIdentifier.Value, check.Equals, "12345")
+	c.Assert(unmarshalled.ValueIdentifier.Type, check.DeepEquals, ext.ValueIdentifier.Type)
+	c.Assert(unmarshalled.ValueIdentifier.Period.Start.Time.Format("2006-01-02"), check.Equals, "2015-01-01")
+	c.Assert(unmarshalled.ValueIdentifier.Assigner, check.DeepEquals, &Reference{
+		Reference:    "Organization/456",
+		Display:      "Example Hospital",
+		ReferencedID: "456",
+		Type:         "Organization",
+		External:     &f,
+	})
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalContactPointExtension(c *check.C) {
+	rank := uint32(1)
+	ext := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueContactPoint: &ContactPoint{
+			System: "phone",
+			Value:  "+61 3 9999 9999",
+			Use:    "work",
+			Rank:   &rank,
+			Period: &Period{
+				Start: &FHIRDateTime{Time: time.Date(2018, time.July, 1, 0, 0, 0, 0, time.UTC), Precision: Precision(Date)},
+			},
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["@context"], check.DeepEquals, bson.M{
+		"foo": bson.M{
+			"@id":   "http://example.org/fhir/extensions/foo",
+			"@type": "ContactPoint",
+		},
+	})
+	contactPoint := m["foo"].(bson.M)
+	c.Assert(contactPoint["rank"], check.Equals, 1)
+	c.Assert(contactPoint["period"].(bson.M)["start"].(bson.M)["__strDate"], check.Equals, "2018-07-01")
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(unmarshalled.ValueContactPoint.Value, check.Equals, "+61 3 9999 9999")
+	c.Assert(*unmarshalled.ValueContactPoint.Rank, check.Equals, uint32(1))
+	c.Assert(unmarshalled.ValueContactPoint.Period.Start.Time.Format("2006-01-02"), check.Equals, "2018-07-01")
+
+	// rank is a positiveInt
+	rank = 0
+	_, err = bson.Marshal(ext)
+	c.Assert(err, check.ErrorMatches, "Invalid ContactPoint rank: 0 is outside the range 1 to 2147483647")
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalAnnotationExtensions(c *check.C) {
+	noteTime := &FHIRDateTime{Time: time.Date(2018, time.March, 4, 10, 30, 0, 0, time.UTC), Precision: Precision(Timestamp)}
+	tests := []struct {
+		name           string
+		annotation     Annotation
+		expectedAuthor bson.M
+	}{
+		{
+			"authorReference",
+			Annotation{AuthorReference: &Reference{Reference: "Practitioner/123"}, Time: noteTime, Text: "Patient *improving*"},
+			bson.M{"authorReference": bson.M{"reference": "Practitioner/123", "reference__id": "123", "reference__type": "Practitioner", "reference__external": false}},
+		},
+		{
+			"authorString",
+			Annotation{AuthorString: "Dr Smith", Time: noteTime, Text: "Patient *improving*"},
+			bson.M{"authorString": "Dr Smith"},
+		},
+	}
+
+	for _, test := range tests {
+		comment := check.Commentf(test.name)
+		value := test.annotation
+		ext := &Extension{Url: "http://example.org/fhir/extensions/foo", ValueAnnotation: &value}
+
+		data, err := bson.Marshal(ext)
+		util.CheckErr(err)
+
+		var m bson.M
+		err = bson.Unmarshal(data, &m)
+		util.CheckErr(err)
+		c.Assert(m["@context"], check.DeepEquals, bson.M{
+			"foo": bson.M{
+				"@id":   "http://example.org/fhir/extensions/foo",
+				"@type": "Annotation",
+			},
+		}, comment)
+		stored := m["foo"].(bson.M)
+		c.Assert(stored["text"], check.Equals, "Patient *improving*", comment)
+		c.Assert(stored["time"].(bson.M)["__strDate"], check.Equals, "2018-03-04T10:30:00Z", comment)
+		for key, author := range test.expectedAuthor {
+			c.Assert(stored[key], check.DeepEquals, author, comment)
+		}
+
+		var unmarshalled Extension
+		err = bson.Unmarshal(data, &unmarshalled)
+		util.CheckErr(err)
+		c.Assert(unmarshalled.ValueAnnotation.AuthorString, check.Equals, value.AuthorString, comment)
+		c.Assert(unmarshalled.ValueAnnotation.AuthorReference == nil, check.Equals, value.AuthorReference == nil, comment)
+		c.Assert(unmarshalled.ValueAnnotation.Time.Time.Unix(), check.Equals, noteTime.Time.Unix(), comment)
+		c.Assert(unmarshalled.ValueAnnotation.Text, check.Equals, value.Text, comment)
+	}
+
+	_, err := bson.Marshal(&Extension{
+		Url:             "http://example.org/fhir/extensions/foo",
+		ValueAnnotation: &Annotation{AuthorReference: &Reference{Reference: "Practitioner/123"}, AuthorString: "Dr Smith"},
+	})
+	c.Assert(err, check.ErrorMatches, "Annotation can't have both authorReference and authorString")
+}
+
+func (e *ExtensionSuite) TestExtensionValue(c *check.C) {
+	fifty := int32(50)
+	t := true
+	concept := &CodeableConcept{Text: "bar"}
+	tests := []struct {
+		ext          Extension
+		expected     interface{}
+		expectedType string
+	}{
+		{Extension{Url: "http://example.org/fhir/extensions/foo", ValueString: "bar"}, "bar", "string"},
+		{Extension{Url: "http://example.org/fhir/extensions/foo", ValueInteger: &fifty}, int32(50), "integer"},
+		{Extension{Url: "http://example.org/fhir/extensions/foo", ValueBoolean: &t}, true, "boolean"},
+		{Extension{Url: "http://example.org/fhir/extensions/foo", ValueCodeableConcept: concept}, *concept, "CodeableConcept"},
+		{Extension{Url: "http://example.org/fhir/extensions/foo"}, nil, ""},
+	}
+
+	for _, test := range tests {
+		value, fhirType := test.ext.Value()
+		c.Assert(value, check.DeepEquals, test.expected)
+		c.Assert(fhirType, check.Equals, test.expectedType)
+	}
+}
+
+func (e *ExtensionSuite) TestExtensionValueTypeRegistry(c *check.C) {
+	quantity := func(value, unit string) Quantity {
+		d, err := NewDecimal(value)
+		util.CheckErr(err)
+		return Quantity{Value: d, Unit: unit}
+	}
+	q := quantity("5", "mg")
+	when := time.Date(2012, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	// a value of each type, so that adding a type to Extension without a test fails
+	samples := map[string]interface{}{
+		"Address":         Address{City: "Melbourne"},
+		"Age":             Age{quantity("42", "a")},
+		"Annotation":      Annotation{Text: "bar"},
+		"Attachment":      Attachment{Url: "http://example.org/report.pdf"},
+		"base64Binary":    "aGVsbG8=",
+		"boolean":         true,
+		"code":            "active",
+		"CodeableConcept": CodeableConcept{Text: "bar"},
+		"Coding":          Coding{System: "http://loinc.org", Code: "1234-5"},
+		"ContactPoint":    ContactPoint{System: "phone", Value: "555 1234"},
+		"Count":           Count{quantity("3", "1")},
+		"date":            FHIRDateTime{Time: when, Precision: Date},
+		"dateTime":        FHIRDateTime{Time: when, Precision: Timestamp},
+		"decimal":         1.5,
+		"Distance":        Distance{quantity("2", "km")},
+		"Dosage":          Dosage{Text: "500 mg twice a day"},
+		"Duration":        Duration{quantity("90", "min")},
+		"HumanName":       HumanName{Family: "Smith"},
+		"id":              "abc",
+		"Identifier":      Identifier{System: "urn:example", Value: "1"},
+		"instant":         FHIRDateTime{Time: when, Precision: Instant},
+		"integer":         int32(5),
+		"markdown":        "*bar*",
+		"Meta":            Meta{VersionId: "1"},
+		"Money":           Money{quantity("10", "AUD")},
+		"oid":             "urn:oid:1.2.3",
+		"Period":          Period{Start: &FHIRDateTime{Time: when, Precision: Timestamp}},
+		"positiveInt":     uint32(3),
+		"Quantity":        q,
+		"Range":           Range{Low: &q, High: &q},
+		"Ratio":           Ratio{Numerator: &q, Denominator: &q},
+		"Reference":       Reference{Reference: "Patient/1"},
+		"ReferenceRange":  ReferenceRange{Low: &q},
+		"References":      []Reference{{Reference: "Patient/1"}},
+		"SampledData":     SampledData{Origin: &q},
+		"Signature":       Signature{WhoUri: "http://example.org/practitioner"},
+		"string":          "bar",
+		"time":            FHIRDateTime{Time: when, Precision: Time},
+		"Timing":          Timing{Code: &CodeableConcept{Text: "BID"}},
+		"unsignedInt":     uint32(7),
+		"uri":             "http://example.org",
+	}
+
+	types := ExtensionValueTypes()
+	c.Assert(types, check.HasLen, len(samples))
+	for _, t := range types {
+		comment := check.Commentf("%s", t.FHIRType)
+		sample, found := samples[t.FHIRType]
+		c.Assert(found, check.Equals, true, comment)
+
+		// from FHIR type to field and back
+		looked, found := LookupExtensionValueType(t.FHIRType)
+		c.Assert(found, check.Equals, true, comment)
+		c.Assert(looked, check.DeepEquals, t, comment)
+		looked, found = ExtensionValueTypeOfField(t.FieldName)
+		c.Assert(found, check.Equals, true, comment)
+		c.Assert(looked, check.DeepEquals, t, comment)
+		field, found := reflect.TypeOf(Extension{}).FieldByName(t.FieldName)
+		c.Assert(found, check.Equals, true, comment)
+		c.Assert(field.Type, check.Equals, t.GoType, comment)
+
+		// and through BSON and JSON
+		ext := Extension{Url: "http://example.org/fhir/extensions/foo"}
+		util.CheckErr(ext.SetValue(t.FHIRType, sample))
+		_, fhirType := ext.Value()
+		c.Assert(fhirType, check.Equals, t.FHIRType)
+
+		data, err := bson.Marshal(&ext)
+		c.Assert(err, check.IsNil, comment)
+		var fromBSON Extension
+		c.Assert(bson.Unmarshal(data, &fromBSON), check.IsNil, comment)
+		_, fhirType = fromBSON.Value()
+		c.Assert(fhirType, check.Equals, t.FHIRType)
+
+		data, err = json.Marshal(&ext)
+		c.Assert(err, check.IsNil, comment)
+		c.Assert(string(data), check.Matches, `.*"`+t.JSONKey()+`":.*`, comment)
+		var fromJSON Extension
+		c.Assert(json.Unmarshal(data, &fromJSON), check.IsNil, comment)
+		_, fhirType = fromJSON.Value()
+		c.Assert(fhirType, check.Equals, t.FHIRType)
+	}
+
+	_, found := LookupExtensionValueType("Raw")
+	c.Assert(found, check.Equals, false)
+	_, found = ExtensionValueTypeOfField("ValueRaw")
+	c.Assert(found, check.Equals, false)
+	_, found = ExtensionValueTypeOfField("String")
+	c.Assert(found, check.Equals, false)
+}
+
+func (e *ExtensionSuite) TestExtensionSetValue(c *check.C) {
+	ext := Extension{Url: "http://example.org/fhir/extensions/foo"}
+
+	err := ext.SetValue("string", "bar")
+	util.CheckErr(err)
+	c.Assert(ext, check.DeepEquals, Extension{Url: "http://example.org/fhir/extensions/foo", ValueString: "bar"})
+
+	// setting another value replaces the string
+	fifty := int32(50)
+	err = ext.SetValue("integer", &fifty)
+	util.CheckErr(err)
+	c.Assert(ext, check.DeepEquals, Extension{Url: "http://example.org/fhir/extensions/foo", ValueInteger: &fifty})
+	value, fhirType := ext.Value()
+	c.Assert(value, check.Equals, int32(50))
+	c.Assert(fhirType, check.Equals, "integer")
+
+	// pointer fields can also be given the value itself
+	err = ext.SetValue("integer", int32(60))
+	util.CheckErr(err)
+	c.Assert(*ext.ValueInteger, check.Equals, int32(60))
+
+	err = ext.SetValue("integer", "sixty")
+	c.Assert(err, check.ErrorMatches, "SetValue: a string can't be used as an extension value of type integer .*")
+	c.Assert(*ext.ValueInteger, check.Equals, int32(60))
+
+	err = ext.SetValue("foo", "bar")
+	c.Assert(err, check.ErrorMatches, "SetValue: unsupported extension type foo")
+}
+
+func (e *ExtensionSuite) TestUnmarshalUnknownExtensionType(c *check.C) {
+	data, err := bson.Marshal(bson.M{
+		"@context": bson.M{
+			"foo": bson.M{
+				"@id":   "http://example.org/fhir/extensions/foo",
+				"@type": "FancyNewType",
+			},
+		},
+		"foo": bson.M{"fanciness": 11},
+	})
+	util.CheckErr(err)
+
+	var ext Extension
+	err = bson.Unmarshal(data, &ext)
+	c.Assert(err, check.ErrorMatches, `Couldn't unmarshal extension http://example.org/fhir/extensions/foo: unknown @type "FancyNewType"`)
+
+	// optionally kept as-is and written back unchanged
+	SetPreserveUnknownExtensionTypes(true)
+	defer SetPreserveUnknownExtensionTypes(false)
+
+	ext = Extension{}
+	err = bson.Unmarshal(data, &ext)
+	util.CheckErr(err)
+	c.Assert(ext.Url, check.Equals, "http://example.org/fhir/extensions/foo")
+	c.Assert(ext.ValueRaw, check.DeepEquals, &RawValue{Type: "FancyNewType", Value: bson.M{"fanciness": 11}})
+
+	remarshalled, err := bson.Marshal(&ext)
+	util.CheckErr(err)
+	var m bson.M
+	err = bson.Unmarshal(remarshalled, &m)
+	util.CheckErr(err)
+	c.Assert(m, check.DeepEquals, bson.M{
+		"@context": bson.M{
+			"foo": bson.M{
+				"@id":   "http://example.org/fhir/extensions/foo",
+				"@type": "FancyNewType",
+			},
+		},
+		"foo": bson.M{"fanciness": 11},
+	})
+}
+
+func (e *ExtensionSuite) TestExtensionSliceOrderIsPreserved(c *check.C) {
+	// Each extension is a separate document in a BSON array, so no ordering information is
+	// needed beyond the array itself (the @context map only ever describes one extension).
+	fifty := int32(50)
+	t := true
+	resource := DomainResource{
+		Extension: []Extension{
+			{Url: "http://example.org/fhir/extensions/e", ValueString: "first"},
+			{Url: "http://example.org/fhir/extensions/d", ValueInteger: &fifty},
+			{Url: "http://example.org/fhir/extensions/c", ValueBoolean: &t},
+			{Url: "http://example.org/fhir/extensions/b", ValueCode: "fourth"},
+			{Url: "http://example.org/fhir/extensions/a", ValueString: "fifth"},
+		},
+	}
+
+	data, err := bson.Marshal(&resource)
+	util.CheckErr(err)
+
+	var unmarshalled DomainResource
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+
+	c.Assert(unmarshalled.Extension, check.DeepEquals, resource.Extension)
+}
+
+func testExtensions(n int) []Extension {
+	extensions := make([]Extension, n)
+	for i := range extensions {
+		value := int32(i)
+		extensions[i] = Extension{Url: fmt.Sprintf("http://example.org/fhir/extensions/foo%d", i), ValueInteger: &value}
+	}
+	extensions[0] = Extension{Url: "http://example.org/fhir/extensions/foo0", ValueString: "bar"}
+	extensions[1] = Extension{Url: "http://example.org/fhir/extensions/foo1", ValueCodeableConcept: &CodeableConcept{Text: "bar"}}
+	return extensions
+}
+
+func (e *ExtensionSuite) TestMarshalExtensions(c *check.C) {
+	extensions := testExtensions(5)
+
+	// merge the documents from marshalling each extension
+	expected := bson.M{"@context": bson.M{}}
+	for i := range extensions {
+		data, err := bson.Marshal(&extensions[i])
+		util.CheckErr(err)
+		var m bson.M
+		err = bson.Unmarshal(data, &m)
+		util.CheckErr(err)
+		for name, value := range m {
+			if name == "@context" {
+				for contextName, definition := range value.(bson.M) {
+					expected["@context"].(bson.M)[contextName] = definition
+				}
+			} else {
+				expected[name] = value
+			}
+		}
+	}
+
+	merged, err := MarshalExtensions(extensions)
+	util.CheckErr(err)
+	data, err := bson.Marshal(merged)
+	util.CheckErr(err)
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+
+	c.Assert(m, check.DeepEquals, expected)
+
+	_, err = MarshalExtensions(append(extensions, Extension{Url: "http://example.org/other/foo1", ValueString: "baz"}))
+	c.Assert(err, check.ErrorMatches, "Couldn't marshal extensions; more than one is named foo1")
+}
+
+func (e *ExtensionSuite) TestUnmarshalMergedExtensions(c *check.C) {
+	extensions := append(testExtensions(5),
+		Extension{Url: "http://example.org/fhir/extensions/notDone", ValueString: "refused", IsModifier: true},
+		Extension{Url: "http://example.org/fhir/extensions/note", ValueString: "bar", ElementID: "n1"},
+	)
+	SortExtensions(extensions)
+	unmarshal := func(doc interface{}) ([]Extension, error) {
+		data, err := bson.Marshal(doc)
+		util.CheckErr(err)
+		var raw bson.Raw
+		util.CheckErr(bson.Unmarshal(data, &raw))
+		return UnmarshalMergedExtensions(raw)
+	}
+
+	merged, err := MarshalExtensions(extensions)
+	util.CheckErr(err)
+	unmarshalled, err := unmarshal(merged)
+	util.CheckErr(err)
+	SortExtensions(unmarshalled)
+	c.Assert(unmarshalled, check.DeepEquals, extensions)
+
+	// the canonical document keeps the order
+	canonical, err := MarshalExtensionsCanonical(extensions)
+	util.CheckErr(err)
+	unmarshalled, err = unmarshal(canonical)
+	util.CheckErr(err)
+	c.Assert(unmarshalled, check.DeepEquals, extensions)
+
+	// no extensions
+	merged, err = MarshalExtensions(nil)
+	util.CheckErr(err)
+	unmarshalled, err = unmarshal(merged)
+	util.CheckErr(err)
+	c.Assert(unmarshalled, check.HasLen, 0)
+
+	_, err = unmarshal(bson.M{"@context": bson.M{}, "foo": "bar"})
+	c.Assert(err, check.ErrorMatches, "Couldn't unmarshal extensions; key foo not found in @context")
+	_, err = UnmarshalMergedExtensions(bson.Raw{Kind: 0x02})
+	c.Assert(err, check.ErrorMatches, "Couldn't unmarshal extensions; expected a document, not BSON kind 0x02")
+}
+
+func (e *ExtensionSuite) TestSortExtensions(c *check.C) {
+	one, yes := int32(1), true
+	extensions := []Extension{
+		{Url: "http://example.org/fhir/extensions/a", ValueInteger: &one},
+		{Url: "http://example.org/fhir/extensions/b", ValueString: "x"},
+		{Url: "http://example.org/fhir/extensions/c", ValueCodeableConcept: &CodeableConcept{Text: "y"}, IsModifier: true},
+		{Url: "http://example.org/fhir/extensions/d", ValueBoolean: &yes, ElementID: "d2"},
+		{Url: "http://example.org/fhir/extensions/e", ValueString: "z", IsModifier: true},
+	}
+	expected, err := MarshalExtensionsCanonical(extensions)
+	util.CheckErr(err)
+	expectedBytes, err := bson.Marshal(expected)
+	util.CheckErr(err)
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		shuffled := append([]Extension(nil), extensions...)
+		random.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+
+		doc, err := MarshalExtensionsCanonical(shuffled)
+		util.CheckErr(err)
+		data, err := bson.Marshal(doc)
+		util.CheckErr(err)
+		c.Assert(data, check.DeepEquals, expectedBytes)
+
+		SortExtensions(shuffled)
+		c.Assert(shuffled, check.DeepEquals, extensions)
+	}
+
+	// the same as MarshalExtensions apart from the order
+	merged, err := MarshalExtensions(extensions)
+	util.CheckErr(err)
+	mergedBytes, err := bson.Marshal(merged)
+	util.CheckErr(err)
+	var fromMerged, fromCanonical bson.M
+	util.CheckErr(bson.Unmarshal(mergedBytes, &fromMerged))
+	util.CheckErr(bson.Unmarshal(expectedBytes, &fromCanonical))
+	c.Assert(fromCanonical, check.DeepEquals, fromMerged)
+
+	// extensions with the same url are ordered by element id
+	sameUrl := []Extension{
+		{Url: "http://example.org/fhir/extensions/a", ElementID: "2"},
+		{Url: "http://example.org/fhir/extensions/a", ElementID: "1"},
+		{Url: "http://example.org/fhir/extensions/a"},
+	}
+	SortExtensions(sameUrl)
+	c.Assert([]string{sameUrl[0].ElementID, sameUrl[1].ElementID, sameUrl[2].ElementID}, check.DeepEquals, []string{"", "1", "2"})
+}
+
+func BenchmarkMarshalExtensions(b *testing.B) {
+	extensions := testExtensions(20)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := MarshalExtensions(extensions); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalExtensionsOneAtATime(b *testing.B) {
+	extensions := testExtensions(20)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := range extensions {
+			if _, err := extensions[j].GetBSON(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkMarshalExtensionsWithRepeatedUrls(b *testing.B) {
+	extensions := testExtensions(3)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := bson.Marshal(&extensions[i%len(extensions)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalExtension(b *testing.B) {
+	data, err := bson.Marshal(&Extension{
+		Url:                  "http://example.org/fhir/extensions/foo",
+		ValueCodeableConcept: &CodeableConcept{Coding: []Coding{{System: "http://loinc.org", Code: "2951-2"}}},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var ext Extension
+		if err := bson.Unmarshal(data, &ext); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalInstantExtension(c *check.C) {
+	instant := time.Date(2012, time.March, 1, 12, 0, 0, 123000000, time.UTC)
+	ext := &Extension{
+		Url:          "http://example.org/fhir/extensions/foo",
+		ValueInstant: &FHIRDateTime{Time: instant, Precision: Precision(Instant)},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["@context"], check.DeepEquals, bson.M{
+		"foo": bson.M{
+			"@id":   "http://example.org/fhir/extensions/foo",
+			"@type": "instant",
+		},
+	})
+	// the search window is the whole second
+	c.Assert(m["foo"].(bson.M)["__from"].(time.Time).UnixNano(), check.Equals, time.Date(2012, time.March, 1, 12, 0, 0, 0, time.UTC).UnixNano())
+	c.Assert(m["foo"].(bson.M)["__to"].(time.Time).UnixNano(), check.Equals, time.Date(2012, time.March, 1, 12, 0, 1, 0, time.UTC).UnixNano())
+	c.Assert(m["foo"].(bson.M)["__strDate"], check.Equals, "2012-03-01T12:00:00.123Z")
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(unmarshalled.ValueInstant.Precision, check.Equals, Precision(Instant))
+	c.Assert(unmarshalled.ValueInstant.Time.UnixNano(), check.Equals, instant.UnixNano())
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalPlainExtensionFormat(c *check.C) {
+	ext := &Extension{
+		Url:                  "http://example.org/fhir/extensions/foo",
+		ValueCodeableConcept: &CodeableConcept{Text: "bar"},
+	}
+
+	SetPlainExtensionFormat(true)
+	plainData, err := bson.Marshal(ext)
+	SetPlainExtensionFormat(false)
+	util.CheckErr(err)
+
+	var m bson.M
+	err = bson.Unmarshal(plainData, &m)
+	util.CheckErr(err)
+	c.Assert(m, check.DeepEquals, bson.M{
+		"url":    "http://example.org/fhir/extensions/foo",
+		"value":  bson.M{"text": "bar", "__tokens": []interface{}{"bar"}},
+		"__type": "CodeableConcept",
+	})
+
+	jsonLDData, err := bson.Marshal(ext)
+	util.CheckErr(err)
+	m = bson.M{}
+	err = bson.Unmarshal(jsonLDData, &m)
+	util.CheckErr(err)
+	c.Assert(m["@context"], check.NotNil)
+
+	// extensions can't be combined into one plain document
+	SetPlainExtensionFormat(true)
+	_, err = MarshalExtensions([]Extension{*ext})
+	c.Assert(err, check.ErrorMatches, "Couldn't marshal extensions; the plain extension format doesn't combine them into one document")
+	_, err = MarshalExtensionsCanonical([]Extension{*ext})
+	c.Assert(err, check.ErrorMatches, "Couldn't marshal extensions; the plain extension format .*")
+	SetPlainExtensionFormat(false)
+	_, err = MarshalExtensions([]Extension{*ext})
+	util.CheckErr(err)
+
+	// both formats can be read regardless of the setting
+	for _, plain := range []bool{false, true} {
+		SetPlainExtensionFormat(plain)
+		for _, data := range [][]byte{plainData, jsonLDData} {
+			var unmarshalled Extension
+			err = bson.Unmarshal(data, &unmarshalled)
+			util.CheckErr(err)
+			c.Assert(unmarshalled.Url, check.Equals, ext.Url)
+			c.Assert(unmarshalled.ValueCodeableConcept, check.DeepEquals, ext.ValueCodeableConcept)
+		}
+	}
+	SetPlainExtensionFormat(false)
+
+	// an extension named "url" is still JSON-LD
+	urlExt := &Extension{Url: "http://example.org/fhir/extensions/url", ValueString: "bar"}
+	data, err := bson.Marshal(urlExt)
+	util.CheckErr(err)
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(&unmarshalled, check.DeepEquals, urlExt)
+
+	// plain documents with an invalid url are an error
+	data, err = bson.Marshal(bson.D{{Name: "url", Value: 1}, {Name: "value", Value: "bar"}, {Name: "__type", Value: "string"}})
+	util.CheckErr(err)
+	err = bson.Unmarshal(data, &unmarshalled)
+	c.Assert(err, check.ErrorMatches, "Couldn't properly unmarshal extension; invalid url: .*")
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalModifierExtension(c *check.C) {
+	ext := &Extension{
+		Url:         "http://example.org/fhir/extensions/notDone",
+		ValueString: "patient refused",
+		IsModifier:  true,
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m, check.DeepEquals, bson.M{
+		"@modifier": bson.M{
+			"notDone": bson.M{"@id": "http://example.org/fhir/extensions/notDone", "@type": "string"},
+		},
+		"notDone": "patient refused",
+	})
+	var unmarshalled Extension
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(&unmarshalled, check.DeepEquals, ext)
+
+	// the @context of an ordinary extension with the same url and type isn't reused
+	data, err = bson.Marshal(&Extension{Url: ext.Url, ValueString: "bar"})
+	util.CheckErr(err)
+	unmarshalled = Extension{}
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled.IsModifier, check.Equals, false)
+	data, err = bson.Marshal(ext)
+	util.CheckErr(err)
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled.IsModifier, check.Equals, true)
+
+	// in the plain format
+	SetPlainExtensionFormat(true)
+	data, err = bson.Marshal(&Extension{Url: ext.Url, ValueString: ext.ValueString, ElementID: "a1", IsModifier: true})
+	SetPlainExtensionFormat(false)
+	util.CheckErr(err)
+	var d bson.D
+	util.CheckErr(bson.Unmarshal(data, &d))
+	c.Assert(d, check.DeepEquals, bson.D{
+		{Name: "url", Value: ext.Url},
+		{Name: "value", Value: ext.ValueString},
+		{Name: "__type", Value: "string"},
+		{Name: "__elementId", Value: "a1"},
+		{Name: "__modifier", Value: true},
+	})
+	unmarshalled = Extension{}
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(&unmarshalled, check.DeepEquals, &Extension{Url: ext.Url, ValueString: ext.ValueString, ElementID: "a1", IsModifier: true})
+
+	// with other extensions
+	merged, err := MarshalExtensions([]Extension{*ext, {Url: "http://example.org/fhir/extensions/foo", ValueString: "bar"}})
+	util.CheckErr(err)
+	c.Assert(merged["@modifier"], check.DeepEquals, bson.M{
+		"notDone": contextDefinition{ID: ext.Url, Type: "string"},
+	})
+	c.Assert(merged["@context"], check.DeepEquals, bson.M{
+		"foo": contextDefinition{ID: "http://example.org/fhir/extensions/foo", Type: "string"},
+	})
+	merged, err = MarshalExtensions([]Extension{{Url: "http://example.org/fhir/extensions/foo", ValueString: "bar"}})
+	util.CheckErr(err)
+	_, found := merged["@modifier"]
+	c.Assert(found, check.Equals, false)
+	_, err = MarshalExtensions([]Extension{*ext, {Url: "http://example.org/other/notDone", ValueString: "bar"}})
+	c.Assert(err, check.ErrorMatches, "Couldn't marshal extensions; more than one is named notDone")
+}
+
+func (e *ExtensionSuite) TestMarshalExtensionUrlValidation(c *check.C) {
+	valid := Extension{Url: "http://example.org/fhir/extensions/foo", ValueString: "bar"}
+	relative := Extension{Url: "#foo", ValueString: "bar"}
+	bareWord := Extension{Url: "foo", ValueString: "bar"}
+
+	// permissive by default
+	SetPlainExtensionFormat(true)
+	_, err := bson.Marshal(&bareWord)
+	SetPlainExtensionFormat(false)
+	util.CheckErr(err)
+
+	SetStrictValueValidation(true)
+	defer SetStrictValueValidation(false)
+
+	_, err = bson.Marshal(&valid)
+	util.CheckErr(err)
+	_, err = MarshalExtensions([]Extension{valid})
+	util.CheckErr(err)
+
+	_, err = bson.Marshal(&relative)
+	c.Assert(err, check.ErrorMatches, `Invalid extension url "#foo": must be an absolute URL with a scheme and host`)
+	_, err = bson.Marshal(&bareWord)
+	c.Assert(err, check.ErrorMatches, `Invalid extension url "foo": must be an absolute URL with a scheme and host`)
+	_, err = MarshalExtensions([]Extension{valid, bareWord})
+	c.Assert(err, check.ErrorMatches, `Invalid extension url "foo": .*`)
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalSampledDataExtension(c *check.C) {
+	origin, err := NewDecimal("2048")
+	util.CheckErr(err)
+	period, err := NewDecimal("0.25")
+	util.CheckErr(err)
+	factor, err := NewDecimal("1.5")
+	util.CheckErr(err)
+	lower, err := NewDecimal("-10")
+	util.CheckErr(err)
+	upper, err := NewDecimal("10")
+	util.CheckErr(err)
+	dimensions := uint32(3)
+
+	ext := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueSampledData: &SampledData{
+			Origin:     &Quantity{Value: origin, Unit: "mV"},
+			Period:     period,
+			Factor:     factor,
+			LowerLimit: lower,
+			UpperLimit: upper,
+			Dimensions: &dimensions,
+			Data:       "2041 2043 2047 E L U 2050 2052 2049",
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["@context"], check.DeepEquals, bson.M{
+		"foo": bson.M{
+			"@id":   "http://example.org/fhir/extensions/foo",
+			"@type": "SampledData",
+		},
+	})
+	c.Assert(m["foo"], check.DeepEquals, bson.M{
+		"origin": bson.M{
+			"value": bson.M{"__from": float64(2047.5), "__to": float64(2048.5), "__num": int64(2048), "__strNum": "2048", "__sig": 0},
+			"unit":  "mV",
+		},
+		"period":     bson.M{"__from": float64(0.245), "__to": float64(0.255), "__num": float64(0.25), "__strNum": "0.25", "__sig": 2},
+		"factor":     bson.M{"__from": float64(1.45), "__to": float64(1.55), "__num": float64(1.5), "__strNum": "1.5", "__sig": 1},
+		"lowerLimit": bson.M{"__from": float64(-10.5), "__to": float64(-9.5), "__num": int64(-10), "__strNum": "-10", "__sig": 0},
+		"upperLimit": bson.M{"__from": float64(9.5), "__to": float64(10.5), "__num": int64(10), "__strNum": "10", "__sig": 0},
+		"dimensions": 3,
+		"data":       "2041 2043 2047 E L U 2050 2052 2049",
+	})
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(&unmarshalled, check.DeepEquals, ext)
+
+	// and as JSON the decimals are plain numbers
+	jsonBytes, err := json.Marshal(ext.ValueSampledData)
+	util.CheckErr(err)
+	c.Assert(string(jsonBytes), check.Equals, `{"origin":{"value":2048,"unit":"mV"},"period":0.25,"factor":1.5,"lowerLimit":-10,"upperLimit":10,"dimensions":3,"data":"2041 2043 2047 E L U 2050 2052 2049"}`)
+	var fromJSON SampledData
+	err = json.Unmarshal(jsonBytes, &fromJSON)
+	util.CheckErr(err)
+	c.Assert(&fromJSON, check.DeepEquals, ext.ValueSampledData)
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalSignatureExtension(c *check.C) {
+	when := time.Date(2018, time.May, 2, 9, 30, 0, 250000000, time.UTC)
+	ext := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueSignature: &Signature{
+			Type: []Coding{
+				{System: "urn:iso-astm:E1762-95:2013", Code: "1.2.840.10065.1.12.1.7", Display: "Consent Signature"},
+			},
+			When:         &FHIRDateTime{Time: when, Precision: Timestamp},
+			WhoReference: &Reference{Reference: "Patient/123", Display: "Alex"},
+			ContentType:  "image/png",
+			Blob:         []byte{0x89, 'P', 'N', 'G', 0x00, 0xff},
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["@context"], check.DeepEquals, bson.M{
+		"foo": bson.M{
+			"@id":   "http://example.org/fhir/extensions/foo",
+			"@type": "Signature",
+		},
+	})
+	stored := m["foo"].(bson.M)
+	c.Assert(stored["type"], check.DeepEquals, []interface{}{
+		bson.M{"system": "urn:iso-astm:E1762-95:2013", "code": "1.2.840.10065.1.12.1.7", "display": "Consent Signature", "__displayLower": "consent signature"},
+	})
+	c.Assert(stored["when"].(bson.M)["__strDate"], check.Equals, "2018-05-02T09:30:00.25Z")
+	c.Assert(stored["whoReference"], check.DeepEquals, bson.M{
+		"reference":           "Patient/123",
+		"display":             "Alex",
+		"reference__display":  "Alex",
+		"reference__id":       "123",
+		"reference__type":     "Patient",
+		"reference__external": false,
+	})
+	// binary rather than a base64 string
+	c.Assert(stored["blob"], check.DeepEquals, []byte{0x89, 'P', 'N', 'G', 0x00, 0xff})
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	sig := unmarshalled.ValueSignature
+	c.Assert(sig.Type, check.DeepEquals, ext.ValueSignature.Type)
+	c.Assert(sig.When.Precision, check.Equals, Precision(Instant))
+	c.Assert(sig.When.Time.UnixNano(), check.Equals, when.UnixNano())
+	c.Assert(sig.WhoReference.Reference, check.Equals, "Patient/123")
+	c.Assert(sig.WhoReference.ReferencedID, check.Equals, "123")
+	c.Assert(sig.WhoReference.Type, check.Equals, "Patient")
+	c.Assert(sig.ContentType, check.Equals, "image/png")
+	c.Assert(sig.Blob, check.DeepEquals, ext.ValueSignature.Blob)
+
+	// the original wasn't changed when marshalling
+	c.Assert(ext.ValueSignature.When.Precision, check.Equals, Precision(Timestamp))
+	c.Assert(ext.ValueSignature.WhoReference.ReferencedID, check.Equals, "")
+
+	// blob is base64 in JSON
+	jsonBytes, err := json.Marshal(sig)
+	util.CheckErr(err)
+	c.Assert(string(jsonBytes), check.Matches, `.*"blob":"iVBORwD/".*`)
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalTimingExtension(c *check.C) {
+	frequency := int32(2)
+	period := float64(1)
+	ext := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueTiming: &Timing{
+			Event: []FHIRDateTime{
+				{Time: time.Date(2018, time.May, 2, 9, 0, 0, 0, time.UTC), Precision: Timestamp},
+				{Time: time.Date(2018, time.May, 2, 21, 0, 0, 0, time.UTC), Precision: Timestamp},
+			},
+			Repeat: &TimingRepeatComponent{
+				BoundsPeriod: &Period{
+					Start: &FHIRDateTime{Time: time.Date(2018, time.May, 1, 0, 0, 0, 0, time.Local), Precision: Date},
+					End:   &FHIRDateTime{Time: time.Date(2018, time.May, 31, 0, 0, 0, 0, time.Local), Precision: Date},
+				},
+				Frequency:  &frequency,
+				Period:     &period,
+				PeriodUnit: "d",
+			},
+			Code: &CodeableConcept{
+				Coding: []Coding{{System: "http://hl7.org/fhir/v3/GTSAbbreviation", Code: "BID"}},
+			},
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["@context"], check.DeepEquals, bson.M{
+		"foo": bson.M{
+			"@id":   "http://example.org/fhir/extensions/foo",
+			"@type": "Timing",
+		},
+	})
+	stored := m["foo"].(bson.M)
+
+	// each event is searchable through the date envelope
+	events := stored["event"].([]interface{})
+	c.Assert(events, check.HasLen, 2)
+	c.Assert(events[0].(bson.M)["__strDate"], check.Equals, "2018-05-02T09:00:00Z")
+	c.Assert(events[0].(bson.M)["__from"].(time.Time).Unix(), check.Equals, time.Date(2018, time.May, 2, 9, 0, 0, 0, time.UTC).Unix())
+	c.Assert(events[0].(bson.M)["__to"].(time.Time).Unix(), check.Equals, time.Date(2018, time.May, 2, 9, 0, 1, 0, time.UTC).Unix())
+	c.Assert(events[1].(bson.M)["__strDate"], check.Equals, "2018-05-02T21:00:00Z")
+
+	repeat := stored["repeat"].(bson.M)
+	c.Assert(repeat["frequency"], check.Equals, 2)
+	c.Assert(repeat["period"], check.Equals, float64(1))
+	c.Assert(repeat["periodUnit"], check.Equals, "d")
+	bounds := repeat["boundsPeriod"].(bson.M)
+	c.Assert(bounds["start"].(bson.M)["__strDate"], check.Equals, "2018-05-01")
+	c.Assert(bounds["end"].(bson.M)["__strDate"], check.Equals, "2018-05-31")
+	c.Assert(bounds["end"].(bson.M)["__to"].(time.Time).Unix(), check.Equals, time.Date(2018, time.June, 1, 0, 0, 0, 0, time.Local).Unix())
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	timing := unmarshalled.ValueTiming
+	c.Assert(unmarshalled.Url, check.Equals, ext.Url)
+	c.Assert(timing.Event, check.HasLen, 2)
+	for i, event := range timing.Event {
+		c.Assert(event.Precision, check.Equals, Precision(Timestamp))
+		c.Assert(event.Time.Unix(), check.Equals, ext.ValueTiming.Event[i].Time.Unix())
+	}
+	c.Assert(timing.Repeat, check.DeepEquals, ext.ValueTiming.Repeat)
+	c.Assert(timing.Code, check.DeepEquals, ext.ValueTiming.Code)
+}
+
+func (e *ExtensionSuite) TestExtensionClone(c *check.C) {
+	decimal := float64(10.5)
+	original := &Extension{
+		Url:          "http://example.org/fhir/extensions/foo",
+		ValueDecimal: &decimal,
+	}
+	clone := original.Clone()
+	c.Assert(clone, check.DeepEquals, original)
+	*clone.ValueDecimal = 11
+	clone.Url = "http://example.org/fhir/extensions/bar"
+	c.Assert(*original.ValueDecimal, check.Equals, float64(10.5))
+	c.Assert(original.Url, check.Equals, "http://example.org/fhir/extensions/foo")
+
+	original = &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueCodeableConcept: &CodeableConcept{
+			Coding: []Coding{{System: "http://example.org", Code: "a"}},
+			Text:   "A",
+		},
+	}
+	clone = original.Clone()
+	c.Assert(clone, check.DeepEquals, original)
+	clone.ValueCodeableConcept.Coding[0].Code = "b"
+	clone.ValueCodeableConcept.Coding = append(clone.ValueCodeableConcept.Coding, Coding{Code: "c"})
+	clone.ValueCodeableConcept.Text = "B"
+	c.Assert(original.ValueCodeableConcept, check.DeepEquals, &CodeableConcept{
+		Coding: []Coding{{System: "http://example.org", Code: "a"}},
+		Text:   "A",
+	})
+
+	// including decimals and references nested in other values
+	value, err := NewDecimal("10")
+	util.CheckErr(err)
+	original = &Extension{
+		Url:            "http://example.org/fhir/extensions/foo",
+		ValueQuantity:  &Quantity{Value: value, Unit: "mm"},
+		ValueReference: &Reference{Reference: "Patient/123"},
+	}
+	clone = original.Clone()
+	clone.ValueQuantity.Value.Str = "20"
+	clone.ValueReference.Reference = "Patient/456"
+	c.Assert(original.ValueQuantity.Value.Str, check.Equals, "10")
+	c.Assert(original.ValueReference.Reference, check.Equals, "Patient/123")
+
+	// and raw values of unknown types
+	original = &Extension{
+		Url:      "http://example.org/fhir/extensions/foo",
+		ValueRaw: &RawValue{Type: "FancyNewType", Value: bson.M{"fanciness": 11}},
+	}
+	clone = original.Clone()
+	clone.ValueRaw.Value.(bson.M)["fanciness"] = 12
+	c.Assert(original.ValueRaw.Value, check.DeepEquals, bson.M{"fanciness": 11})
+}
+
+func (e *ExtensionSuite) TestExtensionEqual(c *check.C) {
+	sydney := time.FixedZone("AEST", 10*60*60)
+	utc := &Extension{
+		Url:           "http://example.org/fhir/extensions/foo",
+		ValueDateTime: &FHIRDateTime{Time: time.Date(2018, time.May, 2, 9, 30, 0, 0, time.UTC), Precision: Timestamp},
+	}
+	local := &Extension{
+		Url:           "http://example.org/fhir/extensions/foo",
+		ValueDateTime: &FHIRDateTime{Time: time.Date(2018, time.May, 2, 19, 30, 0, 0, sydney), Precision: Timestamp},
+	}
+	c.Assert(utc, check.Not(check.DeepEquals), local)
+	c.Assert(utc.Equal(*local), check.Equals, true)
+	c.Assert(local.Equal(*utc), check.Equals, true)
+
+	later := local.Clone()
+	later.ValueDateTime.Time = later.ValueDateTime.Time.Add(time.Second)
+	c.Assert(utc.Equal(*later), check.Equals, false)
+	otherPrecision := utc.Clone()
+	otherPrecision.ValueDateTime.Precision = Instant
+	c.Assert(utc.Equal(*otherPrecision), check.Equals, false)
+	otherUrl := utc.Clone()
+	otherUrl.Url = "http://example.org/fhir/extensions/bar"
+	c.Assert(utc.Equal(*otherUrl), check.Equals, false)
+
+	// decimals are compared by their string form, not the derived search range
+	ten, err := NewDecimal("10")
+	util.CheckErr(err)
+	tenAgain := &Decimal{Str: "10"}
+	tenPointZero, err := NewDecimal("10.0")
+	util.CheckErr(err)
+	quantity := func(value *Decimal) Extension {
+		return Extension{Url: "http://example.org/fhir/extensions/foo", ValueQuantity: &Quantity{Value: value, Unit: "mm"}}
+	}
+	c.Assert(quantity(ten).Equal(quantity(tenAgain)), check.Equals, true)
+	c.Assert(quantity(ten).Equal(quantity(tenPointZero)), check.Equals, false)
+
+	// references by what they resolve to
+	reference := func(ref Reference) Extension {
+		return Extension{Url: "http://example.org/fhir/extensions/foo", ValueReference: &ref}
+	}
+	expanded := Reference{Reference: "Patient/123", ReferencedID: "123", Type: "Patient"}
+	c.Assert(reference(Reference{Reference: "Patient/123"}).Equal(reference(expanded)), check.Equals, true)
+	c.Assert(reference(Reference{Reference: "Patient/123"}).Equal(reference(Reference{Reference: "Patient/456"})), check.Equals, false)
+	c.Assert(reference(Reference{Reference: "Patient/123"}).Equal(reference(Reference{Reference: "Group/123"})), check.Equals, false)
+	c.Assert(reference(Reference{Reference: "Patient/123", Display: "Alex"}).Equal(reference(expanded)), check.Equals, false)
+
+	// different value types
+	str := Extension{Url: "http://example.org/fhir/extensions/foo", ValueString: "10"}
+	c.Assert(str.Equal(quantity(ten)), check.Equals, false)
+	c.Assert(str.Equal(str), check.Equals, true)
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalCodedQuantityExtension(c *check.C) {
+	value, err := NewDecimal("185.5")
+	util.CheckErr(err)
+	ext := &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueQuantity: &Quantity{
+			Value:      value,
+			Comparator: "<",
+			Unit:       "centimetres",
+			System:     "http://unitsofmeasure.org",
+			Code:       "cm",
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["foo"], check.DeepEquals, bson.M{
+		"value":      bson.M{"__from": -math.MaxFloat64, "__to": math.Nextafter(185.5, math.Inf(-1)), "__num": float64(185.5), "__strNum": "185.5", "__sig": 1},
+		"comparator": "<",
+		"unit":       "centimetres",
+		"system":     "http://unitsofmeasure.org",
+		"code":       "cm",
+	})
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(&unmarshalled, check.DeepEquals, ext)
+
+	// without a system and code they're omitted
+	ext.ValueQuantity.System = ""
+	ext.ValueQuantity.Code = ""
+	data, err = bson.Marshal(ext)
+	util.CheckErr(err)
+	m = bson.M{}
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	_, hasSystem := m["foo"].(bson.M)["system"]
+	_, hasCode := m["foo"].(bson.M)["code"]
+	c.Assert(hasSystem, check.Equals, false)
+	c.Assert(hasCode, check.Equals, false)
+}
+
+func (e *ExtensionSuite) TestExtensionValidate(c *check.C) {
+	zero := uint32(0)
+	rank := uint32(0)
+	ext := &Extension{
+		Url:              "foo",
+		ValueString:      "bar",
+		ValuePositiveInt: &zero,
+		ValueContactPoint: &ContactPoint{
+			System: "phone",
+			Value:  "+61 3 5555 5555",
+			Rank:   &rank,
+		},
+	}
+	errs := ext.Validate()
+	c.Assert(errs, check.HasLen, 4)
+	c.Assert(errs[0], check.ErrorMatches, `Invalid extension url "foo": must be an absolute URL with a scheme and host`)
+	c.Assert(errs[1], check.ErrorMatches, `Extension foo has more than one value: ContactPoint, positiveInt, string`)
+	c.Assert(errs[2], check.ErrorMatches, `Invalid positiveInt extension foo: 0 is outside the range 1 to 2147483647`)
+	c.Assert(errs[3], check.ErrorMatches, `Invalid ContactPoint extension foo: Invalid ContactPoint rank: 0 is outside the range 1 to 2147483647`)
+
+	errs = (&Extension{}).Validate()
+	c.Assert(errs, check.HasLen, 2)
+	c.Assert(errs[0], check.ErrorMatches, `Extension is missing a url`)
+	c.Assert(errs[1], check.ErrorMatches, `Extension  has no value`)
+
+	valid := &Extension{Url: "http://example.org/fhir/extensions/foo", ValueString: "bar"}
+	c.Assert(valid.Validate(), check.HasLen, 0)
+}
+
+func (e *ExtensionSuite) TestBatchValidate(c *check.C) {
+	one := uint32(1)
+	extensions := []Extension{
+		{Url: "http://example.org/fhir/extensions/foo", ValueString: "bar"},
+		{Url: "#foo", ValueCode: "bar", ValueUri: "http://example.org"},
+		{Url: "http://example.org/fhir/extensions/foo", ValuePositiveInt: &one},
+		{Url: "http://example.org/fhir/extensions/foo", ValueAnnotation: &Annotation{AuthorString: "Alex", AuthorReference: &Reference{Reference: "Practitioner/1"}, Text: "bar"}},
+	}
+
+	problems := BatchValidate(extensions)
+	c.Assert(problems, check.HasLen, 2)
+	c.Assert(problems[1], check.HasLen, 2)
+	c.Assert(problems[1][0], check.ErrorMatches, `Invalid extension url "#foo": .*`)
+	c.Assert(problems[1][1], check.ErrorMatches, `Extension #foo has more than one value: code, uri`)
+	c.Assert(problems[3], check.HasLen, 1)
+	c.Assert(problems[3][0], check.ErrorMatches, `Invalid Annotation extension .*: Annotation can't have both authorReference and authorString`)
+}
+
+func (e *ExtensionSuite) TestUnmarshalExtensionsOneAtATime(c *check.C) {
+	extensions := testExtensions(200)
+	data, err := bson.Marshal(bson.M{"extension": extensions})
+	util.CheckErr(err)
+	var doc struct {
+		Extension bson.Raw `bson:"extension"`
+	}
+	err = bson.Unmarshal(data, &doc)
+	util.CheckErr(err)
+
+	var streamed []Extension
+	err = UnmarshalExtensions(doc.Extension, func(ext Extension) error {
+		streamed = append(streamed, ext)
+		return nil
+	})
+	util.CheckErr(err)
+	c.Assert(streamed, check.HasLen, 200)
+	for i := range streamed {
+		c.Assert(streamed[i].Url, check.Equals, fmt.Sprintf("http://example.org/fhir/extensions/foo%d", i))
+	}
+
+	// the same as unmarshalling them all at once
+	var batch []Extension
+	err = doc.Extension.Unmarshal(&batch)
+	util.CheckErr(err)
+	c.Assert(streamed, check.DeepEquals, batch)
+
+	// stopping early
+	count := 0
+	err = UnmarshalExtensions(doc.Extension, func(ext Extension) error {
+		count++
+		if count == 10 {
+			return fmt.Errorf("enough")
+		}
+		return nil
+	})
+	c.Assert(err, check.ErrorMatches, "enough")
+	c.Assert(count, check.Equals, 10)
+
+	// errors decoding an extension are reported
+	data, err = bson.Marshal(bson.M{"extension": []interface{}{extensions[0], bson.M{"foo": "bar", "baz": "qux"}}})
+	util.CheckErr(err)
+	err = bson.Unmarshal(data, &doc)
+	util.CheckErr(err)
+	count = 0
+	err = UnmarshalExtensions(doc.Extension, func(ext Extension) error {
+		count++
+		return nil
+	})
+	c.Assert(err, check.ErrorMatches, "Couldn't properly unmarshal extension; unrecognized format in BSON")
+	c.Assert(count, check.Equals, 1)
+
+	err = UnmarshalExtensions(bson.Raw{Kind: 0x03, Data: data}, func(ext Extension) error { return nil })
+	c.Assert(err, check.ErrorMatches, "Couldn't unmarshal extensions; expected an array, not BSON kind 0x03")
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalElementID(c *check.C) {
+	ext := &Extension{
+		Url:         "http://example.org/fhir/extensions/foo",
+		ElementID:   "foo-1",
+		ValueString: "bar",
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m, check.DeepEquals, bson.M{
+		"@context": bson.M{
+			"foo": bson.M{
+				"@id":         "http://example.org/fhir/extensions/foo",
+				"@type":       "string",
+				"__elementId": "foo-1",
+			},
+		},
+		"foo": "bar",
+	})
+
+	var unmarshalled Extension
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(&unmarshalled, check.DeepEquals, ext)
+
+	SetPlainExtensionFormat(true)
+	data, err = bson.Marshal(ext)
+	SetPlainExtensionFormat(false)
+	util.CheckErr(err)
+	m = bson.M{}
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["__elementId"], check.Equals, "foo-1")
+
+	unmarshalled = Extension{}
+	err = bson.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(&unmarshalled, check.DeepEquals, ext)
+
+	// without an id nothing extra is stored
+	ext.ElementID = ""
+	data, err = bson.Marshal(ext)
+	util.CheckErr(err)
+	m = bson.M{}
+	err = bson.Unmarshal(data, &m)
+	util.CheckErr(err)
+	c.Assert(m["@context"], check.DeepEquals, bson.M{
+		"foo": bson.M{"@id": "http://example.org/fhir/extensions/foo", "@type": "string"},
+	})
+}
+
+func (e *ExtensionSuite) TestExtensionJSON(c *check.C) {
+	// valueInteger
+	var i int32 = 42
+	ext := &Extension{Url: "http://example.org/fhir/extensions/foo", ValueInteger: &i}
+	data, err := json.Marshal(ext)
+	util.CheckErr(err)
+	c.Assert(string(data), check.Equals, `{"url":"http://example.org/fhir/extensions/foo","valueInteger":42}`)
+	var unmarshalled Extension
+	err = json.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(&unmarshalled, check.DeepEquals, ext)
+
+	// valueCodeableConcept
+	ext = &Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueCodeableConcept: &CodeableConcept{
+			Coding: []Coding{{System: "http://snomed.info/sct", Code: "73211009"}},
+			Text:   "Diabetes",
+		},
+	}
+	data, err = json.Marshal(ext)
+	util.CheckErr(err)
+	c.Assert(string(data), check.Equals, `{"url":"http://example.org/fhir/extensions/foo",`+
+		`"valueCodeableConcept":{"coding":[{"system":"http://snomed.info/sct","code":"73211009"}],"text":"Diabetes"}}`)
+	unmarshalled = Extension{}
+	err = json.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(&unmarshalled, check.DeepEquals, ext)
+
+	// valueReference, without the fields only used for searching
+	ext = &Extension{
+		Url:            "http://example.org/fhir/extensions/foo",
+		ValueReference: &Reference{Reference: "Patient/123", Display: "Joe"},
+	}
+	data, err = json.Marshal(ext)
+	util.CheckErr(err)
+	c.Assert(string(data), check.Equals, `{"url":"http://example.org/fhir/extensions/foo",`+
+		`"valueReference":{"display":"Joe","reference":"Patient/123"}}`)
+	unmarshalled = Extension{}
+	err = json.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(unmarshalled.Url, check.Equals, ext.Url)
+	c.Assert(unmarshalled.ValueReference.Reference, check.Equals, "Patient/123")
+	c.Assert(unmarshalled.ValueReference.Display, check.Equals, "Joe")
+	c.Assert(unmarshalled.ValueReference.Type, check.Equals, "Patient")
+	c.Assert(unmarshalled.ValueReference.ReferencedID, check.Equals, "123")
+
+	// an element id goes in _value[x]
+	ext = &Extension{Url: "http://example.org/fhir/extensions/foo", ElementID: "foo-1", ValueString: "bar"}
+	data, err = json.Marshal(ext)
+	util.CheckErr(err)
+	c.Assert(string(data), check.Equals, `{"url":"http://example.org/fhir/extensions/foo","valueString":"bar","_valueString":{"id":"foo-1"}}`)
+	unmarshalled = Extension{}
+	err = json.Unmarshal(data, &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(&unmarshalled, check.DeepEquals, ext)
+
+	// more than one value, or an unknown type, is an error
+	err = json.Unmarshal([]byte(`{"url":"http://example.org/fhir/extensions/foo","valueString":"a","valueCode":"b"}`), &unmarshalled)
+	c.Assert(err, check.ErrorMatches, "Couldn't unmarshal extension .*; it has both .*")
+	err = json.Unmarshal([]byte(`{"url":"http://example.org/fhir/extensions/foo","valueUuid":"a"}`), &unmarshalled)
+	c.Assert(err, check.ErrorMatches, "Couldn't unmarshal extension .*: unknown type valueUuid")
+
+	SetPreserveUnknownExtensionTypes(true)
+	defer SetPreserveUnknownExtensionTypes(false)
+	unmarshalled = Extension{}
+	err = json.Unmarshal([]byte(`{"url":"http://example.org/fhir/extensions/foo","valueUuid":"a"}`), &unmarshalled)
+	util.CheckErr(err)
+	c.Assert(unmarshalled.ValueRaw, check.DeepEquals, &RawValue{Type: "uuid", Value: "a"})
+	data, err = json.Marshal(unmarshalled)
+	util.CheckErr(err)
+	c.Assert(string(data), check.Equals, `{"url":"http://example.org/fhir/extensions/foo","valueUuid":"a"}`)
+}
+
+func (e *ExtensionSuite) TestMarshalAndUnmarshalReferencesExtension(c *check.C) {
+	ext := Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueReferences: []Reference{
+			{Reference: "Practitioner/7", Display: "Dr. Smith"},
+			{Reference: "http://example.org/fhir/Organization/8"},
+		},
+	}
+
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m, check.DeepEquals, bson.M{
+		"@context": bson.M{"foo": bson.M{"@id": "http://example.org/fhir/extensions/foo", "@type": "References"}},
+		"foo": []interface{}{
+			bson.M{"reference": "Practitioner/7", "display": "Dr. Smith", "reference__display": "Dr. Smith",
+				"reference__id": "7", "reference__type": "Practitioner", "reference__external": false},
+			bson.M{"reference": "http://example.org/fhir/Organization/8",
+				"reference__id": "8", "reference__type": "Organization", "reference__external": true},
+		},
+	})
+
+	var unmarshalled Extension
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled.ValueReferences, check.HasLen, 2)
+	for i, ref := range unmarshalled.ValueReferences {
+		c.Assert(ref.Reference, check.Equals, ext.ValueReferences[i].Reference)
+		c.Assert(ref.Display, check.Equals, ext.ValueReferences[i].Display)
+	}
+	c.Assert(unmarshalled.ValueReferences[1].ReferencedID, check.Equals, "8")
+	c.Assert(unmarshalled.Equal(ext), check.Equals, true)
+
+	// and in JSON
+	data, err = json.Marshal(ext)
+	util.CheckErr(err)
+	unmarshalled = Extension{}
+	util.CheckErr(json.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled.ValueReferences, check.HasLen, 2)
+	c.Assert(unmarshalled.ValueReferences[0].Reference, check.Equals, "Practitioner/7")
+	c.Assert(unmarshalled.ValueReferences[1].Type, check.Equals, "Organization")
+
+	value, fhirType := ext.Value()
+	c.Assert(fhirType, check.Equals, "References")
+	c.Assert(value, check.DeepEquals, ext.ValueReferences)
+	c.Assert(ext.Clone(), check.DeepEquals, &ext)
+}
+
+func (e *ExtensionSuite) TestUnmarshalLegacyStringReferenceExtension(c *check.C) {
+	context := bson.M{"foo": bson.M{"@id": "http://example.org/fhir/extensions/foo", "@type": "Reference"}}
+	external := false
+	expected := Extension{
+		Url: "http://example.org/fhir/extensions/foo",
+		ValueReference: &Reference{Reference: "Patient/123", Type: "Patient", ReferencedID: "123", External: &external},
+	}
+
+	for _, stored := range []interface{}{
+		// as stored now
+		bson.M{"reference": "Patient/123", "reference__id": "123", "reference__type": "Patient", "reference__external": false},
+		// by older versions
+		"Patient/123",
+	} {
+		data, err := bson.Marshal(bson.M{"@context": context, "foo": stored})
+		util.CheckErr(err)
+		var ext Extension
+		util.CheckErr(bson.Unmarshal(data, &ext))
+		c.Assert(ext, check.DeepEquals, expected, check.Commentf("%#v", stored))
+	}
+
+	// and written back in the current format
+	data, err := bson.Marshal(bson.M{"@context": context, "foo": "http://example.org/fhir/Patient/123/_history/2"})
+	util.CheckErr(err)
+	var ext Extension
+	util.CheckErr(bson.Unmarshal(data, &ext))
+	c.Assert(ext.ValueReference.Version, check.Equals, "2")
+	c.Assert(*ext.ValueReference.External, check.Equals, true)
+	data, err = bson.Marshal(ext)
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m["foo"].(bson.M)["reference__id"], check.Equals, "123")
+}
+
+func (e *ExtensionSuite) TestEmptyStringExtension(c *check.C) {
+	empty := Extension{Url: "http://example.org/fhir/extensions/foo", EmptyString: true}
+	unset := Extension{Url: "http://example.org/fhir/extensions/foo"}
+
+	value, fhirType := empty.Value()
+	c.Assert(value, check.Equals, "")
+	c.Assert(fhirType, check.Equals, "string")
+	value, fhirType = unset.Value()
+	c.Assert(value, check.IsNil)
+	c.Assert(fhirType, check.Equals, "")
+
+	c.Assert(empty.Validate(), check.HasLen, 0)
+	c.Assert(unset.Validate(), check.HasLen, 1)
+
+	// an empty string survives BSON and JSON
+	data, err := bson.Marshal(empty)
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m["foo"], check.Equals, "")
+	var unmarshalled Extension
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled, check.DeepEquals, empty)
+
+	jsonData, err := json.Marshal(empty)
+	util.CheckErr(err)
+	c.Assert(string(jsonData), check.Equals, `{"url":"http://example.org/fhir/extensions/foo","valueString":""}`)
+	unmarshalled = Extension{}
+	util.CheckErr(json.Unmarshal(jsonData, &unmarshalled))
+	c.Assert(unmarshalled, check.DeepEquals, empty)
+
+	jsonData, err = json.Marshal(unset)
+	util.CheckErr(err)
+	c.Assert(string(jsonData), check.Equals, `{"url":"http://example.org/fhir/extensions/foo"}`)
+
+	// SetValue records the empty string too, and clears it when replaced
+	ext := Extension{Url: "http://example.org/fhir/extensions/foo"}
+	util.CheckErr(ext.SetValue("string", ""))
+	c.Assert(ext, check.DeepEquals, empty)
+	util.CheckErr(ext.SetValue("code", "bar"))
+	c.Assert(ext.EmptyString, check.Equals, false)
+
+	// a value assigned directly to another field replaces the empty string
+	read := Extension{}
+	util.CheckErr(bson.Unmarshal(data, &read))
+	c.Assert(read.EmptyString, check.Equals, true)
+	read.ValueUri = "http://example.org/bar"
+	value, fhirType = read.Value()
+	c.Assert(value, check.Equals, "http://example.org/bar")
+	c.Assert(fhirType, check.Equals, "uri")
+	data, err = bson.Marshal(read)
+	util.CheckErr(err)
+	var remarshalled Extension
+	util.CheckErr(bson.Unmarshal(data, &remarshalled))
+	c.Assert(remarshalled.ValueUri, check.Equals, "http://example.org/bar")
+	c.Assert(remarshalled.EmptyString, check.Equals, false)
+	jsonData, err = json.Marshal(read)
+	util.CheckErr(err)
+	c.Assert(string(jsonData), check.Equals, `{"url":"http://example.org/fhir/extensions/foo","valueUri":"http://example.org/bar"}`)
+
+	// an unset extension is still stored as an empty string, unless validation is strict
+	_, err = bson.Marshal(unset)
+	util.CheckErr(err)
+	SetStrictValueValidation(true)
+	defer SetStrictValueValidation(false)
+	_, err = bson.Marshal(unset)
+	c.Assert(err, check.ErrorMatches, ".*extension http://example.org/fhir/extensions/foo: it has no value")
+	_, err = MarshalExtensions([]Extension{unset})
+	c.Assert(err, check.NotNil)
+	_, err = bson.Marshal(empty)
+	util.CheckErr(err)
+}
+
+func (e *ExtensionSuite) TestFindExtension(c *check.C) {
+	exts := []Extension{
+		{Url: "http://example.org/fhir/extensions/single", ValueString: "a"},
+		{Url: "http://example.org/fhir/extensions/repeated", ValueString: "b"},
+		{Url: "http://example.org/fhir/extensions/repeated/sub", ValueString: "c"},
+		{Url: "http://example.org/fhir/extensions/repeated", ValueString: "d"},
+	}
+
+	ext, found := FindExtension(exts, "http://example.org/fhir/extensions/single")
+	c.Assert(found, check.Equals, true)
+	c.Assert(ext, check.Equals, &exts[0])
+	c.Assert(FindExtensions(exts, "http://example.org/fhir/extensions/single"), check.DeepEquals, []Extension{exts[0]})
+
+	ext, found = FindExtension(exts, "http://example.org/fhir/extensions/repeated")
+	c.Assert(found, check.Equals, true)
+	c.Assert(ext, check.Equals, &exts[1])
+	c.Assert(FindExtensions(exts, "http://example.org/fhir/extensions/repeated"), check.DeepEquals, []Extension{exts[1], exts[3]})
+
+	// matching is exact
+	for _, url := range []string{"http://example.org/fhir/extensions/missing", "http://example.org/fhir/extensions/", "http://example.org/fhir/extensions/SINGLE"} {
+		ext, found = FindExtension(exts, url)
+		c.Assert(found, check.Equals, false)
+		c.Assert(ext, check.IsNil)
+		c.Assert(FindExtensions(exts, url), check.HasLen, 0)
+	}
+}
+
+func (e *ExtensionSuite) TestWalkExtensions(c *check.C) {
+	exts := []Extension{
+		{Url: "http://old.example.org/fhir/extensions/foo", ValueString: "a"},
+		{Url: "http://example.org/fhir/extensions/bar", ValueCode: "b"},
+		{Url: "http://old.example.org/fhir/extensions/baz", ValueString: "c"},
+	}
+
+	var paths []string
+	err := WalkExtensions(exts, func(path string, ext *Extension) error {
+		paths = append(paths, path)
+		ext.Url = strings.Replace(ext.Url, "http://old.example.org/", "http://example.org/", 1)
+		return nil
+	})
+	util.CheckErr(err)
+	c.Assert(paths, check.DeepEquals, []string{"extension[0]", "extension[1]", "extension[2]"})
+	c.Assert(exts, check.DeepEquals, []Extension{
+		{Url: "http://example.org/fhir/extensions/foo", ValueString: "a"},
+		{Url: "http://example.org/fhir/extensions/bar", ValueCode: "b"},
+		{Url: "http://example.org/fhir/extensions/baz", ValueString: "c"},
+	})
+
+	// stops at the first error
+	paths = nil
+	err = WalkExtensions(exts, func(path string, ext *Extension) error {
+		paths = append(paths, path)
+		if ext.ValueCode != "" {
+			return fmt.Errorf("%s has a code", path)
+		}
+		ext.ValueString = "changed"
+		return nil
+	})
+	c.Assert(err, check.ErrorMatches, `extension\[1\] has a code`)
+	c.Assert(paths, check.DeepEquals, []string{"extension[0]", "extension[1]"})
+	c.Assert(exts[0].ValueString, check.Equals, "changed")
+	c.Assert(exts[2].ValueString, check.Equals, "c")
+
+	c.Assert(WalkExtensions(nil, func(string, *Extension) error { return fmt.Errorf("called") }), check.IsNil)
+}
+
+func (e *ExtensionSuite) TestGroupExtensions(c *check.C) {
+	const vitals = "http://example.org/fhir/extensions/vitals"
+	heartRate := int32(72)
+	exts := []Extension{
+		{Url: vitals + "/bp/value", ValueString: "120/80"},
+		{Url: "http://example.org/fhir/extensions/unrelated", ValueString: "a"},
+		{Url: vitals + "/heartRate/value", ValueInteger: &heartRate},
+		{Url: vitals + "/bp/method", ValueCode: "auscultation"},
+		{Url: vitals + "/bp/referenceRange", ValueString: "90/60-120/80"},
+		{Url: vitals + "Extra/bp/value", ValueString: "not a vital"},
+		{Url: vitals, ValueString: "the prefix itself"},
+		{Url: vitals + "/heartRate/method", ValueCode: "palpation"},
+	}
+
+	groups := GroupExtensions(exts, vitals)
+	c.Assert(groups, check.DeepEquals, map[string][]Extension{
+		"bp":        {exts[0], exts[3], exts[4]},
+		"heartRate": {exts[2], exts[7]},
+	})
+
+	// a trailing slash on the prefix makes no difference
+	c.Assert(GroupExtensions(exts, vitals+"/"), check.DeepEquals, groups)
+
+	c.Assert(GroupExtensions(nil, vitals), check.HasLen, 0)
+	c.Assert(GroupExtensions(exts, "http://example.org/fhir/extensions/labs"), check.HasLen, 0)
+}
+
+func (e *ExtensionSuite) TestMergeExtensions(c *check.C) {
+	base := []Extension{
+		{Url: "http://example.org/fhir/extensions/both", ValueString: "base"},
+		{Url: "http://example.org/fhir/extensions/baseOnly", ValueString: "a"},
+		{Url: "http://example.org/fhir/extensions/withID", ElementID: "1", ValueString: "base 1"},
+	}
+	overlay := []Extension{
+		{Url: "http://example.org/fhir/extensions/overlayOnly", ValueString: "b"},
+		{Url: "http://example.org/fhir/extensions/both", ValueString: "overlay"},
+		{Url: "http://example.org/fhir/extensions/withID", ElementID: "2", ValueString: "overlay 2"},
+	}
+
+	c.Assert(MergeExtensions(base, overlay, OverlayWins), check.DeepEquals, []Extension{
+		overlay[1], base[1], base[2], overlay[0], overlay[2],
+	})
+	c.Assert(MergeExtensions(base, overlay, BaseWins), check.DeepEquals, []Extension{
+		base[0], base[1], base[2], overlay[0], overlay[2],
+	})
+	c.Assert(MergeExtensions(base, overlay, AppendAll), check.DeepEquals, []Extension{
+		base[0], base[1], base[2], overlay[0], overlay[1], overlay[2],
+	})
+
+	// repeated urls are matched in order
+	repeated := []Extension{
+		{Url: "http://example.org/fhir/extensions/both", ValueString: "overlay 1"},
+		{Url: "http://example.org/fhir/extensions/both", ValueString: "overlay 2"},
+	}
+	c.Assert(MergeExtensions(base[:1], repeated, OverlayWins), check.DeepEquals, []Extension{repeated[0], repeated[1]})
+	c.Assert(MergeExtensions(base[:1], repeated, BaseWins), check.DeepEquals, []Extension{base[0], repeated[1]})
+
+	// the base isn't modified
+	c.Assert(base[0].ValueString, check.Equals, "base")
+	c.Assert(MergeExtensions(nil, nil, OverlayWins), check.HasLen, 0)
+}
+
+func (e *ExtensionSuite) TestExtensionValueHash(c *check.C) {
+	const url = "http://example.org/fhir/extensions/foo"
+	dateTime := func(str string) *Extension {
+		dt, err := NewFHIRDateTime(str)
+		util.CheckErr(err)
+		return &Extension{Url: url, ValueDateTime: dt}
+	}
+
+	// the same instant in different time zones
+	brisbane := dateTime("2018-03-01T12:00:00+10:00")
+	utc := dateTime("2018-03-01T02:00:00Z")
+	c.Assert(brisbane.ValueHash(), check.Equals, utc.ValueHash())
+	c.Assert(brisbane.ValueHash(), check.Matches, "[0-9a-f]{64}")
+	c.Assert(dateTime("2018-03-01T12:00:00Z").ValueHash(), check.Not(check.Equals), utc.ValueHash())
+	c.Assert(dateTime("2018-03-01").ValueHash(), check.Not(check.Equals), dateTime("2018-03").ValueHash())
+
+	// the url isn't part of the hash, but the type is
+	other := *utc
+	other.Url = "http://example.org/fhir/extensions/bar"
+	c.Assert(other.ValueHash(), check.Equals, utc.ValueHash())
+	c.Assert((&Extension{Url: url, ValueString: "a"}).ValueHash(), check.Not(check.Equals), (&Extension{Url: url, ValueCode: "a"}).ValueHash())
+
+	// decimals by their string form, without the band
+	banded, err := NewDecimal("1.50")
+	util.CheckErr(err)
+	unbanded, err := NewDecimalWithoutBand("1.50")
+	util.CheckErr(err)
+	c.Assert((&Extension{Url: url, ValueQuantity: &Quantity{Value: banded, Unit: "mg"}}).ValueHash(), check.Equals,
+		(&Extension{Url: url, ValueQuantity: &Quantity{Value: unbanded, Unit: "mg"}}).ValueHash())
+
+	// codings in any order
+	loinc := Coding{System: "http://loinc.org", Code: "8480-6"}
+	snomed := Coding{System: "http://snomed.info/sct", Code: "271649006"}
+	c.Assert((&Extension{Url: url, ValueCodeableConcept: &CodeableConcept{Coding: []Coding{loinc, snomed}}}).ValueHash(), check.Equals,
+		(&Extension{Url: url, ValueCodeableConcept: &CodeableConcept{Coding: []Coding{snomed, loinc}}}).ValueHash())
+	c.Assert((&Extension{Url: url, ValueCodeableConcept: &CodeableConcept{Coding: []Coding{loinc}}}).ValueHash(), check.Not(check.Equals),
+		(&Extension{Url: url, ValueCodeableConcept: &CodeableConcept{Coding: []Coding{snomed}}}).ValueHash())
+
+	// references by what they resolve to
+	c.Assert((&Extension{Url: url, ValueReference: &Reference{Reference: "Patient/123"}}).ValueHash(), check.Equals,
+		(&Extension{Url: url, ValueReference: &Reference{Type: "Patient", ReferencedID: "123"}}).ValueHash())
+}
+
+func (e *ExtensionSuite) TestDiffExtensions(c *check.C) {
+	old := []Extension{
+		{Url: "http://example.org/fhir/extensions/unchanged", ValueString: "a"},
+		{Url: "http://example.org/fhir/extensions/changed", ValueString: "b"},
+		{Url: "http://example.org/fhir/extensions/removed", ValueCode: "c"},
+		{Url: "http://example.org/fhir/extensions/repeated", ValueString: "d"},
+		{Url: "http://example.org/fhir/extensions/repeated", ValueString: "e"},
+	}
+	updated := []Extension{
+		{Url: "http://example.org/fhir/extensions/added", ValueString: "f"},
+		{Url: "http://example.org/fhir/extensions/unchanged", ValueString: "a"},
+		{Url: "http://example.org/fhir/extensions/changed", ValueCode: "b"},
+		{Url: "http://example.org/fhir/extensions/repeated", ValueString: "d"},
+		{Url: "http://example.org/fhir/extensions/repeated", ValueString: "g"},
+	}
+
+	changes := DiffExtensions(old, updated)
+	c.Assert(changes, check.DeepEquals, []ExtensionChange{
+		{Url: "http://example.org/fhir/extensions/changed", Kind: ExtensionChanged, Old: &old[1], New: &updated[2]},
+		{Url: "http://example.org/fhir/extensions/removed", Kind: ExtensionRemoved, Old: &old[2]},
+		{Url: "http://example.org/fhir/extensions/repeated", Kind: ExtensionChanged, Old: &old[4], New: &updated[4]},
+		{Url: "http://example.org/fhir/extensions/added", Kind: ExtensionAdded, New: &updated[0]},
+	})
+
+	c.Assert(DiffExtensions(old, old), check.HasLen, 0)
+	c.Assert(DiffExtensions(nil, nil), check.HasLen, 0)
+
+	// extensions with the same url but different element ids are different extensions
+	withID := []Extension{{Url: "http://example.org/fhir/extensions/foo", ElementID: "1", ValueString: "a"}}
+	withOtherID := []Extension{{Url: "http://example.org/fhir/extensions/foo", ElementID: "2", ValueString: "a"}}
+	changes = DiffExtensions(withID, withOtherID)
+	c.Assert(changes, check.HasLen, 2)
+	c.Assert(changes[0].Kind, check.Equals, ExtensionRemoved)
+	c.Assert(changes[0].ElementID, check.Equals, "1")
+	c.Assert(changes[1].Kind, check.Equals, ExtensionAdded)
+	c.Assert(changes[1].ElementID, check.Equals, "2")
+}
+
+func (e *ExtensionSuite) TestUnmarshalExtensionWithoutContext(c *check.C) {
+	var warnings []string
+	warningf = func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	defer func() { warningf = glog.Warningf }()
+
+	fifty := int32(50)
+	decimal := 1.5
+	yes := true
+	date, err := NewFHIRDateTime("2018-03-01")
+	util.CheckErr(err)
+	when := time.Date(2018, time.March, 1, 12, 30, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		value    interface{}
+		expected Extension
+	}{
+		{"bar", Extension{Url: "foo", ValueString: "bar"}},
+		{int32(50), Extension{Url: "foo", ValueInteger: &fifty}},
+		{int64(50), Extension{Url: "foo", ValueInteger: &fifty}},
+		{1.5, Extension{Url: "foo", ValueDecimal: &decimal}},
+		{true, Extension{Url: "foo", ValueBoolean: &yes}},
+		{date, Extension{Url: "foo", ValueDateTime: date}},
+		{when, Extension{Url: "foo", ValueDateTime: &FHIRDateTime{Time: when, Precision: Timestamp}}},
+	} {
+		// with no @context at all, or without a definition for the value
+		for _, doc := range []bson.M{
+			{"foo": test.value},
+			{"@context": bson.M{"other": bson.M{"@id": "http://example.org/fhir/extensions/other", "@type": "string"}}, "foo": test.value},
+		} {
+			data, err := bson.Marshal(doc)
+			util.CheckErr(err)
+			var ext Extension
+			util.CheckErr(bson.Unmarshal(data, &ext))
+			if test.expected.ValueDateTime != nil {
+				c.Assert(ext.ValueDateTime.Time.Equal(test.expected.ValueDateTime.Time), check.Equals, true, check.Commentf("%#v", test.value))
+				c.Assert(ext.ValueDateTime.Precision, check.Equals, test.expected.ValueDateTime.Precision)
+				continue
+			}
+			c.Assert(ext, check.DeepEquals, test.expected, check.Commentf("%#v", test.value))
+		}
+	}
+	c.Assert(warnings[0], check.Equals, "extension foo has no @context definition; treating it as a string")
+
+	// the url is relative to the base, if set
+	SetExtensionBaseURL("http://example.org/fhir/extensions/")
+	defer SetExtensionBaseURL("")
+	data, err := bson.Marshal(bson.M{"foo": "bar"})
+	util.CheckErr(err)
+	var ext Extension
+	util.CheckErr(bson.Unmarshal(data, &ext))
+	c.Assert(ext.Url, check.Equals, "http://example.org/fhir/extensions/foo")
+
+	// values whose type can't be inferred are still errors
+	for _, value := range []interface{}{bson.M{"system": "http://loinc.org"}, []string{"a"}} {
+		data, err = bson.Marshal(bson.M{"foo": value})
+		util.CheckErr(err)
+		err = bson.Unmarshal(data, &ext)
+		c.Assert(err, check.ErrorMatches, "Couldn't properly unmarshal extension; key foo not found in @context and .* can't be inferred")
+	}
+}
+
+func (e *ExtensionSuite) TestMaxExtensionDepth(c *check.C) {
+	// extensions nested in the extensions of Meta values
+	nested := func(depth int) Extension {
+		ext := Extension{Url: "http://example.org/fhir/extensions/leaf", ValueString: "bar"}
+		for i := 1; i < depth; i++ {
+			ext = Extension{
+				Url:       "http://example.org/fhir/extensions/meta",
+				ValueMeta: &Meta{Element: Element{Extension: []Extension{ext}}},
+			}
+		}
+		return ext
+	}
+	c.Assert(extensionDepth(reflect.ValueOf(nested(3)), 0, 100), check.Equals, 3)
+
+	SetMaxExtensionDepth(5)
+	defer SetMaxExtensionDepth(0)
+
+	data, err := bson.Marshal(nested(5))
+	util.CheckErr(err)
+	var unmarshalled Extension
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled, check.DeepEquals, nested(5))
+
+	_, err = bson.Marshal(nested(6))
+	c.Assert(err, check.ErrorMatches, "Couldn't marshal extension http://example.org/fhir/extensions/meta: extensions are nested more than 5 deep")
+	_, err = MarshalExtensions([]Extension{nested(6)})
+	c.Assert(err, check.ErrorMatches, "Couldn't marshal extension http://example.org/fhir/extensions/meta: extensions are nested more than 5 deep")
+
+	// by default the limit is 20
+	SetMaxExtensionDepth(0)
+	_, err = bson.Marshal(nested(30))
+	c.Assert(err, check.ErrorMatches, ".* extensions are nested more than 20 deep")
+
+	// stored before the limit was lowered
+	data, err = bson.Marshal(nested(6))
+	util.CheckErr(err)
+	SetMaxExtensionDepth(5)
+	err = bson.Unmarshal(data, &unmarshalled)
+	c.Assert(err, check.ErrorMatches, "Couldn't unmarshal extension: extensions are nested more than 5 deep")
+
+	// extensions side by side aren't nested
+	wide := Extension{Url: "http://example.org/fhir/extensions/meta", ValueMeta: &Meta{}}
+	for i := 0; i < 10; i++ {
+		wide.ValueMeta.Extension = append(wide.ValueMeta.Extension, nested(4))
+	}
+	data, err = bson.Marshal(wide)
+	util.CheckErr(err)
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+}
+
+func (e *ExtensionSuite) TestExtensionBaseURL(c *check.C) {
+	SetExtensionBaseURL("http://example.org/fhir/extensions/")
+	defer SetExtensionBaseURL("")
+
+	for _, test := range []struct {
+		url, stored string
+	}{
+		{"http://example.org/fhir/extensions/foo", "foo"},
+		{"http://other.example.org/fhir/extensions/foo", "http://other.example.org/fhir/extensions/foo"},
+	} {
+		ext := Extension{Url: test.url, ValueString: "bar"}
+		data, err := bson.Marshal(ext)
+		util.CheckErr(err)
+		var m bson.M
+		util.CheckErr(bson.Unmarshal(data, &m))
+		c.Assert(m["@context"].(bson.M)["foo"].(bson.M)["@id"], check.Equals, test.stored)
+
+		var unmarshalled Extension
+		util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+		c.Assert(unmarshalled, check.DeepEquals, ext)
+
+		merged, err := MarshalExtensions([]Extension{ext})
+		util.CheckErr(err)
+		c.Assert(merged["@context"].(bson.M)["foo"].(contextDefinition).ID, check.Equals, test.stored)
+
+		SetPlainExtensionFormat(true)
+		data, err = bson.Marshal(ext)
+		SetPlainExtensionFormat(false)
+		util.CheckErr(err)
+		m = nil
+		util.CheckErr(bson.Unmarshal(data, &m))
+		c.Assert(m["url"], check.Equals, test.stored)
+		unmarshalled = Extension{}
+		util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+		c.Assert(unmarshalled, check.DeepEquals, ext)
+	}
+
+	// extensions stored before the base was set are still read
+	SetExtensionBaseURL("")
+	data, err := bson.Marshal(Extension{Url: "http://example.org/fhir/extensions/foo", ValueString: "bar"})
+	util.CheckErr(err)
+	SetExtensionBaseURL("http://example.org/fhir/extensions/")
+	var ext Extension
+	util.CheckErr(bson.Unmarshal(data, &ext))
+	c.Assert(ext.Url, check.Equals, "http://example.org/fhir/extensions/foo")
+}
+
+func (e *ExtensionSuite) TestExtensionKeyFunc(c *check.C) {
+	hashKey := func(url string) string {
+		sum := sha256.Sum256([]byte(url))
+		return "x" + hex.EncodeToString(sum[:8])
+	}
+	ext := Extension{Url: "http://example.org/fhir/extensions/keyed", ValueString: "bar"}
+	key := hashKey(ext.Url)
+
+	// cache the @context with the default name first
+	_, err := bson.Marshal(ext)
+	util.CheckErr(err)
+
+	SetExtensionKeyFunc(hashKey)
+	defer SetExtensionKeyFunc(nil)
+
+	for i := 0; i < 2; i++ {
+		data, err := bson.Marshal(ext)
+		util.CheckErr(err)
+		var m bson.M
+		util.CheckErr(bson.Unmarshal(data, &m))
+		c.Assert(m, check.DeepEquals, bson.M{
+			"@context": bson.M{key: bson.M{"@id": ext.Url, "@type": "string"}},
+			key:        "bar",
+		})
+
+		// the url comes from the @context
+		var unmarshalled Extension
+		util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+		c.Assert(unmarshalled, check.DeepEquals, ext)
+	}
+
+	other := Extension{Url: "http://example.org/fhir/extensions/other", ValueString: "baz"}
+	merged, err := MarshalExtensions([]Extension{ext, other})
+	util.CheckErr(err)
+	c.Assert(merged[key], check.Equals, "bar")
+	c.Assert(merged[hashKey(other.Url)], check.Equals, "baz")
+
+	// keys that can't be stored are an error
+	SetExtensionKeyFunc(func(url string) string { return "extensions.keyed" })
+	_, err = bson.Marshal(ext)
+	c.Assert(err, check.ErrorMatches, `Couldn't store extension http://example.org/fhir/extensions/keyed under the name "extensions.keyed" from the extension key function`)
+
+	// back to the last segment of the url
+	SetExtensionKeyFunc(nil)
+	data, err := bson.Marshal(ext)
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m["keyed"], check.Equals, "bar")
+}
+
+func (e *ExtensionSuite) TestCachedExtensionContext(c *check.C) {
+	ext := Extension{Url: "http://example.org/fhir/extensions/cached", ValueString: "bar"}
+	expected := bson.M{
+		"@context": bson.M{"cached": bson.M{"@id": "http://example.org/fhir/extensions/cached", "@type": "string"}},
+		"cached":   "bar",
+	}
+
+	// the first time the @context is built, after that it comes from the cache
+	for i := 0; i < 3; i++ {
+		data, err := bson.Marshal(ext)
+		util.CheckErr(err)
+		var m bson.M
+		util.CheckErr(bson.Unmarshal(data, &m))
+		c.Assert(m, check.DeepEquals, expected)
+	}
+
+	// the same url with another type has its own @context
+	other := Extension{Url: "http://example.org/fhir/extensions/cached", ValueCode: "bar"}
+	data, err := bson.Marshal(other)
+	util.CheckErr(err)
+	var unmarshalled Extension
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled, check.DeepEquals, other)
+
+	// changing a returned @context doesn't change the cached one
+	doc, err := ext.GetBSON()
+	util.CheckErr(err)
+	context := doc.(bson.M)["@context"].(bson.Raw)
+	for i := range context.Data {
+		context.Data[i] = 0
+	}
+	data, err = bson.Marshal(ext)
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m, check.DeepEquals, expected)
+}
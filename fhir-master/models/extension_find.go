@@ -0,0 +1,22 @@
+package models
+
+// FindExtension returns the first extension with exactly the url
+func FindExtension(exts []Extension, url string) (*Extension, bool) {
+	for i := range exts {
+		if exts[i].Url == url {
+			return &exts[i], true
+		}
+	}
+	return nil, false
+}
+
+// FindExtensions returns all the extensions with exactly the url, in order, e.g. for repeating extensions
+func FindExtensions(exts []Extension, url string) []Extension {
+	var found []Extension
+	for _, ext := range exts {
+		if ext.Url == url {
+			found = append(found, ext)
+		}
+	}
+	return found
+}
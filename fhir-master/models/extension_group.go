@@ -0,0 +1,27 @@
+package models
+
+import "strings"
+
+// GroupExtensions buckets the extensions whose urls start with byUrlPrefix by the next segment of
+// their url, e.g. with the prefix http://example.org/fhir/extensions/vitals the extensions
+// .../vitals/bp/value and .../vitals/bp/method are both grouped under "bp". This is useful for
+// building Observation.component entries from related extensions. Extensions keep their order within
+// a bucket and extensions without the prefix are left out.
+func GroupExtensions(exts []Extension, byUrlPrefix string) map[string][]Extension {
+	prefix := strings.TrimSuffix(byUrlPrefix, "/") + "/"
+	groups := make(map[string][]Extension)
+	for _, ext := range exts {
+		if !strings.HasPrefix(ext.Url, prefix) {
+			continue
+		}
+		key := ext.Url[len(prefix):]
+		if slash := strings.Index(key, "/"); slash >= 0 {
+			key = key[:slash]
+		}
+		if key == "" {
+			continue
+		}
+		groups[key] = append(groups[key], ext)
+	}
+	return groups
+}
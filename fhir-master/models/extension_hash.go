@@ -0,0 +1,137 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// ValueHash returns a hash of the extension's type and value (not its url) that is the same for
+// values that mean the same thing, so that identical extensions can be found cheaply. As with Equal,
+// times are hashed by the instant they refer to, decimals by their string form and references by
+// the resource they resolve to. In addition the order of codings doesn't matter.
+func (e *Extension) ValueHash() string {
+	value, fhirType := e.Value()
+	var buf bytes.Buffer
+	writeHashString(&buf, fhirType)
+	if value != nil {
+		semanticHash(&buf, reflect.ValueOf(value))
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+var codingsType = reflect.TypeOf([]Coding{})
+
+// semanticHash writes a canonical form of v, in which values that semanticEqual considers equal are the same
+func semanticHash(buf *bytes.Buffer, v reflect.Value) {
+	switch v.Type() {
+	case timeType:
+		writeHashInt(buf, v.Interface().(time.Time).UnixNano())
+		return
+	case decimalType:
+		d := v.Interface().(Decimal)
+		if d.Str == "" {
+			writeHashFloat(buf, d.Num)
+		} else {
+			writeHashString(buf, d.Str)
+		}
+		return
+	case referenceType:
+		ref := reference(v.Interface().(Reference))
+		ref.expand()
+		if ref.ReferencedID != "" {
+			writeHashString(buf, ref.Type)
+			writeHashString(buf, ref.ReferencedID)
+			writeHashString(buf, ref.Version)
+		} else {
+			writeHashString(buf, ref.Reference)
+		}
+		writeHashString(buf, ref.Display)
+		semanticHash(buf, reflect.ValueOf(ref.Identifier))
+		return
+	case codingsType:
+		// sorted by the hash of each coding
+		codings := make([]string, v.Len())
+		for i := range codings {
+			var coding bytes.Buffer
+			semanticHash(&coding, v.Index(i))
+			codings[i] = coding.String()
+		}
+		sort.Strings(codings)
+		writeHashInt(buf, int64(len(codings)))
+		for _, coding := range codings {
+			writeHashString(buf, coding)
+		}
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteByte(0)
+			return
+		}
+		buf.WriteByte(1)
+		semanticHash(buf, v.Elem())
+	case reflect.Slice:
+		writeHashInt(buf, int64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			semanticHash(buf, v.Index(i))
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		writeHashInt(buf, int64(len(keys)))
+		for _, key := range keys {
+			semanticHash(buf, key)
+			semanticHash(buf, v.MapIndex(key))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			semanticHash(buf, v.Field(i))
+		}
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeHashInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeHashInt(buf, int64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		writeHashFloat(buf, v.Float())
+	case reflect.String:
+		writeHashString(buf, v.String())
+	default:
+		writeHashString(buf, fmt.Sprintf("%#v", v.Interface()))
+	}
+}
+
+// writeHashString writes the length first so that e.g. "ab", "c" and "a", "bc" differ
+func writeHashString(buf *bytes.Buffer, s string) {
+	writeHashInt(buf, int64(len(s)))
+	buf.WriteString(s)
+}
+
+func writeHashInt(buf *bytes.Buffer, i int64) {
+	for shift := 56; shift >= 0; shift -= 8 {
+		buf.WriteByte(byte(uint64(i) >> uint(shift)))
+	}
+}
+
+func writeHashFloat(buf *bytes.Buffer, f float64) {
+	if f == 0 {
+		f = 0 // -0 is equal to 0
+	}
+	writeHashInt(buf, int64(math.Float64bits(f)))
+}
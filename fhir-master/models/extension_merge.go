@@ -0,0 +1,44 @@
+package models
+
+// MergePolicy decides what MergeExtensions does with an extension found in both slices
+type MergePolicy int
+
+const (
+	// OverlayWins replaces the base extension with the overlay one, keeping the base's position
+	OverlayWins MergePolicy = iota
+	// BaseWins keeps the base extension and drops the overlay one
+	BaseWins
+	// AppendAll keeps both, i.e. the overlay is appended to the base
+	AppendAll
+)
+
+// MergeExtensions combines a base resource's extensions with overlay extensions. As in DiffExtensions,
+// extensions are the same if they have the same url and element id, matched in order if a url appears
+// more than once. Overlay extensions not in the base are appended in their order.
+func MergeExtensions(base, overlay []Extension, policy MergePolicy) []Extension {
+	merged := make([]Extension, 0, len(base)+len(overlay))
+	merged = append(merged, base...)
+	if policy == AppendAll {
+		return append(merged, overlay...)
+	}
+
+	positions := make(map[extensionKey][]int, len(base))
+	for i := range base {
+		key := extensionKey{base[i].Url, base[i].ElementID}
+		positions[key] = append(positions[key], i)
+	}
+
+	for _, ext := range overlay {
+		key := extensionKey{ext.Url, ext.ElementID}
+		candidates := positions[key]
+		if len(candidates) == 0 {
+			merged = append(merged, ext)
+			continue
+		}
+		positions[key] = candidates[1:]
+		if policy == OverlayWins {
+			merged[candidates[0]] = ext
+		}
+	}
+	return merged
+}
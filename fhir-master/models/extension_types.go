@@ -0,0 +1,80 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+)
+
+// ExtensionValueType is an entry in the registry of the types an extension's value can have,
+// linking the FHIR type (as stored in @type) to the Value[x] field of Extension that holds it.
+// The registry is built from Extension's fields, so a new value type only needs a field (and,
+// if it's a FHIR primitive, an entry in fhirPrimitiveTypes) plus any marshalling it needs.
+type ExtensionValueType struct {
+	FHIRType  string       // e.g. "string" or "CodeableConcept"
+	FieldName string       // e.g. "ValueString" or "ValueCodeableConcept"
+	GoType    reflect.Type // the type of the field, e.g. string or *CodeableConcept
+	index     int          // of the field in Extension
+}
+
+// JSONKey is the name of the value in FHIR JSON, e.g. "valueString"
+func (t ExtensionValueType) JSONKey() string {
+	return "v" + t.FieldName[1:]
+}
+
+// FHIR primitive types, whose names start with a lowercase letter unlike the Value[x] field names
+var fhirPrimitiveTypes = makeStringSet(`Instant Time Date DateTime Decimal Boolean Integer String Uri Base64Binary
+	UnsignedInt PositiveInt Code Id Markdown Oid`)
+
+var extensionValueTypes, extensionValueTypesByName = func() ([]ExtensionValueType, map[string]ExtensionValueType) {
+	var types []ExtensionValueType
+	byName := map[string]ExtensionValueType{}
+	extensionType := reflect.TypeOf(Extension{})
+	for i := 0; i < extensionType.NumField(); i++ {
+		field := extensionType.Field(i)
+		if !strings.HasPrefix(field.Name, "Value") || field.Name == "ValueRaw" {
+			continue
+		}
+		t := ExtensionValueType{
+			FHIRType:  getTypeFromValueXFieldName(field.Name),
+			FieldName: field.Name,
+			GoType:    field.Type,
+			index:     i,
+		}
+		types = append(types, t)
+		// both as written by GetBSON (e.g. "string") and capitalised like the field name (e.g. "String")
+		byName[t.FHIRType] = t
+		byName[strings.TrimPrefix(field.Name, "Value")] = t
+	}
+	return types, byName
+}()
+
+// ExtensionValueTypes returns the registry of value types, in the order of Extension's fields
+func ExtensionValueTypes() []ExtensionValueType {
+	return append([]ExtensionValueType(nil), extensionValueTypes...)
+}
+
+// LookupExtensionValueType finds the value type for a FHIR type, e.g. "string" (or "String") or "CodeableConcept"
+func LookupExtensionValueType(fhirType string) (ExtensionValueType, bool) {
+	t, found := extensionValueTypesByName[fhirType]
+	return t, found
+}
+
+// ExtensionValueTypeOfField finds the value type held by a Value[x] field of Extension, e.g. "ValueString"
+func ExtensionValueTypeOfField(fieldName string) (ExtensionValueType, bool) {
+	if !strings.HasPrefix(fieldName, "Value") {
+		return ExtensionValueType{}, false
+	}
+	t, found := extensionValueTypesByName[strings.TrimPrefix(fieldName, "Value")]
+	return t, found && t.FieldName == fieldName
+}
+
+// getTypeFromValueXFieldName takes in a FHIR type with an uppercase letter and fixes it so it is lowercase if
+// it is a FHIR "primitive". This function has little to no value outside of the intended use case -- which is
+// to create the right type based on the field names for extension Value[x] properties.
+func getTypeFromValueXFieldName(valueField string) string {
+	fhirType := strings.TrimPrefix(valueField, "Value")
+	if fhirPrimitiveTypes[fhirType] {
+		fhirType = strings.ToLower(fhirType[:1]) + fhirType[1:]
+	}
+	return fhirType
+}
@@ -0,0 +1,15 @@
+package models
+
+import "strconv"
+
+// WalkExtensions calls fn with each extension in order, along with its path (e.g. "extension[1]"),
+// stopping at the first error, which it returns. fn can change the extension in place. Nested
+// extensions will get paths like "extension[1].extension[0]" once they are supported.
+func WalkExtensions(exts []Extension, fn func(path string, e *Extension) error) error {
+	for i := range exts {
+		if err := fn("extension["+strconv.Itoa(i)+"]", &exts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/eug48/fhir/utils"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -18,47 +19,232 @@ const (
 	Year      = "year"
 	Timestamp = "timestamp"
 	Time      = "time"
+	Instant   = "instant" // always a full timestamp with a time zone, unlike dateTime
 )
 
+// Names of the precisions as used in logs and messages
+var precisionNames = map[Precision]string{
+	Year:      "year",
+	YearMonth: "month",
+	Date:      "day",
+	Time:      "time",
+	Timestamp: "timestamp",
+	Instant:   "instant",
+}
+
+// String returns the name of the precision: "year", "month", "day", "time", "timestamp" or "instant"
+func (p Precision) String() string {
+	if name, found := precisionNames[p]; found {
+		return name
+	}
+	return string(p)
+}
+
+// ParsePrecision is the inverse of Precision.String. It also accepts the stored values (e.g. "year-month").
+func ParsePrecision(name string) (Precision, error) {
+	for p, pName := range precisionNames {
+		if name == pName || name == string(p) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unrecognised precision: %q", name)
+}
+
 type FHIRDateTime struct {
 	Time      time.Time
 	Precision Precision
 }
 
+// clock returns the current time; see SetClock
+var clock = time.Now
+
+// SetClock replaces the source of the current time used by Now, e.g. with a fixed time in tests
+// or for deterministic ingest. A nil clock restores time.Now.
+func SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	clock = now
+}
+
+// Now returns the current time (according to SetClock) with the given precision
+func Now(precision Precision) *FHIRDateTime {
+	return &FHIRDateTime{Time: clock(), Precision: precision}
+}
+
+// withPrecision returns the value with its precision inferred from the time if none was given:
+// an instant if it has fractional seconds and otherwise a timestamp
+func (f FHIRDateTime) withPrecision() FHIRDateTime {
+	if f.Precision != "" || f.Time.IsZero() {
+		return f
+	}
+	if f.Time.Nanosecond() != 0 {
+		f.Precision = Instant
+	} else {
+		f.Precision = Timestamp
+	}
+	return f
+}
+
+// How fine each precision covering a range of dates is, for Truncate
+var precisionRanks = map[Precision]int{Year: 1, YearMonth: 2, Date: 3, Timestamp: 4, Instant: 5}
+
+// Truncate returns the value floored to a coarser precision in its own time zone, e.g. the month
+// containing a timestamp, which is then stored with the search window of the whole month.
+// Values that are already as coarse (or are times of day) are returned as they are.
+func (f FHIRDateTime) Truncate(p Precision) FHIRDateTime {
+	f = f.withPrecision()
+	rank, known := precisionRanks[f.Precision]
+	targetRank, targetKnown := precisionRanks[p]
+	if !known || !targetKnown || targetRank >= rank {
+		return f
+	}
+
+	year, month, day := f.Time.Date()
+	loc := f.Time.Location()
+	switch p {
+	case Year:
+		f.Time = time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+	case YearMonth:
+		f.Time = time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	case Date:
+		f.Time = time.Date(year, month, day, 0, 0, 0, 0, loc)
+	case Timestamp:
+		f.Time = f.Time.Truncate(time.Second)
+	}
+	f.Precision = p
+	return f
+}
+
+// Whether instants are stored as plain BSON dates; see SetPlainInstantDates
+var plainInstantDates = false
+
+// SetPlainInstantDates turns on (or off) storing values with instant precision as plain BSON dates
+// rather than with __from, __to and __strDate, for collections such as audit logs that are only ever
+// queried by exact instant. BSON dates only have millisecond precision and lose the time zone, and
+// can't be searched by range like the other fields. While this is on, SetBSON reads plain dates back
+// as instants rather than timestamps.
+func SetPlainInstantDates(enabled bool) {
+	plainInstantDates = enabled
+}
+
 func (f FHIRDateTime) GetBSON() (interface{}, error) {
+	f = f.withPrecision()
 
-	// if f.Precision == Timestamp {
-		// return f.Time, nil
-	// }
+	if plainInstantDates && f.Precision == Instant {
+		return f.Time, nil
+	}
 
 	bytesForm, err := f.MarshalJSON()
-	stringForm := string(bytesForm[1:len(bytesForm)-1]) // remove JSON quotes
 	if err != nil {
 		return nil, errors.Wrap(err, "FHIRDateTime.GetBSON: MarshalJSON failed")
 	}
+	stringForm := string(bytesForm[1:len(bytesForm)-1]) // remove JSON quotes
 
-	date, err := utils.ParseDate(stringForm)
+	if f.Precision == Time {
+		// a time of day isn't a range of dates, so can't be searched by one
+		return []bson.DocElem{{Name: "__strDate", Value: stringForm}}, nil
+	}
+
+	from, to, err := f.rangeOf(stringForm)
 	if err != nil {
 		return nil, errors.Wrap(err, "FHIRDateTime.GetBSON: ParseDate failed")
 	}
 
 	doc := []bson.DocElem{
-		bson.DocElem{Name: "__from", Value: date.RangeLowIncl()},
-		bson.DocElem{Name: "__to", Value: date.RangeHighExcl()},
+		bson.DocElem{Name: "__from", Value: from},
+		bson.DocElem{Name: "__to", Value: to},
 		bson.DocElem{Name: "__strDate", Value: stringForm},
 	}
 	return doc, nil
 
 }
 
+// rangeOf returns the range of time covered by the value given its precision (stored as __from and __to)
+func (f FHIRDateTime) rangeOf(stringForm string) (from, to time.Time, err error) {
+	// Dates are windows of whole calendar days in the value's own location, which can be 23 or 25 hours long
+	// across DST transitions, so build them with time.Date rather than adding fixed durations
+	year, month, day := f.Time.Date()
+	loc := f.Time.Location()
+	switch f.Precision {
+	case Year:
+		return time.Date(year, time.January, 1, 0, 0, 0, 0, loc), time.Date(year+1, time.January, 1, 0, 0, 0, 0, loc), nil
+	case YearMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, loc), time.Date(year, month+1, 1, 0, 0, 0, 0, loc), nil
+	case Date:
+		return time.Date(year, month, day, 0, 0, 0, 0, loc), time.Date(year, month, day+1, 0, 0, 0, 0, loc), nil
+	case Timestamp, Instant:
+		// searched as the second containing it, even if it has fractional seconds
+		// (Go doesn't model leap seconds so a second is always a second)
+		from = f.Time.Truncate(time.Second)
+		return from, from.Add(time.Second), nil
+	}
+
+	date, err := utils.ParseDate(stringForm)
+	if err != nil {
+		return
+	}
+	return date.RangeLowIncl(), date.RangeHighExcl(), nil
+}
+
+// window is like rangeOf but for values that haven't been marshalled yet: e.g. all of 2012 for "2012"
+// or a single second for "2012-03-01T12:00:00Z". to is exclusive.
+func (f FHIRDateTime) window() (from, to time.Time, err error) {
+	f = f.withPrecision()
+	bytesForm, err := f.MarshalJSON()
+	if err != nil {
+		return
+	}
+	return f.rangeOf(string(bytesForm[1 : len(bytesForm)-1]))
+}
+
+// Before reports whether the value ends before other starts, taking the precision of both into account.
+// Values that don't cover a range of dates (e.g. a time) are never before, after or overlapping anything.
+func (f FHIRDateTime) Before(other FHIRDateTime) bool {
+	_, to, err := f.window()
+	if err != nil {
+		return false
+	}
+	otherFrom, _, err := other.window()
+	if err != nil {
+		return false
+	}
+	return !to.After(otherFrom)
+}
+
+// After reports whether the value starts after other ends
+func (f FHIRDateTime) After(other FHIRDateTime) bool {
+	return other.Before(f)
+}
+
+// Overlaps reports whether the value and other share any time, e.g. "2012" overlaps "2012-03-01T12:00:00Z"
+func (f FHIRDateTime) Overlaps(other FHIRDateTime) bool {
+	from, to, err := f.window()
+	if err != nil {
+		return false
+	}
+	otherFrom, otherTo, err := other.window()
+	if err != nil {
+		return false
+	}
+	return from.Before(otherTo) && otherFrom.Before(to)
+}
+
+// InLocation returns the time converted to loc for display, e.g. an instant stored in UTC shown in
+// a user's own time zone. The value itself, including its time zone and precision, is unchanged.
+func (f FHIRDateTime) InLocation(loc *time.Location) time.Time {
+	return f.Time.In(loc)
+}
+
 func (f *FHIRDateTime) SetBSON(raw bson.Raw) error {
 	// fmt.Printf("FHIRDateTime.SetBSON: %+v %s\n", raw, string(raw.Data))
 	if raw.Kind == 2 {
 		// string - e.g. type instant
-		err := f.UnmarshalJSON([]byte("\"" + string(raw.Data[4:len(raw.Data)-1]) + "\""))
+		parsed, err := NewFHIRDateTime(string(raw.Data[4 : len(raw.Data)-1]))
 		if err != nil {
-			return errors.Wrap(err, "FHIRDateTime.SetBSON --> UnmarshalJSON failed")
+			return errors.Wrap(err, "FHIRDateTime.SetBSON --> NewFHIRDateTime failed")
 		}
+		*f = *parsed
 		return nil
 	} else if raw.Kind == 3 {
 
@@ -73,10 +259,11 @@ func (f *FHIRDateTime) SetBSON(raw bson.Raw) error {
 				if !ok {
 					return errors.New("FHIRDateTime.SetBSON: __strDate is not a string")
 				}
-				err = f.UnmarshalJSON([]byte("\"" + strDate + "\""))
+				parsed, err := NewFHIRDateTime(strDate)
 				if err != nil {
-					return errors.Wrap(err, "FHIRDateTime.SetBSON --> UnmarshalJSON failed")
+					return errors.Wrap(err, "FHIRDateTime.SetBSON --> NewFHIRDateTime failed")
 				}
+				*f = *parsed
 				return nil
 			}
 		}
@@ -87,47 +274,71 @@ func (f *FHIRDateTime) SetBSON(raw bson.Raw) error {
 		if err != nil {
 			return errors.Wrap(err, "FHIRDateTime.SetBSON --> Unmarshal of UTC timestamp failed")
 		}
-		f.Precision = Timestamp
+		if plainInstantDates {
+			f.Precision = Instant
+		} else {
+			f.Precision = Timestamp
+		}
 		return nil
 	} else {
 		return fmt.Errorf("FHIRDateTime.GetBSON: could not parse BSON kind %d", raw.Kind)
 	}
 }
 
-func (f *FHIRDateTime) UnmarshalJSON(data []byte) (err error) {
-	strData := string(data)
-	if len(data) <= 12 {
-		f.Precision = Precision("date")
-		f.Time, err = time.ParseInLocation("\"2006-01-02\"", strData, time.Local)
-		if err != nil {
-			f.Precision = Precision("year-month")
-			f.Time, err = time.ParseInLocation("\"2006-01\"", strData, time.Local)
-		}
-		if err != nil {
-			f.Precision = Precision("year")
-			f.Time, err = time.ParseInLocation("\"2006\"", strData, time.Local)
-		}
+func (f *FHIRDateTime) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("unable to parse DateTime: %s", data)
+	}
+	parsed, err := NewFHIRDateTime(str)
+	if err != nil {
+		return err
+	}
+	*f = *parsed
+	return nil
+}
+
+// Layouts of the FHIR date and time types without a time zone, which are parsed in the local one
+var localDateTimeLayouts = []struct {
+	layout    string
+	precision Precision
+}{
+	{"2006-01-02", Date},
+	{"2006-01", YearMonth},
+	{"2006", Year},
+	{"15:04:05", Time}, // TODO: should move time into a separate type
+}
+
+// NewFHIRDateTime parses a FHIR date, dateTime, instant or time (e.g. "2012", "2012-03-01" or
+// "2012-03-01T12:00:00+05:30"), setting the precision from how much of it is given. Dates are in
+// the local time zone while timestamps keep their offset.
+func NewFHIRDateTime(str string) (*FHIRDateTime, error) {
+	if len(str) > len("2006-01-02") {
+		t, err := time.Parse(time.RFC3339, str)
 		if err != nil {
-			// TODO: should move time into a separate type
-			f.Precision = Precision("time")
-			f.Time, err = time.ParseInLocation("\"15:04:05\"", strData, time.Local)
+			return nil, fmt.Errorf("unable to parse DateTime: %q", str)
 		}
-		if err != nil {
-			err = fmt.Errorf("unable to parse DateTime: %s", strData)
-			f.Precision = ""
+		if strings.Contains(str, ".") {
+			// fractional seconds, as withPrecision would infer, so that they're marshalled back
+			return &FHIRDateTime{Time: t, Precision: Instant}, nil
 		}
+		return &FHIRDateTime{Time: t, Precision: Timestamp}, nil
+	}
 
-	} else {
-		f.Precision = Precision("timestamp")
-		f.Time = time.Time{}
-		err = f.Time.UnmarshalJSON(data)
+	for _, l := range localDateTimeLayouts {
+		if t, err := time.ParseInLocation(l.layout, str, time.Local); err == nil {
+			return &FHIRDateTime{Time: t, Precision: l.precision}, nil
+		}
 	}
-	return err
+	return nil, fmt.Errorf("unable to parse DateTime: %q", str)
 }
 
 func (f FHIRDateTime) MarshalJSON() ([]byte, error) {
+	f = f.withPrecision()
 	if f.Precision == Timestamp {
 		return json.Marshal(f.Time.Format(time.RFC3339))
+	} else if f.Precision == Instant {
+		return json.Marshal(f.Time.Format(time.RFC3339Nano))
 	} else if f.Precision == YearMonth {
 		return json.Marshal(f.Time.Format("2006-01"))
 	} else if f.Precision == Year {
@@ -7,6 +7,7 @@ import (
 
 	"github.com/pebbe/util"
 	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type FDSuite struct {
@@ -73,3 +74,381 @@ func (s *FDSuite) TestFHIRDateTime(c *check.C) {
 
 	// TODO: test error handling
 }
+
+func (s *FDSuite) TestFHIRDateTimeComparisons(c *check.C) {
+	year2011 := FHIRDateTime{Time: time.Date(2011, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: Year}
+	year2012 := FHIRDateTime{Time: time.Date(2012, time.January, 1, 0, 0, 0, 0, time.UTC), Precision: Year}
+	march2012 := FHIRDateTime{Time: time.Date(2012, time.March, 1, 0, 0, 0, 0, time.UTC), Precision: YearMonth}
+	day := FHIRDateTime{Time: time.Date(2012, time.March, 1, 0, 0, 0, 0, time.UTC), Precision: Date}
+	timestamp := FHIRDateTime{Time: time.Date(2012, time.March, 1, 12, 0, 0, 0, time.UTC), Precision: Timestamp}
+	instant := FHIRDateTime{Time: time.Date(2012, time.March, 1, 12, 0, 0, 500000000, time.UTC), Precision: Instant}
+
+	// values of different precisions overlap when one contains the other
+	c.Assert(year2012.Overlaps(timestamp), check.Equals, true)
+	c.Assert(timestamp.Overlaps(year2012), check.Equals, true)
+	c.Assert(march2012.Overlaps(day), check.Equals, true)
+	c.Assert(day.Overlaps(timestamp), check.Equals, true)
+	c.Assert(timestamp.Overlaps(instant), check.Equals, true)
+	c.Assert(year2012.Before(timestamp), check.Equals, false)
+	c.Assert(year2012.After(timestamp), check.Equals, false)
+
+	// disjoint values
+	c.Assert(year2011.Overlaps(year2012), check.Equals, false)
+	c.Assert(year2011.Overlaps(timestamp), check.Equals, false)
+	c.Assert(year2011.Before(year2012), check.Equals, true)
+	c.Assert(year2011.Before(timestamp), check.Equals, true)
+	c.Assert(year2012.After(year2011), check.Equals, true)
+	c.Assert(timestamp.After(year2011), check.Equals, true)
+	c.Assert(year2012.Before(year2011), check.Equals, false)
+	c.Assert(year2011.After(year2012), check.Equals, false)
+
+	// consecutive seconds don't overlap
+	nextSecond := FHIRDateTime{Time: time.Date(2012, time.March, 1, 12, 0, 1, 0, time.UTC), Precision: Timestamp}
+	c.Assert(timestamp.Overlaps(nextSecond), check.Equals, false)
+	c.Assert(timestamp.Before(nextSecond), check.Equals, true)
+	c.Assert(instant.Before(nextSecond), check.Equals, true)
+
+	// a time isn't a range of dates, so can't be compared
+	noon := FHIRDateTime{Time: time.Date(0, time.January, 1, 12, 0, 0, 0, time.UTC), Precision: Time}
+	c.Assert(noon.Overlaps(noon), check.Equals, false)
+	c.Assert(noon.Before(year2012), check.Equals, false)
+	c.Assert(year2012.After(noon), check.Equals, false)
+}
+
+func (s *FDSuite) TestPrecisionNames(c *check.C) {
+	names := map[Precision]string{
+		Year:      "year",
+		YearMonth: "month",
+		Date:      "day",
+		Time:      "time",
+		Timestamp: "timestamp",
+		Instant:   "instant",
+	}
+	for precision, name := range names {
+		c.Assert(precision.String(), check.Equals, name)
+
+		parsed, err := ParsePrecision(name)
+		util.CheckErr(err)
+		c.Assert(parsed, check.Equals, precision)
+
+		parsed, err = ParsePrecision(string(precision))
+		util.CheckErr(err)
+		c.Assert(parsed, check.Equals, precision)
+	}
+
+	_, err := ParsePrecision("fortnight")
+	c.Assert(err, check.ErrorMatches, `unrecognised precision: "fortnight"`)
+	_, err = ParsePrecision("")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *FDSuite) TestFHIRDateTimeWindowsAcrossDST(c *check.C) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		c.Skip("time zone database not available: " + err.Error())
+	}
+
+	window := func(f FHIRDateTime) (from, to time.Time) {
+		doc, err := f.GetBSON()
+		util.CheckErr(err)
+		elems := doc.([]bson.DocElem)
+		return elems[0].Value.(time.Time), elems[1].Value.(time.Time)
+	}
+
+	// clocks went forward at 2am on 11 March 2018, so the day was only 23 hours long
+	day := FHIRDateTime{Time: time.Date(2018, time.March, 11, 0, 0, 0, 0, newYork), Precision: Date}
+	from, to := window(day)
+	c.Assert(from.Equal(time.Date(2018, time.March, 11, 5, 0, 0, 0, time.UTC)), check.Equals, true)
+	c.Assert(to.Equal(time.Date(2018, time.March, 12, 4, 0, 0, 0, time.UTC)), check.Equals, true)
+	c.Assert(to.Sub(from), check.Equals, 23*time.Hour)
+
+	month := FHIRDateTime{Time: time.Date(2018, time.March, 1, 0, 0, 0, 0, newYork), Precision: YearMonth}
+	from, to = window(month)
+	c.Assert(from.Equal(time.Date(2018, time.March, 1, 5, 0, 0, 0, time.UTC)), check.Equals, true)
+	c.Assert(to.Equal(time.Date(2018, time.April, 1, 4, 0, 0, 0, time.UTC)), check.Equals, true)
+
+	// a timestamp just after the clocks went forward is still a one second window
+	timestamp := FHIRDateTime{Time: time.Date(2018, time.March, 11, 3, 0, 0, 0, newYork), Precision: Timestamp}
+	from, to = window(timestamp)
+	c.Assert(from.Equal(time.Date(2018, time.March, 11, 7, 0, 0, 0, time.UTC)), check.Equals, true)
+	c.Assert(to.Sub(from), check.Equals, time.Second)
+	c.Assert(day.Overlaps(timestamp), check.Equals, true)
+
+	// and the last second of the day is within its window but the first second of the next isn't
+	lastSecond := FHIRDateTime{Time: time.Date(2018, time.March, 11, 23, 59, 59, 0, newYork), Precision: Timestamp}
+	nextDay := FHIRDateTime{Time: time.Date(2018, time.March, 12, 0, 0, 0, 0, newYork), Precision: Timestamp}
+	c.Assert(day.Overlaps(lastSecond), check.Equals, true)
+	c.Assert(day.Overlaps(nextDay), check.Equals, false)
+	c.Assert(day.Before(nextDay), check.Equals, true)
+}
+
+func (s *FDSuite) TestFHIRDateTimeClock(c *check.C) {
+	fixed := time.Date(2018, time.March, 11, 15, 4, 5, 250000000, time.UTC)
+	SetClock(func() time.Time { return fixed })
+	defer SetClock(nil)
+
+	window := func(f *FHIRDateTime) (from, to time.Time) {
+		doc, err := f.GetBSON()
+		util.CheckErr(err)
+		elems := doc.([]bson.DocElem)
+		return elems[0].Value.(time.Time), elems[1].Value.(time.Time)
+	}
+
+	from, to := window(Now(Date))
+	c.Assert(from.Equal(time.Date(2018, time.March, 11, 0, 0, 0, 0, time.UTC)), check.Equals, true)
+	c.Assert(to.Equal(time.Date(2018, time.March, 12, 0, 0, 0, 0, time.UTC)), check.Equals, true)
+
+	from, to = window(Now(Year))
+	c.Assert(from.Equal(time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)), check.Equals, true)
+	c.Assert(to.Equal(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)), check.Equals, true)
+
+	from, to = window(Now(Timestamp))
+	c.Assert(from.Equal(time.Date(2018, time.March, 11, 15, 4, 5, 0, time.UTC)), check.Equals, true)
+	c.Assert(to.Equal(time.Date(2018, time.March, 11, 15, 4, 6, 0, time.UTC)), check.Equals, true)
+
+	// without a precision, one is inferred from the time
+	inferred := Now("")
+	from, to = window(inferred)
+	c.Assert(from.Equal(time.Date(2018, time.March, 11, 15, 4, 5, 0, time.UTC)), check.Equals, true)
+	c.Assert(to.Equal(time.Date(2018, time.March, 11, 15, 4, 6, 0, time.UTC)), check.Equals, true)
+	data, err := inferred.MarshalJSON()
+	util.CheckErr(err)
+	c.Assert(string(data), check.Equals, `"2018-03-11T15:04:05.25Z"`)
+	c.Assert(inferred.Overlaps(*Now(Date)), check.Equals, true)
+
+	wholeSecond := FHIRDateTime{Time: time.Date(2018, time.March, 11, 15, 4, 5, 0, time.UTC)}
+	data, err = wholeSecond.MarshalJSON()
+	util.CheckErr(err)
+	c.Assert(string(data), check.Equals, `"2018-03-11T15:04:05Z"`)
+
+	// but a zero time is still an error
+	_, err = FHIRDateTime{}.MarshalJSON()
+	c.Assert(err, check.NotNil)
+}
+
+func (s *FDSuite) TestNewFHIRDateTime(c *check.C) {
+	tests := []struct {
+		str       string
+		expected  time.Time
+		precision Precision
+	}{
+		{"2012", time.Date(2012, time.January, 1, 0, 0, 0, 0, time.Local), Year},
+		{"2012-03", time.Date(2012, time.March, 1, 0, 0, 0, 0, time.Local), YearMonth},
+		{"2012-03-01", time.Date(2012, time.March, 1, 0, 0, 0, 0, time.Local), Date},
+		{"2012-03-01T12:00:00+05:30", time.Date(2012, time.March, 1, 12, 0, 0, 0, time.FixedZone("", 5*60*60+30*60)), Timestamp},
+		{"2012-03-01T12:00:00.123Z", time.Date(2012, time.March, 1, 12, 0, 0, 123000000, time.UTC), Instant},
+		{"2012-03-01T12:00:00.5-04:00", time.Date(2012, time.March, 1, 12, 0, 0, 500000000, time.FixedZone("", -4*60*60)), Instant},
+	}
+	for _, test := range tests {
+		f, err := NewFHIRDateTime(test.str)
+		util.CheckErr(err)
+		c.Assert(f.Time.Equal(test.expected), check.Equals, true, check.Commentf(test.str))
+		c.Assert(f.Precision, check.Equals, test.precision)
+		_, offset := f.Time.Zone()
+		_, expectedOffset := test.expected.Zone()
+		c.Assert(offset, check.Equals, expectedOffset)
+
+		// the same as unmarshalling from JSON, and marshals back to the original string
+		var fromJSON FHIRDateTime
+		util.CheckErr(json.Unmarshal([]byte(`"`+test.str+`"`), &fromJSON))
+		c.Assert(&fromJSON, check.DeepEquals, f)
+		data, err := json.Marshal(f)
+		util.CheckErr(err)
+		c.Assert(string(data), check.Equals, `"`+test.str+`"`)
+
+		// and from BSON, keeping the fraction of an instant
+		data, err = bson.Marshal(bson.M{"date": f})
+		util.CheckErr(err)
+		var fromBSON struct{ Date FHIRDateTime }
+		util.CheckErr(bson.Unmarshal(data, &fromBSON))
+		c.Assert(fromBSON.Date.Precision, check.Equals, test.precision)
+		data, err = json.Marshal(fromBSON.Date)
+		util.CheckErr(err)
+		c.Assert(string(data), check.Equals, `"`+test.str+`"`)
+	}
+
+	for _, invalid := range []string{"2012-13", "2012-03-01T12:00", "March 2012", ""} {
+		_, err := NewFHIRDateTime(invalid)
+		c.Assert(err, check.ErrorMatches, `unable to parse DateTime: ".*"`, check.Commentf(invalid))
+	}
+}
+
+func (s *FDSuite) TestFHIRDateTimeTruncate(c *check.C) {
+	loc := time.FixedZone("+10:00", 10*60*60)
+	ts := FHIRDateTime{Time: time.Date(2018, time.March, 14, 23, 45, 12, 500, loc), Precision: Instant}
+
+	day := ts.Truncate(Date)
+	c.Assert(day, check.DeepEquals, FHIRDateTime{Time: time.Date(2018, time.March, 14, 0, 0, 0, 0, loc), Precision: Date})
+	month := ts.Truncate(YearMonth)
+	c.Assert(month, check.DeepEquals, FHIRDateTime{Time: time.Date(2018, time.March, 1, 0, 0, 0, 0, loc), Precision: YearMonth})
+	c.Assert(ts.Truncate(Timestamp).Time, check.DeepEquals, time.Date(2018, time.March, 14, 23, 45, 12, 0, loc))
+	c.Assert(ts.Time.Nanosecond(), check.Equals, 500) // unchanged
+
+	// stored with the window of the whole day or month
+	for _, test := range []struct {
+		value    FHIRDateTime
+		from, to time.Time
+		str      string
+	}{
+		{day, time.Date(2018, time.March, 14, 0, 0, 0, 0, loc), time.Date(2018, time.March, 15, 0, 0, 0, 0, loc), "2018-03-14"},
+		{month, time.Date(2018, time.March, 1, 0, 0, 0, 0, loc), time.Date(2018, time.April, 1, 0, 0, 0, 0, loc), "2018-03"},
+	} {
+		data, err := bson.Marshal(bson.M{"date": test.value})
+		util.CheckErr(err)
+		var m struct {
+			Date struct {
+				From time.Time `bson:"__from"`
+				To   time.Time `bson:"__to"`
+				Str  string    `bson:"__strDate"`
+			}
+		}
+		util.CheckErr(bson.Unmarshal(data, &m))
+		c.Assert(m.Date.From.Equal(test.from), check.Equals, true, check.Commentf("%s from %s", test.str, m.Date.From))
+		c.Assert(m.Date.To.Equal(test.to), check.Equals, true, check.Commentf("%s to %s", test.str, m.Date.To))
+		c.Assert(m.Date.Str, check.Equals, test.str)
+	}
+
+	// not made any finer
+	c.Assert(month.Truncate(Date), check.DeepEquals, month)
+	c.Assert(month.Truncate(Year).Precision, check.Equals, Precision(Year))
+}
+
+func (s *FDSuite) TestTimeOfDayGetBSON(c *check.C) {
+	f, err := NewFHIRDateTime("14:30:15")
+	util.CheckErr(err)
+	c.Assert(f.Precision, check.Equals, Precision(Time))
+
+	// a time of day isn't a range of dates, so has no __from and __to
+	doc, err := f.GetBSON()
+	util.CheckErr(err)
+	c.Assert(doc, check.DeepEquals, []bson.DocElem{{Name: "__strDate", Value: "14:30:15"}})
+	_, _, err = f.window()
+	c.Assert(err, check.NotNil)
+
+	data, err := bson.Marshal(bson.M{"time": f})
+	util.CheckErr(err)
+	var stored struct{ Time bson.M }
+	util.CheckErr(bson.Unmarshal(data, &stored))
+	c.Assert(stored.Time, check.DeepEquals, bson.M{"__strDate": "14:30:15"})
+
+	var read struct{ Time FHIRDateTime }
+	util.CheckErr(bson.Unmarshal(data, &read))
+	c.Assert(read.Time.Precision, check.Equals, Precision(Time))
+	jsonData, err := json.Marshal(read.Time)
+	util.CheckErr(err)
+	c.Assert(string(jsonData), check.Equals, `"14:30:15"`)
+}
+
+func (s *FDSuite) TestPlainInstantDates(c *check.C) {
+	SetPlainInstantDates(true)
+	defer SetPlainInstantDates(false)
+
+	instant := FHIRDateTime{Time: time.Date(2018, time.March, 14, 23, 45, 12, 250000000, time.UTC), Precision: Instant}
+	data, err := bson.Marshal(bson.M{"recorded": instant})
+	util.CheckErr(err)
+
+	// stored as a plain date rather than __from, __to and __strDate
+	var raw bson.M
+	util.CheckErr(bson.Unmarshal(data, &raw))
+	stored, isTime := raw["recorded"].(time.Time)
+	c.Assert(isTime, check.Equals, true, check.Commentf("stored as %T", raw["recorded"]))
+	c.Assert(stored.Equal(instant.Time), check.Equals, true)
+
+	var read struct {
+		Recorded FHIRDateTime
+	}
+	util.CheckErr(bson.Unmarshal(data, &read))
+	c.Assert(read.Recorded.Precision, check.Equals, Precision(Instant))
+	c.Assert(read.Recorded.Time.Equal(instant.Time), check.Equals, true)
+
+	// other precisions keep the window used for range searches
+	data, err = bson.Marshal(bson.M{"recorded": FHIRDateTime{Time: instant.Time, Precision: Timestamp}})
+	util.CheckErr(err)
+	util.CheckErr(bson.Unmarshal(data, &raw))
+	_, isTime = raw["recorded"].(time.Time)
+	c.Assert(isTime, check.Equals, false)
+	util.CheckErr(bson.Unmarshal(data, &read))
+	c.Assert(read.Recorded.Precision, check.Equals, Precision(Timestamp))
+
+	// without the mode plain dates are still read, as timestamps
+	SetPlainInstantDates(false)
+	data, err = bson.Marshal(bson.M{"recorded": instant.Time})
+	util.CheckErr(err)
+	util.CheckErr(bson.Unmarshal(data, &read))
+	c.Assert(read.Recorded.Precision, check.Equals, Precision(Timestamp))
+	c.Assert(read.Recorded.Time.Equal(instant.Time), check.Equals, true)
+}
+
+func (s *FDSuite) TestPeriodWindow(c *check.C) {
+	stored := func(p Period) bson.M {
+		data, err := bson.Marshal(bson.M{"period": p})
+		util.CheckErr(err)
+		var m struct{ Period bson.M }
+		util.CheckErr(bson.Unmarshal(data, &m))
+		return m.Period
+	}
+	date := func(str string) *FHIRDateTime {
+		d, err := NewFHIRDateTime(str)
+		util.CheckErr(err)
+		return d
+	}
+
+	// since 2019: from the start of the year, with no end
+	since := stored(Period{Start: date("2019")})
+	c.Assert(since["__from"].(time.Time).Equal(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.Local)), check.Equals, true)
+	c.Assert(since["__to"].(time.Time).Equal(openPeriodEnd), check.Equals, true)
+	c.Assert(since["start"].(bson.M)["__strDate"], check.Equals, "2019")
+	c.Assert(since["end"], check.IsNil)
+
+	// until a timestamp, with no start
+	until := stored(Period{End: date("2019-03-01T10:30:00Z")})
+	c.Assert(until["__from"].(time.Time).Equal(openPeriodStart), check.Equals, true)
+	c.Assert(until["__to"].(time.Time).Equal(time.Date(2019, time.March, 1, 10, 30, 1, 0, time.UTC)), check.Equals, true)
+
+	// bounded: from the start of the start's window to the end of the end's
+	bounded := stored(Period{Start: date("2019-03"), End: date("2019-06-15")})
+	c.Assert(bounded["__from"].(time.Time).Equal(time.Date(2019, time.March, 1, 0, 0, 0, 0, time.Local)), check.Equals, true)
+	c.Assert(bounded["__to"].(time.Time).Equal(time.Date(2019, time.June, 16, 0, 0, 0, 0, time.Local)), check.Equals, true)
+
+	// an empty period has no window
+	c.Assert(stored(Period{}), check.DeepEquals, bson.M{})
+
+	// and the window is left out when read back
+	data, err := bson.Marshal(bson.M{"period": Period{Start: date("2019")}})
+	util.CheckErr(err)
+	var read struct{ Period Period }
+	util.CheckErr(bson.Unmarshal(data, &read))
+	c.Assert(read.Period, check.DeepEquals, Period{Start: date("2019")})
+
+	_, err = bson.Marshal(bson.M{"period": Period{Start: date("10:30:00")}})
+	c.Assert(err, check.ErrorMatches, "Period.GetBSON: invalid start: .*")
+}
+
+func (s *FDSuite) TestFHIRDateTimeInLocation(c *check.C) {
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		c.Skip("time zone database not available: " + err.Error())
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		c.Skip("time zone database not available: " + err.Error())
+	}
+
+	f, err := NewFHIRDateTime("2019-07-01T02:30:00.123Z")
+	util.CheckErr(err)
+	original := *f
+
+	inSydney := f.InLocation(sydney)
+	c.Assert(inSydney.Location(), check.Equals, sydney)
+	c.Assert(inSydney.Format("2006-01-02T15:04:05.000-07:00"), check.Equals, "2019-07-01T12:30:00.123+10:00")
+	c.Assert(inSydney.Equal(f.Time), check.Equals, true)
+
+	// the day before in New York, during daylight saving
+	inNewYork := f.InLocation(newYork)
+	c.Assert(inNewYork.Format("2006-01-02T15:04:05.000-07:00"), check.Equals, "2019-06-30T22:30:00.123-04:00")
+	c.Assert(inNewYork.Equal(f.Time), check.Equals, true)
+
+	// the stored value is unchanged
+	c.Assert(*f, check.DeepEquals, original)
+	c.Assert(f.Time.Location(), check.Equals, time.UTC)
+}
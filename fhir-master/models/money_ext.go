@@ -0,0 +1,42 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+const iso4217System = "urn:iso:std:iso:4217"
+
+// Active ISO 4217 currency codes
+var iso4217Currencies = makeStringSet(`
+	AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BOV BRL BSD BTN BWP BYN BZD
+	CAD CDF CHE CHF CHW CLF CLP CNY COP COU CRC CUC CUP CVE CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP
+	GEL GHS GIP GMD GNF GTQ GYD HKD HNL HRK HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW
+	KRW KWD KYD KZT LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MXV MYR MZN NAD
+	NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE
+	SLL SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX USD USN UYI UYU UYW UZS VED
+	VES VND VUV WST XAF XAG XAU XBA XBB XBC XBD XCD XDR XOF XPD XPF XPT XSU XTS XUA XXX YER ZAR ZMW ZWL`)
+
+type money Money
+
+// GetBSON checks the currency code against ISO 4217 when strict validation is enabled.
+// Money is a Quantity with the currency as its code, so the amount goes through the usual decimal envelope.
+func (m Money) GetBSON() (interface{}, error) {
+	if strictValueValidation && (m.System == "" || m.System == iso4217System) {
+		if m.Code == "" {
+			return nil, fmt.Errorf("Money is missing a currency code")
+		}
+		if !iso4217Currencies[m.Code] {
+			return nil, fmt.Errorf("Money has an unknown currency code: %s", m.Code)
+		}
+	}
+	return money(m), nil
+}
+
+func makeStringSet(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"github.com/pebbe/util"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type MoneySuite struct {
+}
+
+var _ = check.Suite(&MoneySuite{})
+
+func (s *MoneySuite) TestMoneyCurrencyValidation(c *check.C) {
+	value, err := NewDecimal("10")
+	util.CheckErr(err)
+	ext := &Extension{
+		Url:        "http://example.org/fhir/extensions/foo",
+		ValueMoney: &Money{Quantity{Value: value, System: "urn:iso:std:iso:4217", Code: "XYZ"}},
+	}
+
+	// only checked when validation is on
+	_, err = bson.Marshal(ext)
+	c.Assert(err, check.IsNil)
+
+	SetStrictValueValidation(true)
+	defer SetStrictValueValidation(false)
+
+	_, err = bson.Marshal(ext)
+	c.Assert(err, check.ErrorMatches, "Money has an unknown currency code: XYZ")
+
+	ext.ValueMoney.Code = "USD"
+	_, err = bson.Marshal(ext)
+	c.Assert(err, check.IsNil)
+}
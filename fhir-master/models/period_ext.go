@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Stand-ins for the missing side of an open-ended period in __from and __to, as MongoDB
+// only compares dates with dates
+var (
+	openPeriodStart = time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC)
+	openPeriodEnd   = time.Date(10000, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+type period Period
+
+type storedPeriod struct {
+	period `bson:",inline"`
+	From   *time.Time `bson:"__from,omitempty"`
+	To     *time.Time `bson:"__to,omitempty"`
+}
+
+// GetBSON adds the window of time covered by the whole period as __from and __to, from the start
+// of the start's window (e.g. all of 2019 for "2019") to the end of the end's. A missing start or
+// end leaves that side open, so "since 2019" runs from 2019-01-01 to openPeriodEnd.
+func (p Period) GetBSON() (interface{}, error) {
+	if p.Start == nil && p.End == nil {
+		return period(p), nil
+	}
+	stored := storedPeriod{period: period(p), From: &openPeriodStart, To: &openPeriodEnd}
+	if p.Start != nil {
+		from, _, err := p.Start.window()
+		if err != nil {
+			return nil, errors.Wrap(err, "Period.GetBSON: invalid start")
+		}
+		stored.From = &from
+	}
+	if p.End != nil {
+		_, to, err := p.End.window()
+		if err != nil {
+			return nil, errors.Wrap(err, "Period.GetBSON: invalid end")
+		}
+		stored.To = &to
+	}
+	return stored, nil
+}
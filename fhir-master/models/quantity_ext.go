@@ -0,0 +1,356 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/eug48/fhir/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const ucumSystem = "http://unitsofmeasure.org"
+
+// Whether quantities in UCUM units are also stored converted to a base unit
+var canonicalUnits = false
+
+// SetCanonicalUnits turns on (or off) storing __canonValue and __canonUnit with quantities
+// in UCUM units that can be converted to a base unit, e.g. 250 mg is also stored as 0.25 g,
+// so that range queries can compare quantities recorded in different units
+func SetCanonicalUnits(enabled bool) {
+	canonicalUnits = enabled
+}
+
+// Whether quantities' units are checked against ucumUnits when stored
+var ucumUnitValidation = false
+
+// SetUCUMUnitValidation turns on (or off) rejecting quantities whose UCUM unit (the code, or the unit
+// if there's no code or system) isn't one of the commonly used units in ucumUnits, to catch typos
+// such as "mgg". Quantities in other systems aren't checked.
+func SetUCUMUnitValidation(enabled bool) {
+	ucumUnitValidation = enabled
+}
+
+type ucumConversion struct {
+	factor string // exact, to avoid widening the decimal band with rounding errors
+	unit   string
+}
+
+// ucumTablesLock guards ucumConversions and ucumUnits, which AddUnitConversion can add to
+// while quantities are being stored by other goroutines
+var ucumTablesLock sync.RWMutex
+
+// UCUM codes that can be converted, with the factor to multiply by to get the base unit
+var ucumConversions = map[string]ucumConversion{
+	"kg": {"1000", "g"},
+	"g":  {"1", "g"},
+	"mg": {"0.001", "g"},
+	"ug": {"0.000001", "g"},
+	"ng": {"0.000000001", "g"},
+
+	"km": {"1000", "m"},
+	"m":  {"1", "m"},
+	"cm": {"0.01", "m"},
+	"mm": {"0.001", "m"},
+	"um": {"0.000001", "m"},
+
+	"wk":  {"604800", "s"},
+	"d":   {"86400", "s"},
+	"h":   {"3600", "s"},
+	"min": {"60", "s"},
+	"s":   {"1", "s"},
+	"ms":  {"0.001", "s"},
+
+	"/s":   {"60", "/min"},
+	"/min": {"1", "/min"},
+
+	"L":  {"1", "L"},
+	"dL": {"0.1", "L"},
+	"mL": {"0.001", "L"},
+	"uL": {"0.000001", "L"},
+}
+
+// UCUM codes accepted when SetUCUMUnitValidation is enabled: the units that can be converted and
+// those of the Quantity specialisations plus ones commonly used in observations
+var ucumUnits = makeStringSet(`% 1 10*3/uL 10*6/uL 10*9/L 10*12/L /min /h /d {beats}/min {breaths}/min {score}
+	mol mmol umol nmol mol/L mmol/L umol/L nmol/L g/L g/dL mg/dL mg/L ug/L ng/mL pg/mL fL pg
+	U U/L [IU] [IU]/L mU/L meq/L mosm/kg mg/kg mg/d L/min mL/min mL/h m2 kg/m2
+	mm[Hg] cm[H2O] kPa Cel [degF] K [lb_av] [oz_av]`)
+
+func init() {
+	for _, units := range []map[string]bool{ucumTimeUnits, ucumLengthUnits} {
+		for unit := range units {
+			ucumUnits[unit] = true
+		}
+	}
+	for unit := range ucumConversions {
+		ucumUnits[unit] = true
+	}
+}
+
+type quantity Quantity
+
+type quantityWithCanonicalUnits struct {
+	quantity   `bson:",inline"`
+	CanonValue *Decimal `bson:"__canonValue,omitempty"`
+	CanonUnit  string   `bson:"__canonUnit,omitempty"`
+}
+
+// GetBSON opens up the value's __from/__to range on the side a comparator leaves unbounded and
+// adds the value in the base unit when SetCanonicalUnits is enabled; the original value and unit
+// are kept for display
+func (q Quantity) GetBSON() (interface{}, error) {
+	if err := q.checkUCUMUnit(); err != nil {
+		return nil, err
+	}
+	q.Value = withComparatorBounds(q.Value, q.Comparator)
+	if !canonicalUnits {
+		return quantity(q), nil
+	}
+	canonValue, canonUnit := q.canonical()
+	if canonValue == nil {
+		return quantity(q), nil
+	}
+	canonValue = withComparatorBounds(canonValue, q.Comparator)
+	return quantityWithCanonicalUnits{quantity(q), canonValue, canonUnit}, nil
+}
+
+// checkUCUMUnit checks the unit is a known UCUM unit when SetUCUMUnitValidation is enabled
+func (q *Quantity) checkUCUMUnit() error {
+	if !ucumUnitValidation || (q.System != "" && q.System != ucumSystem) {
+		return nil
+	}
+	unit := q.Code
+	if unit == "" && q.System == "" {
+		unit = q.Unit
+	}
+	if unit != "" && !isUCUMUnit(unit) {
+		return fmt.Errorf("Quantity has an unknown UCUM unit: %q", unit)
+	}
+	return nil
+}
+
+func isUCUMUnit(unit string) bool {
+	ucumTablesLock.RLock()
+	defer ucumTablesLock.RUnlock()
+	return ucumUnits[unit] || ucumUnits[stripUCUMAnnotations(unit)]
+}
+
+// lookupUnitConversion finds the conversion of a UCUM code (ignoring annotations) to its base unit
+func lookupUnitConversion(code string) (ucumConversion, bool) {
+	ucumTablesLock.RLock()
+	defer ucumTablesLock.RUnlock()
+	conversion, found := ucumConversions[stripUCUMAnnotations(code)]
+	return conversion, found
+}
+
+// stripUCUMAnnotations removes the annotations in curly braces from a UCUM code, which don't change
+// its meaning, e.g. "{beats}/min" is "/min". An annotation on its own is the unity "1", so "mL/{h}" is "mL".
+func stripUCUMAnnotations(code string) string {
+	if !strings.Contains(code, "{") {
+		return code
+	}
+	var stripped strings.Builder
+	for {
+		start := strings.Index(code, "{")
+		if start < 0 {
+			break
+		}
+		length := strings.Index(code[start:], "}")
+		if length < 0 {
+			// unterminated, so not an annotation
+			break
+		}
+		stripped.WriteString(code[:start])
+		code = code[start+length+1:]
+	}
+	stripped.WriteString(code)
+
+	result := strings.TrimRight(stripped.String(), "./")
+	result = strings.TrimPrefix(result, ".")
+	if result == "" {
+		return "1"
+	}
+	return result
+}
+
+// SetBSON restores the usual __from/__to range of values stored with a comparator
+func (q *Quantity) SetBSON(raw bson.Raw) error {
+	var stored quantity
+	if err := raw.Unmarshal(&stored); err != nil {
+		return err
+	}
+	if stored.Comparator != "" && stored.Value != nil && stored.Value.Str != "" {
+		if value, err := NewDecimal(stored.Value.Str); err == nil {
+			stored.Value = value
+		}
+	}
+	*q = Quantity(stored)
+	return nil
+}
+
+// Stored for the open end of a range instead of an infinity, which Decimal.GetBSON rejects
+const openBound = math.MaxFloat64
+
+// withComparatorBounds returns d with the range a comparator implies, e.g. <=5 is everything up to
+// and including 5 (__from -openBound, __to 5) rather than 4.5 to 5.5, or d itself if there's no comparator.
+// The bounds are the nearest values included, as searches compare them inclusively, so a strict comparator
+// leaves out d itself: <5 runs up to the largest float64 below 5.
+func withComparatorBounds(d *Decimal, comparator string) *Decimal {
+	if d == nil {
+		return nil
+	}
+	bounded := *d
+	switch comparator {
+	case "<":
+		bounded.From, bounded.To = -openBound, math.Nextafter(d.Num, math.Inf(-1))
+	case "<=":
+		bounded.From, bounded.To = -openBound, d.Num
+	case ">":
+		bounded.From, bounded.To = math.Nextafter(d.Num, math.Inf(1)), openBound
+	case ">=":
+		bounded.From, bounded.To = d.Num, openBound
+	default:
+		return d
+	}
+	return &bounded
+}
+
+// AddUnitConversion adds a unit to the table used by Quantity.Convert and for canonical units: a
+// quantity in unit is multiplied by factor (a decimal string, e.g. "0.001") to give it in baseUnit,
+// which must already be in the table (as its own base unit) unless a new family is being started.
+// Both units are then accepted by SetUCUMUnitValidation too.
+func AddUnitConversion(unit string, factor string, baseUnit string) error {
+	if f, ok := new(big.Rat).SetString(factor); !ok || f.Sign() <= 0 {
+		return fmt.Errorf("invalid factor %q for unit %q", factor, unit)
+	}
+	ucumTablesLock.Lock()
+	defer ucumTablesLock.Unlock()
+	if base, found := ucumConversions[baseUnit]; found && base.unit != baseUnit {
+		return fmt.Errorf("%q is not a base unit", baseUnit)
+	}
+	ucumConversions[unit] = ucumConversion{factor, baseUnit}
+	if _, found := ucumConversions[baseUnit]; !found {
+		ucumConversions[baseUnit] = ucumConversion{"1", baseUnit}
+	}
+	ucumUnits[unit] = true
+	ucumUnits[baseUnit] = true
+	return nil
+}
+
+// Convert returns the quantity in another unit of the same kind (e.g. mass) from the conversion
+// table, keeping the same number of significant figures (e.g. 1.5 g is 1500 mg, and 250 mg is
+// 0.250 g). The value has its own __from/__to band.
+func (q *Quantity) Convert(toUnit string) (*Quantity, error) {
+	if q.Value == nil || q.Value.Str == "" {
+		return nil, errors.New("can't convert a quantity without a value")
+	}
+	if q.System != "" && q.System != ucumSystem {
+		return nil, fmt.Errorf("can't convert units of %s", q.System)
+	}
+	fromUnit := q.Code
+	if fromUnit == "" {
+		fromUnit = q.Unit
+	}
+	from, found := lookupUnitConversion(fromUnit)
+	if !found {
+		return nil, fmt.Errorf("can't convert from unknown unit %q", fromUnit)
+	}
+	to, found := lookupUnitConversion(toUnit)
+	if !found {
+		return nil, fmt.Errorf("can't convert to unknown unit %q", toUnit)
+	}
+	if from.unit != to.unit {
+		return nil, fmt.Errorf("can't convert %s to %s: they are different kinds of quantity", fromUnit, toUnit)
+	}
+
+	number := utils.ParseNumber(q.Value.Str)
+	if number.Value == nil {
+		return nil, fmt.Errorf("can't convert invalid value %q", q.Value.Str)
+	}
+	fromFactor, _ := new(big.Rat).SetString(from.factor)
+	toFactor, _ := new(big.Rat).SetString(to.factor)
+	ratio := new(big.Rat).Quo(fromFactor, toFactor)
+
+	places := number.Precision - orderOfMagnitude(ratio)
+	if places < 0 {
+		places = 0
+	}
+	value, err := NewDecimal(new(big.Rat).Mul(number.Value, ratio).FloatString(places))
+	if err != nil {
+		return nil, err
+	}
+	return &Quantity{Value: value, Comparator: q.Comparator, Unit: toUnit, System: ucumSystem, Code: toUnit}, nil
+}
+
+// orderOfMagnitude returns floor(log10(r)) for positive r, e.g. 3 for 1000 and -2 for 1/60
+func orderOfMagnitude(r *big.Rat) int {
+	ten := big.NewRat(10, 1)
+	one := big.NewRat(1, 1)
+	r = new(big.Rat).Set(r)
+	magnitude := 0
+	for r.Cmp(ten) >= 0 {
+		r.Quo(r, ten)
+		magnitude++
+	}
+	for r.Cmp(one) < 0 {
+		r.Mul(r, ten)
+		magnitude--
+	}
+	return magnitude
+}
+
+// canonical converts the quantity to its base unit, returning nil if it isn't in a known UCUM unit
+func (q *Quantity) canonical() (*Decimal, string) {
+	if q.Value == nil || q.Value.Str == "" {
+		return nil, ""
+	}
+	code := q.Code
+	if code == "" && q.System == "" {
+		code = q.Unit
+	}
+	if q.System != "" && q.System != ucumSystem {
+		return nil, ""
+	}
+	conversion, found := lookupUnitConversion(code)
+	if !found {
+		return nil, ""
+	}
+
+	number := utils.ParseNumber(q.Value.Str)
+	if number.Value == nil {
+		return nil, ""
+	}
+	factor, _ := new(big.Rat).SetString(conversion.factor)
+
+	// keep the same significant figures, e.g. 250 mg is 0.250 g and 1.5 kg is 1500 g
+	places := number.Precision
+	if i := strings.Index(conversion.factor, "."); i >= 0 {
+		places += len(conversion.factor) - i - 1
+	} else {
+		places -= len(conversion.factor) - len(strings.TrimRight(conversion.factor, "0"))
+		if places < 0 {
+			places = 0
+		}
+	}
+
+	value := new(big.Rat).Mul(number.Value, factor)
+	num, _ := value.Float64()
+	from, _ := new(big.Rat).Mul(number.RangeLowIncl(), factor).Float64()
+	to, _ := new(big.Rat).Mul(number.RangeHighExcl(), factor).Float64()
+	canonValue := &Decimal{
+		From: from,
+		To:   to,
+		Num:  num,
+		Str:  value.FloatString(places),
+		Sig:  places,
+	}
+	if canonValue.checkFinite() != nil {
+		// too large for a float once converted; the original value is still stored
+		return nil, ""
+	}
+	return canonValue, conversion.unit
+}
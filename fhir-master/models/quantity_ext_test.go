@@ -0,0 +1,279 @@
+package models
+
+import (
+	"math"
+
+	"github.com/pebbe/util"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type QuantitySuite struct {
+}
+
+var _ = check.Suite(&QuantitySuite{})
+
+func (s *QuantitySuite) TestQuantitySpecialisationValidation(c *check.C) {
+	fraction, err := NewDecimal("2.5")
+	util.CheckErr(err)
+	_, err = bson.Marshal(&Extension{Url: "http://example.org/fhir/extensions/foo", ValueCount: &Count{Quantity{Value: fraction}}})
+	c.Assert(err, check.ErrorMatches, "Count must be an integer, not 2.5")
+
+	forty, err := NewDecimal("40")
+	util.CheckErr(err)
+	weight := &Extension{Url: "http://example.org/fhir/extensions/foo", ValueAge: &Age{Quantity{Value: forty, System: "http://unitsofmeasure.org", Code: "kg"}}}
+	_, err = bson.Marshal(weight)
+	c.Assert(err, check.IsNil)
+
+	SetStrictValueValidation(true)
+	defer SetStrictValueValidation(false)
+	_, err = bson.Marshal(weight)
+	c.Assert(err, check.ErrorMatches, `Age has an invalid unit: "kg"`)
+}
+
+func (s *QuantitySuite) TestQuantityCanonicalUnits(c *check.C) {
+	quantity := func(value string, code string) *Quantity {
+		d, err := NewDecimal(value)
+		util.CheckErr(err)
+		return &Quantity{Value: d, Unit: code, System: "http://unitsofmeasure.org", Code: code}
+	}
+	stored := func(q *Quantity) bson.M {
+		data, err := bson.Marshal(&Extension{Url: "http://example.org/fhir/extensions/foo", ValueQuantity: q})
+		util.CheckErr(err)
+		var m bson.M
+		err = bson.Unmarshal(data, &m)
+		util.CheckErr(err)
+		return m["foo"].(bson.M)
+	}
+
+	// off by default
+	m := stored(quantity("250", "mg"))
+	_, found := m["__canonValue"]
+	c.Assert(found, check.Equals, false)
+
+	SetCanonicalUnits(true)
+	defer SetCanonicalUnits(false)
+
+	// mg to g, keeping the original value and unit
+	m = stored(quantity("250", "mg"))
+	c.Assert(m["value"].(bson.M)["__strNum"], check.Equals, "250")
+	c.Assert(m["unit"], check.Equals, "mg")
+	c.Assert(m["__canonUnit"], check.Equals, "g")
+	canon := m["__canonValue"].(bson.M)
+	c.Assert(canon["__strNum"], check.Equals, "0.250")
+	c.Assert(canon["__num"], check.Equals, 0.25)
+	c.Assert(canon["__from"], check.Equals, 0.2495)
+	c.Assert(canon["__to"], check.Equals, 0.2505)
+	c.Assert(canon["__sig"], check.Equals, 3)
+
+	// g is already the base unit
+	m = stored(quantity("0.25", "g"))
+	c.Assert(m["__canonUnit"], check.Equals, "g")
+	canon = m["__canonValue"].(bson.M)
+	c.Assert(canon["__strNum"], check.Equals, "0.25")
+	c.Assert(canon["__from"], check.Equals, 0.245)
+	c.Assert(canon["__to"], check.Equals, 0.255)
+
+	// and kg to g
+	m = stored(quantity("1.5", "kg"))
+	canon = m["__canonValue"].(bson.M)
+	c.Assert(m["__canonUnit"], check.Equals, "g")
+	c.Assert(canon["__strNum"], check.Equals, "1500")
+	c.Assert(canon["__from"], check.Equals, float64(1450))
+	c.Assert(canon["__to"], check.Equals, float64(1550))
+
+	// unknown units and other systems aren't converted
+	m = stored(quantity("2", "[drp]"))
+	_, found = m["__canonValue"]
+	c.Assert(found, check.Equals, false)
+	q := quantity("2", "mg")
+	q.System = "http://snomed.info/sct"
+	m = stored(q)
+	_, found = m["__canonValue"]
+	c.Assert(found, check.Equals, false)
+
+	// the canonical fields are ignored when unmarshalling
+	original := quantity("250", "mg")
+	data, err := bson.Marshal(&Extension{Url: "http://example.org/fhir/extensions/foo", ValueQuantity: original})
+	util.CheckErr(err)
+	var ext Extension
+	err = bson.Unmarshal(data, &ext)
+	util.CheckErr(err)
+	c.Assert(ext.ValueQuantity, check.DeepEquals, original)
+}
+
+func (s *QuantitySuite) TestUCUMUnitValidation(c *check.C) {
+	value, err := NewDecimal("5")
+	util.CheckErr(err)
+	typo := Quantity{Value: value, Unit: "mgg"}
+
+	// off by default
+	_, err = bson.Marshal(typo)
+	util.CheckErr(err)
+
+	SetUCUMUnitValidation(true)
+	defer SetUCUMUnitValidation(false)
+
+	for _, valid := range []Quantity{
+		{Value: value, Unit: "mg"},
+		{Value: value, Unit: "mmHg", System: ucumSystem, Code: "mm[Hg]"},
+		{Value: value, Unit: "beats/minute", System: ucumSystem, Code: "/min"},
+		{Value: value, Unit: "tablets", System: "http://snomed.info/sct", Code: "385055001"},
+		{Value: value},
+	} {
+		_, err = bson.Marshal(valid)
+		c.Assert(err, check.IsNil, check.Commentf("%+v", valid))
+	}
+
+	_, err = bson.Marshal(typo)
+	c.Assert(err, check.ErrorMatches, `Quantity has an unknown UCUM unit: "mgg"`)
+	_, err = bson.Marshal(Quantity{Value: value, Unit: "milliliter", System: ucumSystem, Code: "mililiter"})
+	c.Assert(err, check.ErrorMatches, `Quantity has an unknown UCUM unit: "mililiter"`)
+
+	ext := Extension{Url: "http://example.org/fhir/extensions/foo", ValueQuantity: &typo}
+	_, err = bson.Marshal(ext)
+	c.Assert(err, check.ErrorMatches, `.*unknown UCUM unit: "mgg"`)
+	c.Assert(ext.Validate(), check.HasLen, 1)
+}
+
+func (s *QuantitySuite) TestUCUMAnnotations(c *check.C) {
+	for code, stripped := range map[string]string{
+		"{beats}/min":     "/min",
+		"mL/{h}":          "mL",
+		"{tbl}":           "1",
+		"10*3/uL":         "10*3/uL",
+		"{rbc}.10*6/uL":   "10*6/uL",
+		"{unterminated/h": "{unterminated/h",
+	} {
+		c.Assert(stripUCUMAnnotations(code), check.Equals, stripped, check.Commentf(code))
+	}
+
+	value, err := NewDecimal("72")
+	util.CheckErr(err)
+	heartRate := Quantity{Value: value, Unit: "beats/minute", System: ucumSystem, Code: "{beats}/min"}
+
+	SetUCUMUnitValidation(true)
+	defer SetUCUMUnitValidation(false)
+	for _, code := range []string{"{beats}/min", "mL/{h}", "{breaths}/min"} {
+		_, err = bson.Marshal(Quantity{Value: value, System: ucumSystem, Code: code})
+		c.Assert(err, check.IsNil, check.Commentf(code))
+	}
+	_, err = bson.Marshal(Quantity{Value: value, System: ucumSystem, Code: "{beats}/mni"})
+	c.Assert(err, check.ErrorMatches, `Quantity has an unknown UCUM unit: "{beats}/mni"`)
+
+	SetCanonicalUnits(true)
+	defer SetCanonicalUnits(false)
+	data, err := bson.Marshal(heartRate)
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m["code"], check.Equals, "{beats}/min")
+	c.Assert(m["__canonUnit"], check.Equals, "/min")
+	c.Assert(m["__canonValue"].(bson.M)["__strNum"], check.Equals, "72")
+
+	var unmarshalled Quantity
+	util.CheckErr(bson.Unmarshal(data, &unmarshalled))
+	c.Assert(unmarshalled, check.DeepEquals, heartRate)
+}
+
+func (s *QuantitySuite) TestQuantityConvert(c *check.C) {
+	quantity := func(value, unit string) *Quantity {
+		d, err := NewDecimal(value)
+		util.CheckErr(err)
+		return &Quantity{Value: d, Unit: unit}
+	}
+
+	for _, test := range []struct {
+		value, from, to, expected string
+	}{
+		{"1.5", "g", "mg", "1500"},
+		{"250", "mg", "g", "0.250"},
+		{"2.5", "L", "mL", "2500"},
+		{"90", "min", "h", "1.50"},
+		{"1.0", "h", "min", "60"},
+		{"72", "{beats}/min", "/s", "1.20"},
+	} {
+		converted, err := quantity(test.value, test.from).Convert(test.to)
+		util.CheckErr(err)
+		expected, err := NewDecimal(test.expected)
+		util.CheckErr(err)
+		c.Assert(converted, check.DeepEquals, &Quantity{Value: expected, Unit: test.to, System: ucumSystem, Code: test.to},
+			check.Commentf("%s %s to %s", test.value, test.from, test.to))
+	}
+
+	// the band is the converted value's own
+	converted, err := quantity("1.5", "g").Convert("mg")
+	util.CheckErr(err)
+	c.Assert(converted.Value.From, check.Equals, 1499.5)
+	c.Assert(converted.Value.To, check.Equals, 1500.5)
+
+	_, err = quantity("5", "mg").Convert("mL")
+	c.Assert(err, check.ErrorMatches, "can't convert mg to mL: they are different kinds of quantity")
+	_, err = quantity("5", "mgg").Convert("g")
+	c.Assert(err, check.ErrorMatches, `can't convert from unknown unit "mgg"`)
+	_, err = (&Quantity{Unit: "mg"}).Convert("g")
+	c.Assert(err, check.ErrorMatches, "can't convert a quantity without a value")
+
+	// the table can be extended
+	util.CheckErr(AddUnitConversion("[lb_av]", "453.59237", "g"))
+	defer delete(ucumConversions, "[lb_av]")
+	converted, err = quantity("2.0", "[lb_av]").Convert("kg")
+	util.CheckErr(err)
+	c.Assert(converted.Value.Str, check.Equals, "0.91")
+	c.Assert(AddUnitConversion("[lb_av]", "0", "g"), check.ErrorMatches, `invalid factor "0" .*`)
+	c.Assert(AddUnitConversion("[oz_av]", "28", "mg"), check.ErrorMatches, `"mg" is not a base unit`)
+}
+
+func (s *QuantitySuite) TestQuantityComparatorBounds(c *check.C) {
+	envelope := func(q Quantity) bson.M {
+		data, err := bson.Marshal(q)
+		util.CheckErr(err)
+		var m bson.M
+		util.CheckErr(bson.Unmarshal(data, &m))
+		return m["value"].(bson.M)
+	}
+	five, err := NewDecimal("5")
+	util.CheckErr(err)
+
+	// the bounds are inclusive, so the strict comparators leave out 5 itself
+	justBelow, justAbove := math.Nextafter(5, math.Inf(-1)), math.Nextafter(5, math.Inf(1))
+	tests := []struct {
+		comparator string
+		from, to   float64
+	}{
+		{"<", -math.MaxFloat64, justBelow},
+		{"<=", -math.MaxFloat64, 5},
+		{">", justAbove, math.MaxFloat64},
+		{">=", 5, math.MaxFloat64},
+	}
+	for _, test := range tests {
+		comment := check.Commentf(test.comparator)
+		value := envelope(Quantity{Value: five, Comparator: test.comparator, Unit: "mg"})
+		c.Assert(value["__from"], check.Equals, test.from, comment)
+		c.Assert(value["__to"], check.Equals, test.to, comment)
+		c.Assert(value["__num"], check.Equals, int64(5), comment)
+		c.Assert(value["__strNum"], check.Equals, "5", comment)
+	}
+	c.Assert(justBelow < 5 && justAbove > 5, check.Equals, true)
+
+	// without a comparator the range is the precision of the value
+	value := envelope(Quantity{Value: five, Unit: "mg"})
+	c.Assert(value["__from"], check.Equals, 4.5)
+	c.Assert(value["__to"], check.Equals, 5.5)
+
+	// the quantity itself isn't changed
+	q := Quantity{Value: five, Comparator: "<=", Unit: "mg"}
+	envelope(q)
+	c.Assert(q.Value.From, check.Equals, 4.5)
+
+	// and the canonical value is open in the same way
+	SetCanonicalUnits(true)
+	defer SetCanonicalUnits(false)
+	data, err := bson.Marshal(Quantity{Value: five, Comparator: ">", System: ucumSystem, Code: "mg"})
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	canon := m["__canonValue"].(bson.M)
+	c.Assert(canon["__from"], check.Equals, math.Nextafter(0.005, math.Inf(1)))
+	c.Assert(canon["__to"], check.Equals, math.MaxFloat64)
+}
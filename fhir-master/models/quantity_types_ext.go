@@ -0,0 +1,62 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// UCUM codes allowed for the Quantity specialisations when strict validation is enabled
+var ucumTimeUnits = makeStringSet("ns us ms s min h d wk mo a")
+var ucumLengthUnits = makeStringSet("nm um mm cm dm m km [in_i] [ft_i] [yd_i] [mi_i] [nmi_i]")
+
+type age Age
+type count Count
+type distance Distance
+type duration Duration
+
+// GetBSON checks the unit is a UCUM time unit when strict validation is enabled
+func (a Age) GetBSON() (interface{}, error) {
+	if err := a.checkUnit("Age", ucumTimeUnits); err != nil {
+		return nil, err
+	}
+	return age(a), nil
+}
+
+// GetBSON rejects non-integer counts
+func (c Count) GetBSON() (interface{}, error) {
+	if c.Value != nil && (c.Value.Num != math.Trunc(c.Value.Num) || strings.ContainsAny(c.Value.Str, ".eE")) {
+		return nil, fmt.Errorf("Count must be an integer, not %s", c.Value.Str)
+	}
+	return count(c), nil
+}
+
+// GetBSON checks the unit is a UCUM length unit when strict validation is enabled
+func (d Distance) GetBSON() (interface{}, error) {
+	if err := d.checkUnit("Distance", ucumLengthUnits); err != nil {
+		return nil, err
+	}
+	return distance(d), nil
+}
+
+// GetBSON checks the unit is a UCUM time unit when strict validation is enabled
+func (d Duration) GetBSON() (interface{}, error) {
+	if err := d.checkUnit("Duration", ucumTimeUnits); err != nil {
+		return nil, err
+	}
+	return duration(d), nil
+}
+
+func (q *Quantity) checkUnit(fhirType string, allowed map[string]bool) error {
+	if !strictValueValidation || q.Value == nil {
+		return nil
+	}
+	unit := q.Code
+	if unit == "" {
+		unit = q.Unit
+	}
+	if !allowed[unit] {
+		return fmt.Errorf("%s has an invalid unit: %q", fhirType, unit)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"fmt"
+)
+
+type rangeAlias Range
+
+// GetBSON refuses to store a Range whose bounds are in different units
+// as the __from/__to values of its decimals couldn't be compared meaningfully.
+func (r Range) GetBSON() (interface{}, error) {
+	if err := r.checkUnits(); err != nil {
+		return nil, err
+	}
+	return rangeAlias(r), nil
+}
+
+func (r *Range) checkUnits() error {
+	if r.Low == nil || r.High == nil {
+		return nil
+	}
+	low, high := r.Low, r.High
+	if low.Code != "" && high.Code != "" {
+		if low.Code != high.Code || low.System != high.System {
+			return fmt.Errorf("Range bounds have different units: low %s (%s) and high %s (%s)", low.Code, low.System, high.Code, high.System)
+		}
+		return nil
+	}
+	if low.Unit != high.Unit {
+		return fmt.Errorf("Range bounds have different units: low %q and high %q", low.Unit, high.Unit)
+	}
+	return nil
+}
@@ -34,4 +34,6 @@ type Reference struct {
 	Type         string      `bson:"reference__type,omitempty" json:"reference__type,omitempty"`
 	ReferencedID string      `bson:"reference__id,omitempty" json:"reference__id,omitempty"`
 	External     *bool       `bson:"reference__external,omitempty" json:"reference__external,omitempty"`
+	Contained    bool        `bson:"reference__contained,omitempty" json:"reference__contained,omitempty"`
+	Version      string      `bson:"reference__version,omitempty" json:"reference__version,omitempty"`
 }
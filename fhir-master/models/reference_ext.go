@@ -3,6 +3,8 @@ package models
 import (
 	"encoding/json"
 	"strings"
+
+	"gopkg.in/mgo.v2/bson"
 )
 
 func (r *Reference) MarshalJSON() ([]byte, error) {
@@ -26,17 +28,86 @@ type reference Reference
 func (r *Reference) UnmarshalJSON(data []byte) (err error) {
 	ref := reference{}
 	if err = json.Unmarshal(data, &ref); err == nil {
-		splitURL := strings.Split(ref.Reference, "/")
-		if len(splitURL) >= 2 {
-			ref.ReferencedID = splitURL[len(splitURL)-1]
-			ref.Type = splitURL[len(splitURL)-2]
-		}
-
-		external := strings.HasPrefix(ref.Reference, "http")
-		ref.External = &external
-
+		ref.expand()
 		*r = Reference(ref)
 		return
 	}
 	return err
 }
+
+// expand sets the reference__* fields used for searching from the reference URL
+func (ref *reference) expand() {
+	if strings.HasPrefix(ref.Reference, "#") {
+		// a resource contained in this one, e.g. #vitals
+		external := false
+		ref.ReferencedID = ref.Reference[1:]
+		ref.Type = ""
+		ref.Contained = true
+		ref.External = &external
+		return
+	}
+
+	splitURL := strings.Split(ref.Reference, "/")
+	if len(splitURL) >= 4 && splitURL[len(splitURL)-2] == "_history" {
+		// pinned to a version, e.g. Patient/123/_history/4
+		ref.Version = splitURL[len(splitURL)-1]
+		splitURL = splitURL[:len(splitURL)-2]
+	}
+	if len(splitURL) >= 2 {
+		ref.ReferencedID = splitURL[len(splitURL)-1]
+		ref.Type = splitURL[len(splitURL)-2]
+	}
+
+	external := strings.HasPrefix(ref.Reference, "http")
+	ref.External = &external
+}
+
+// storedReference adds a copy of the display text to the reference__* fields so that references
+// can be rendered from them without being resolved
+type storedReference struct {
+	reference   `bson:",inline"`
+	DisplayCopy string `bson:"reference__display,omitempty"`
+}
+
+// Normalize fills in the reference__* fields of a Reference that wasn't unmarshalled from JSON,
+// or the reference itself (e.g. Patient/123/_history/4) if only they were set
+func (r *Reference) Normalize() {
+	if r.Reference != "" && r.ReferencedID == "" && r.External == nil {
+		(*reference)(r).expand()
+	} else if r.Reference == "" && r.Type != "" && r.ReferencedID != "" {
+		r.Reference = r.Type + "/" + r.ReferencedID
+		if r.Version != "" {
+			r.Reference += "/_history/" + r.Version
+		}
+	}
+}
+
+// GetBSON stores the reference normalized
+func (r Reference) GetBSON() (interface{}, error) {
+	r.Normalize()
+	return storedReference{reference: reference(r), DisplayCopy: r.Display}, nil
+}
+
+// SetBSON restores the display from reference__display if it is missing. It also accepts
+// references stored as just a string (e.g. "Patient/123") by older versions.
+func (r *Reference) SetBSON(raw bson.Raw) error {
+	if raw.Kind == 0x02 {
+		var str string
+		if err := raw.Unmarshal(&str); err != nil {
+			return err
+		}
+		*r = Reference{Reference: str}
+		r.Normalize()
+		return nil
+	}
+
+	var stored storedReference
+	if err := raw.Unmarshal(&stored); err != nil {
+		return err
+	}
+	if stored.Display == "" {
+		stored.Display = stored.DisplayCopy
+	}
+	*r = Reference(stored.reference)
+	return nil
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"encoding/json"
+
+	"github.com/pebbe/util"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ReferenceSuite struct {
+}
+
+var _ = check.Suite(&ReferenceSuite{})
+
+func (s *ReferenceSuite) TestContainedReferences(c *check.C) {
+	for _, test := range []struct {
+		reference string
+		expected  bson.M
+	}{
+		{"#vitals", bson.M{"reference": "#vitals", "reference__id": "vitals", "reference__contained": true, "reference__external": false}},
+		{"Patient/123", bson.M{"reference": "Patient/123", "reference__id": "123", "reference__type": "Patient", "reference__external": false}},
+	} {
+		// expanded both when unmarshalled from JSON and when stored without having been
+		var fromJSON Reference
+		util.CheckErr(json.Unmarshal([]byte(`{"reference":"`+test.reference+`"}`), &fromJSON))
+		for _, ref := range []Reference{fromJSON, {Reference: test.reference}} {
+			data, err := bson.Marshal(ref)
+			util.CheckErr(err)
+			var m bson.M
+			util.CheckErr(bson.Unmarshal(data, &m))
+			c.Assert(m, check.DeepEquals, test.expected)
+		}
+		c.Assert(fromJSON.Contained, check.Equals, test.reference[0] == '#')
+	}
+}
+
+func (s *ReferenceSuite) TestVersionedReferences(c *check.C) {
+	for _, test := range []struct {
+		reference string
+		expected  bson.M
+	}{
+		{"Patient/123/_history/4", bson.M{"reference": "Patient/123/_history/4", "reference__id": "123", "reference__type": "Patient",
+			"reference__version": "4", "reference__external": false}},
+		{"http://example.org/fhir/Patient/123/_history/4", bson.M{"reference": "http://example.org/fhir/Patient/123/_history/4",
+			"reference__id": "123", "reference__type": "Patient", "reference__version": "4", "reference__external": true}},
+		{"Patient/123", bson.M{"reference": "Patient/123", "reference__id": "123", "reference__type": "Patient", "reference__external": false}},
+	} {
+		data, err := bson.Marshal(Reference{Reference: test.reference})
+		util.CheckErr(err)
+		var m bson.M
+		util.CheckErr(bson.Unmarshal(data, &m))
+		c.Assert(m, check.DeepEquals, test.expected)
+
+		var ref Reference
+		util.CheckErr(bson.Unmarshal(data, &ref))
+		version, _ := test.expected["reference__version"].(string)
+		c.Assert(ref.Version, check.Equals, version)
+	}
+
+	// the reference is rebuilt if only its parts were set
+	data, err := bson.Marshal(Reference{Type: "Patient", ReferencedID: "123", Version: "4"})
+	util.CheckErr(err)
+	var ref Reference
+	util.CheckErr(bson.Unmarshal(data, &ref))
+	c.Assert(ref.Reference, check.Equals, "Patient/123/_history/4")
+}
+
+func (s *ReferenceSuite) TestReferenceDisplay(c *check.C) {
+	data, err := bson.Marshal(Reference{Reference: "Practitioner/7", Display: "Dr. Smith"})
+	util.CheckErr(err)
+	var m bson.M
+	util.CheckErr(bson.Unmarshal(data, &m))
+	c.Assert(m["display"], check.Equals, "Dr. Smith")
+	c.Assert(m["reference__display"], check.Equals, "Dr. Smith")
+
+	var ref Reference
+	util.CheckErr(bson.Unmarshal(data, &ref))
+	c.Assert(ref.Display, check.Equals, "Dr. Smith")
+	c.Assert(ref.Reference, check.Equals, "Practitioner/7")
+	c.Assert(ref.ReferencedID, check.Equals, "7")
+
+	// left out when there's no display
+	data, err = bson.Marshal(Reference{Reference: "Practitioner/7"})
+	util.CheckErr(err)
+	m = nil
+	util.CheckErr(bson.Unmarshal(data, &m))
+	_, found := m["reference__display"]
+	c.Assert(found, check.Equals, false)
+
+	// restored from reference__display alone
+	data, err = bson.Marshal(bson.M{"reference": "Practitioner/7", "reference__display": "Dr. Smith"})
+	util.CheckErr(err)
+	ref = Reference{}
+	util.CheckErr(bson.Unmarshal(data, &ref))
+	c.Assert(ref.Display, check.Equals, "Dr. Smith")
+}
@@ -0,0 +1,25 @@
+package models
+
+// ReferenceRange is a Range that applies during a Period, e.g. an Observation reference range
+// for a particular stage of a pregnancy. It isn't a FHIR data type so is only used in extensions,
+// with the @type ReferenceRange.
+type ReferenceRange struct {
+	Low    *Quantity `bson:"low,omitempty" json:"low,omitempty"`
+	High   *Quantity `bson:"high,omitempty" json:"high,omitempty"`
+	Period *Period   `bson:"period,omitempty" json:"period,omitempty"`
+}
+
+type referenceRange ReferenceRange
+
+// GetBSON refuses to store bounds in different units, like Range.GetBSON
+func (r ReferenceRange) GetBSON() (interface{}, error) {
+	if err := r.Range().checkUnits(); err != nil {
+		return nil, err
+	}
+	return referenceRange(r), nil
+}
+
+// Range returns the low and high bounds without the period
+func (r *ReferenceRange) Range() *Range {
+	return &Range{Low: r.Low, High: r.High}
+}
@@ -34,5 +34,5 @@ type Signature struct {
 	OnBehalfOfUri       string        `bson:"onBehalfOfUri,omitempty" json:"onBehalfOfUri,omitempty"`
 	OnBehalfOfReference *Reference    `bson:"onBehalfOfReference,omitempty" json:"onBehalfOfReference,omitempty"`
 	ContentType         string        `bson:"contentType,omitempty" json:"contentType,omitempty"`
-	Blob                string        `bson:"blob,omitempty" json:"blob,omitempty"`
+	Blob                []byte        `bson:"blob,omitempty" json:"blob,omitempty"`
 }
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+type signature Signature
+
+// GetBSON stores when as an instant, keeping any fractional seconds
+func (s Signature) GetBSON() (interface{}, error) {
+	if s.When != nil && s.When.Precision == Timestamp {
+		when := *s.When
+		when.Precision = Instant
+		s.When = &when
+	}
+	return signature(s), nil
+}
+
+// SetBSON restores the instant precision of when, which isn't stored, and reads a blob stored
+// either as BSON binary or, as it was before, as a base64 string
+func (s *Signature) SetBSON(raw bson.Raw) error {
+	var sig signature
+	if err := raw.Unmarshal(&sig); err != nil {
+		return err
+	}
+	if err := decodeLegacyBase64Binary(raw, "blob", &sig.Blob); err != nil {
+		return err
+	}
+	if sig.When != nil {
+		sig.When.Precision = Instant
+	}
+	*s = Signature(sig)
+	return nil
+}
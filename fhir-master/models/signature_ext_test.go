@@ -0,0 +1,37 @@
+package models
+
+import (
+	"encoding/json"
+
+	"github.com/pebbe/util"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type SignatureSuite struct {
+}
+
+var _ = check.Suite(&SignatureSuite{})
+
+func (s *SignatureSuite) TestUnmarshalLegacyBase64Blob(c *check.C) {
+	// blob was stored as a base64 string before it was stored as binary
+	data, err := bson.Marshal(bson.M{"contentType": "application/jose", "blob": "aGVsbG8="})
+	util.CheckErr(err)
+
+	var signature Signature
+	err = bson.Unmarshal(data, &signature)
+	util.CheckErr(err)
+	c.Assert(signature.Blob, check.DeepEquals, []byte("hello"))
+
+	jsonBytes, err := json.Marshal(&signature)
+	util.CheckErr(err)
+	c.Assert(string(jsonBytes), check.Equals, `{"contentType":"application/jose","blob":"aGVsbG8="}`)
+
+	// binary is read as it is
+	data, err = bson.Marshal(bson.M{"blob": []byte("hello")})
+	util.CheckErr(err)
+	signature = Signature{}
+	err = bson.Unmarshal(data, &signature)
+	util.CheckErr(err)
+	c.Assert(signature.Blob, check.DeepEquals, []byte("hello"))
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Whether values with constraints beyond their Go types (e.g. currency codes, units, extension URLs) are checked when stored
+var strictValueValidation = false
+
+// SetStrictValueValidation turns on (or off) the optional checks made when storing
+// values such as Money currencies
+func SetStrictValueValidation(enabled bool) {
+	strictValueValidation = enabled
+}
+
+// Validate checks the extension, returning every problem found rather than stopping at the first.
+// As well as the checks made when storing it, the url must always be absolute and there must be
+// exactly one value.
+func (e *Extension) Validate() []error {
+	var errs []error
+
+	if e.Url == "" {
+		errs = append(errs, errors.New("Extension is missing a url"))
+	} else if err := checkAbsoluteUrl(e.Url); err != nil {
+		errs = append(errs, err)
+	}
+
+	values, fhirTypes := e.values()
+	switch {
+	case len(values) == 0:
+		errs = append(errs, fmt.Errorf("Extension %s has no value", e.Url))
+	case len(values) > 1:
+		errs = append(errs, fmt.Errorf("Extension %s has more than one value: %s", e.Url, strings.Join(fhirTypes, ", ")))
+	}
+
+	for i, value := range values {
+		if n, ok := value.(uint32); ok {
+			if err := checkExtensionInteger(fhirTypes[i], e.Url, int64(n)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	// checks made by the values themselves (e.g. Range units, ContactPoint rank)
+	for i, value := range values {
+		if getter, ok := value.(bson.Getter); ok {
+			if _, err := getter.GetBSON(); err != nil {
+				errs = append(errs, fmt.Errorf("Invalid %s extension %s: %s", fhirTypes[i], e.Url, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// BatchValidate validates each of the extensions, returning the problems found keyed by index.
+// Extensions without problems aren't included.
+func BatchValidate(extensions []Extension) map[int][]error {
+	problems := map[int][]error{}
+	for i := range extensions {
+		if errs := extensions[i].Validate(); len(errs) > 0 {
+			problems[i] = errs
+		}
+	}
+	return problems
+}
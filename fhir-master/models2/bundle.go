@@ -2,7 +2,6 @@ package models2
 
 import (
 	"github.com/pkg/errors"
-	"time"
 	"encoding/json"
 	"github.com/eug48/fhir/models"
 )
@@ -28,10 +27,7 @@ func (r *ShallowBundle) MarshalJSON() ([]byte, error) {
 	r.ResourceType = "Bundle"
 	if r.Meta == nil {
 		r.Meta = &models.Meta {
-			LastUpdated: &models.FHIRDateTime {
-				Time: time.Now(),
-				Precision: models.Timestamp,
-			},
+			LastUpdated: models.Now(models.Timestamp),
 		}
 	}
 	return json.Marshal(*r)
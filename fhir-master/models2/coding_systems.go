@@ -0,0 +1,49 @@
+package models2
+
+import (
+	"strings"
+)
+
+const Gofhir__systemOriginal = "system__original"
+
+// Alternative spellings of Coding.system URLs (e.g. https://loinc.org/ for http://loinc.org)
+// mapped to their canonical form. Keys are stored normalised so that a single entry
+// covers http/https and trailing slash variants.
+var canonicalCodingSystems map[string]string
+
+// Whether to keep the system URL as originally sent (in system__original) when it is canonicalised
+var preserveOriginalCodingSystems bool
+
+// SetCodingSystemCanonicalization configures the Coding.system URLs rewritten on write.
+// The map is from an alternative spelling to the canonical URL; passing nil disables canonicalization.
+func SetCodingSystemCanonicalization(aliases map[string]string, preserveOriginal bool) {
+	canonical := make(map[string]string, len(aliases))
+	for alias, system := range aliases {
+		canonical[codingSystemKey(alias)] = system
+		canonical[codingSystemKey(system)] = system
+	}
+	canonicalCodingSystems = canonical
+	preserveOriginalCodingSystems = preserveOriginal
+}
+
+// CanonicalCodingSystem returns the canonical form of a Coding.system URL,
+// or the URL unchanged if it isn't a known alternative spelling.
+func CanonicalCodingSystem(system string) string {
+	if len(canonicalCodingSystems) == 0 || system == "" {
+		return system
+	}
+	if canonical, found := canonicalCodingSystems[codingSystemKey(system)]; found {
+		return canonical
+	}
+	return system
+}
+
+func codingSystemKey(system string) string {
+	key := strings.TrimRight(system, "/")
+	if strings.HasPrefix(key, "https://") {
+		key = strings.TrimPrefix(key, "https://")
+	} else {
+		key = strings.TrimPrefix(key, "http://")
+	}
+	return key
+}
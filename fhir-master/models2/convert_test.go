@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/eug48/fhir/models"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	mgobson "gopkg.in/mgo.v2/bson"
 )
 
 func TestConversion(t *testing.T) {
@@ -115,6 +119,142 @@ func TestEncryptionOfMedicareIdentifier(t *testing.T) {
 	}
 }
 
+func TestCodingSystemCanonicalization(t *testing.T) {
+
+	SetCodingSystemCanonicalization(map[string]string{"https://loinc.org": "http://loinc.org"}, true)
+	defer SetCodingSystemCanonicalization(nil, false)
+
+	for _, system := range []string{"http://loinc.org", "https://loinc.org", "https://loinc.org/"} {
+		t.Run(system, func(t *testing.T) {
+			jsonBytes := []byte(`{"resourceType":"Observation","status":"final","code":{"coding":[{"system":"` + system + `","code":"2951-2"}]}}`)
+
+			bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, WhatToEncrypt{}, map[string]string{})
+			assert.Nil(t, err)
+
+			code := bsonDoc.Map()["code"].([]bson.E)
+			coding := bson.D(code[0].Value.([]interface{})[0].([]bson.E)).Map()
+			assert.Equal(t, "http://loinc.org", coding["system"], "should store the canonical system")
+			assert.Equal(t, "2951-2", coding["code"])
+			if system == "http://loinc.org" {
+				assert.NotContains(t, coding, Gofhir__systemOriginal)
+			} else {
+				assert.Equal(t, system, coding[Gofhir__systemOriginal], "should preserve the original system")
+			}
+
+			backToJson, _, err := ConvertGoFhirBSONToJSON(bsonDoc)
+			assert.Nil(t, err)
+			assert.JSONEq(t, `{"resourceType":"Observation","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"2951-2"}]}}`, string(backToJson))
+		})
+	}
+}
+
+func TestContainedReferences(t *testing.T) {
+	for _, test := range []struct {
+		reference string
+		expected  map[string]interface{}
+	}{
+		{"#pract1", map[string]interface{}{"reference": "#pract1", "reference__id": "pract1", "reference__contained": true, "reference__external": false}},
+		{"Practitioner/123", map[string]interface{}{"reference": "Practitioner/123", "reference__id": "123", "reference__type": "Practitioner", "reference__external": false}},
+	} {
+		t.Run(test.reference, func(t *testing.T) {
+			jsonBytes := []byte(`{"resourceType":"Condition","subject":{"reference":"Patient/1"},"asserter":{"reference":"` + test.reference + `"}}`)
+
+			bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, WhatToEncrypt{}, map[string]string{})
+			assert.Nil(t, err)
+
+			asserter := bson.D(bsonDoc.Map()["asserter"].([]bson.E)).Map()
+			assert.Equal(t, bson.M(test.expected), asserter)
+
+			backToJson, _, err := ConvertGoFhirBSONToJSON(bsonDoc)
+			assert.Nil(t, err)
+			assert.JSONEq(t, string(jsonBytes), string(backToJson))
+		})
+	}
+}
+
+func TestVersionedReferences(t *testing.T) {
+	for _, reference := range []string{"Patient/123/_history/4", "http://example.org/fhir/Patient/123/_history/4", "Patient/123"} {
+		t.Run(reference, func(t *testing.T) {
+			jsonBytes := []byte(`{"resourceType":"Condition","subject":{"reference":"` + reference + `"}}`)
+
+			bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, WhatToEncrypt{}, map[string]string{})
+			assert.Nil(t, err)
+
+			subject := bson.D(bsonDoc.Map()["subject"].([]bson.E)).Map()
+			assert.Equal(t, "123", subject["reference__id"])
+			assert.Equal(t, "Patient", subject["reference__type"])
+			if strings.Contains(reference, "_history") {
+				assert.Equal(t, "4", subject["reference__version"])
+			} else {
+				assert.NotContains(t, subject, "reference__version")
+			}
+
+			backToJson, _, err := ConvertGoFhirBSONToJSON(bsonDoc)
+			assert.Nil(t, err)
+			assert.JSONEq(t, string(jsonBytes), string(backToJson))
+		})
+	}
+}
+
+func TestAttachmentDataStoredAsBinary(t *testing.T) {
+	jsonBytes := []byte(`{"resourceType":"Patient","photo":[{"contentType":"image/gif","data":"aGVsbG8="}]}`)
+
+	bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, WhatToEncrypt{}, map[string]string{})
+	assert.Nil(t, err)
+
+	photo := bson.D(bsonDoc.Map()["photo"].([]interface{})[0].([]bson.E)).Map()
+	assert.Equal(t, primitive.Binary{Data: []byte("hello")}, photo["data"])
+
+	// models reads the same bytes
+	bsonBytes, err := bson.Marshal(&bsonDoc)
+	assert.Nil(t, err)
+	var patient models.Patient
+	err = mgobson.Unmarshal(bsonBytes, &patient)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), patient.Photo[0].Data)
+
+	var stored bson.D
+	err = bson.Unmarshal(bsonBytes, &stored)
+	assert.Nil(t, err)
+	backToJson, _, err := ConvertGoFhirBSONToJSON(stored)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(jsonBytes), string(backToJson))
+
+	// data stored as a base64 string before is returned as it is
+	legacy := bson.D{
+		{Key: "resourceType", Value: "Patient"},
+		{Key: "photo", Value: bson.A{bson.D{{Key: "contentType", Value: "image/gif"}, {Key: "data", Value: "aGVsbG8="}}}},
+	}
+	backToJson, _, err = ConvertGoFhirBSONToJSON(legacy)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(jsonBytes), string(backToJson))
+
+	_, err = ConvertJsonToGoFhirBSON([]byte(`{"resourceType":"Patient","photo":[{"data":"not base64!"}]}`), WhatToEncrypt{}, map[string]string{})
+	assert.NotNil(t, err)
+}
+
+func TestSignatureBlobStoredAsBinary(t *testing.T) {
+	jsonBytes := []byte(`{"resourceType":"Provenance","recorded":"2019-01-02T03:04:05Z","signature":[{"contentType":"application/jose","blob":"aGVsbG8="}]}`)
+
+	bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, WhatToEncrypt{}, map[string]string{})
+	assert.Nil(t, err)
+
+	signature := bson.D(bsonDoc.Map()["signature"].([]interface{})[0].([]bson.E)).Map()
+	assert.Equal(t, primitive.Binary{Data: []byte("hello")}, signature["blob"])
+
+	// models reads the same bytes
+	bsonBytes, err := bson.Marshal(&bsonDoc)
+	assert.Nil(t, err)
+	var provenance models.Provenance
+	err = mgobson.Unmarshal(bsonBytes, &provenance)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), provenance.Signature[0].Blob)
+
+	backToJson, _, err := ConvertGoFhirBSONToJSON(bsonDoc)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(jsonBytes), string(backToJson))
+}
+
 func printBSON(bsonDoc *bson.D) {
 	bsonBytes, err := bson.Marshal(bsonDoc)
 	if err != nil {
@@ -1,6 +1,7 @@
 package models2
 
 import (
+	"encoding/base64"
 	"fmt"
 	"math"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"github.com/buger/jsonparser"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type refsMap map[string]string
@@ -28,6 +30,8 @@ const Gofhir__to = "__to"
 //   - converts extensions from { url, value } to { url: { value } } to enable better MongoDB queries
 //   - converts decimal numbers to { __from, __to, __num, __strNum } for FHIR conformance
 //   - converts dates to { __from, __to, __strDate } for FHIR conformance
+//   - stores Attachment.data and Signature.blob as BSON binary
+//   - canonicalizes known alternative spellings of Coding.system URLs
 //   - optionally encrypts certain fields
 func ConvertJsonToGoFhirBSON(jsonBytes []byte, whatToEncrypt WhatToEncrypt, transformReferencesMap map[string]string) (out bson.D, err error) {
 
@@ -108,7 +112,7 @@ func addToBSONdoc(output *[]bson.E, pos positionInfo, key []byte, value []byte,
 			lastComponent := splitURL[components-1]
 			secondLastComponent := splitURL[components-2]
 
-			var referenceID, typeStr string
+			var referenceID, typeStr, version string
 
 			if secondLastComponent == "_history" {
 				// e.g. http://..../..../Patient/34/_history/3
@@ -119,6 +123,7 @@ func addToBSONdoc(output *[]bson.E, pos positionInfo, key []byte, value []byte,
 
 				referenceID = splitURL[components-3]
 				typeStr = splitURL[components-4]
+				version = lastComponent
 			} else {
 				// e.g. http://..../..../Patient/34
 				referenceID = lastComponent
@@ -131,8 +136,13 @@ func addToBSONdoc(output *[]bson.E, pos positionInfo, key []byte, value []byte,
 
 			*output = append(*output, bson.E{Key: "reference__id", Value: referenceID})
 			*output = append(*output, bson.E{Key: "reference__type", Value: typeStr})
+			if version != "" {
+				*output = append(*output, bson.E{Key: "reference__version", Value: version})
+			}
 		} else if strings.HasPrefix(reference, "#") {
 			// may have internal references like #ClinicIcon
+			*output = append(*output, bson.E{Key: "reference__id", Value: reference[1:]})
+			*output = append(*output, bson.E{Key: "reference__contained", Value: true})
 		} else if strings.HasPrefix(reference, "urn:uuid:") && strings.HasPrefix(pos.pathHere, "Bundle.") {
 			// may have in-bundle references in unprocessed Bundles (e.g. POSTed to /Bundle)
 		} else {
@@ -143,6 +153,20 @@ func addToBSONdoc(output *[]bson.E, pos positionInfo, key []byte, value []byte,
 		*output = append(*output, bson.E{Key: "reference__external", Value: external})
 	}
 
+	if pos.atCoding() && strKey == "system" {
+		// normalise alternative spellings of code systems so that token searches match
+		system, isString := valueBson.(string)
+		if isString {
+			canonical := CanonicalCodingSystem(system)
+			if canonical != system {
+				(*output)[len(*output)-1].Value = canonical
+				if preserveOriginalCodingSystems {
+					*output = append(*output, bson.E{Key: Gofhir__systemOriginal, Value: system})
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -216,6 +240,12 @@ func convertValue(pos positionInfo, value []byte, dataType jsonparser.ValueType,
 				err = errors.Wrap(err, "convertInstant failed")
 			}
 			return
+		} else if pos.atBinary() {
+			out, err = convertBinary(value, pos)
+			if err != nil {
+				err = errors.Wrap(err, "convertBinary failed")
+			}
+			return
 		} else {
 			unescaped, err := jsonparser.Unescape(value, nil)
 			if err != nil {
@@ -323,6 +353,19 @@ func convertInstant(jsonBytes []byte, pos positionInfo) (elem interface{}, err e
 	return
 }
 
+// base64Binary values of binaryElements are stored as BSON binary
+func convertBinary(jsonBytes []byte, pos positionInfo) (elem interface{}, err error) {
+	unescaped, err := jsonparser.Unescape(jsonBytes, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "jsonparser.Unescape failed")
+	}
+	data, err := base64.StdEncoding.DecodeString(string(unescaped))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid base64Binary at %s", pos.pathHere)
+	}
+	return primitive.Binary{Data: data}, nil
+}
+
 func convertDateValue(jsonBytes []byte, pos positionInfo) (elem interface{}, err error) {
 
 	stringForm := string(jsonBytes)
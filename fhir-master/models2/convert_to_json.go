@@ -143,7 +143,7 @@ func processDocument(out *bytes.Buffer, bsonDoc []bson.E) (err error) {
 		debug("processDocument: %s", elem.Key)
 
 		switch elem.Key {
-		case "reference__id", "reference__type", "reference__external":
+		case "reference__id", "reference__type", "reference__external", "reference__contained", "reference__version", Gofhir__systemOriginal:
 			continue // i.e. skip
 		}
 
@@ -211,6 +211,14 @@ func processValue(out *bytes.Buffer, elt interface{}) (err error) {
 		}
 		out.Write(b)
 
+	case primitive.Binary:
+		// base64-encoded
+		b, err := json.Marshal(v.Data)
+		if err != nil {
+			return err
+		}
+		out.Write(b)
+
 	case primitive.DateTime:
 		b, err := json.Marshal(v)
 		if err != nil {
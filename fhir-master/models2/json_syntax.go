@@ -0,0 +1,71 @@
+package models2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// How many bytes either side of a JSON syntax error to include in JsonSyntaxError.Snippet
+const jsonSyntaxSnippetRadius = 20
+
+// JsonSyntaxError describes where malformed JSON failed to parse
+type JsonSyntaxError struct {
+	msg     string
+	Offset  int64 // bytes read before the error was detected
+	Line    int   // 1-based
+	Column  int   // 1-based
+	Snippet string
+}
+
+func (e JsonSyntaxError) Error() string {
+	return fmt.Sprintf("malformed JSON at line %d, column %d (byte offset %d): %s near `%s`", e.Line, e.Column, e.Offset, e.msg, e.Snippet)
+}
+
+// CheckJsonSyntax returns a JsonSyntaxError if jsonBytes isn't well-formed JSON.
+// jsonparser (used for everything else) is lenient and only notices some problems
+// deep inside a conversion, so this should be called on JSON received from clients.
+func CheckJsonSyntax(jsonBytes []byte) error {
+	if json.Valid(jsonBytes) {
+		return nil
+	}
+
+	var raw json.RawMessage
+	err := json.Unmarshal(jsonBytes, &raw)
+	syntaxErr, isSyntaxError := err.(*json.SyntaxError)
+	if !isSyntaxError {
+		// shouldn't happen as json.Valid returned false
+		return JsonSyntaxError{msg: fmt.Sprintf("%v", err), Line: 1, Column: 1}
+	}
+
+	// the offending byte is the last one read
+	offset := int(syntaxErr.Offset)
+	if offset > len(jsonBytes) {
+		offset = len(jsonBytes)
+	}
+	errIndex := offset - 1
+	if errIndex < 0 {
+		errIndex = 0
+	}
+	line := 1 + bytes.Count(jsonBytes[:errIndex], []byte("\n"))
+	column := errIndex - bytes.LastIndexByte(jsonBytes[:errIndex], '\n')
+
+	snippetFrom := offset - jsonSyntaxSnippetRadius
+	if snippetFrom < 0 {
+		snippetFrom = 0
+	}
+	snippetTo := offset + jsonSyntaxSnippetRadius
+	if snippetTo > len(jsonBytes) {
+		snippetTo = len(jsonBytes)
+	}
+	snippet := strings.Join(strings.Fields(string(jsonBytes[snippetFrom:snippetTo])), " ")
+
+	return JsonSyntaxError{
+		msg:     syntaxErr.Error(),
+		Offset:  syntaxErr.Offset,
+		Line:    line,
+		Column:  column,
+		Snippet: snippet,
+	}
+}
@@ -0,0 +1,31 @@
+package models2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckJsonSyntax(t *testing.T) {
+
+	assert.Nil(t, CheckJsonSyntax([]byte(`{"resourceType": "Patient", "active": true}`)))
+
+	malformed := "{\n  \"resourceType\": \"Patient\",\n  \"active\": ,\n  \"gender\": \"male\"\n}"
+	err := CheckJsonSyntax([]byte(malformed))
+	syntaxErr, isSyntaxError := err.(JsonSyntaxError)
+	if assert.True(t, isSyntaxError, "should return a JsonSyntaxError") {
+		assert.Equal(t, 3, syntaxErr.Line)
+		assert.Equal(t, 13, syntaxErr.Column)
+		assert.Equal(t, int64(44), syntaxErr.Offset)
+		assert.Contains(t, syntaxErr.Snippet, `"active": ,`)
+		assert.Contains(t, syntaxErr.Error(), "line 3, column 13")
+	}
+
+	err = CheckJsonSyntax([]byte(`{"resourceType": "Patient"`))
+	syntaxErr, isSyntaxError = err.(JsonSyntaxError)
+	if assert.True(t, isSyntaxError, "should return a JsonSyntaxError for truncated JSON") {
+		assert.Equal(t, 1, syntaxErr.Line)
+		assert.Equal(t, 26, syntaxErr.Column)
+		assert.Contains(t, syntaxErr.Snippet, `"Patient"`)
+	}
+}
@@ -24,10 +24,24 @@ type positionInfo struct {
 
 	// Current path through the JSON - only for debugging
 	pathHere               string
+
+	// Whether the value is a base64Binary that's stored as BSON binary (see binaryElements)
+	binary                 bool
+}
+
+// base64Binary elements that are stored as BSON binary rather than a base64 string,
+// matching the []byte fields of models
+var binaryElements = map[string]bool{
+	"Attachment.data": true,
+	"Signature.blob":  true,
 }
+
 func (p *positionInfo) atReference() bool {
 	return p.element == "Reference"
 }
+func (p *positionInfo) atCoding() bool {
+	return p.element == "Coding"
+}
 func (p *positionInfo) atExtension() bool {
 	return p.element == "Extension"
 }
@@ -40,6 +54,9 @@ func (p *positionInfo) atDate() bool {
 func (p *positionInfo) atInstant() bool {
 	return p.element == "instant"
 }
+func (p *positionInfo) atBinary() bool {
+	return p.binary
+}
 func (p *positionInfo) downTo(key string, valueJson []byte) positionInfo {
 	result := p.__downTo(key, valueJson)
 	debug("downTo %s --> %#v", key, result)
@@ -115,6 +132,7 @@ func (p *positionInfo) __downTo(key string, valueJson []byte) positionInfo {
 		pathHere:               nextPath,
 		element:                nextElement,
 		needToReadResourceType: needToAcquireResourceType,
+		binary:                 binaryElements[p.element+"."+key],
 	}
 }
 func (p *positionInfo) intoArray(valueJson []byte) positionInfo {
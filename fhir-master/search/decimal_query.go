@@ -0,0 +1,63 @@
+package search
+
+import (
+	"github.com/eug48/fhir/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// BuildDecimalQuery returns the criteria matching a stored Decimal (with its __from/__to envelope) at field
+// for the search prefix op (eq, ne, gt, ge, lt or le), or nil for other prefixes. Stored values match:
+//
+//	eq: if their range is within d's range, e.g. searching for 100 matches 100 and 100.2 but not 100.7
+//	ne: if their range isn't within d's range (and not if they have no value)
+//	gt, lt: if any of their range is above (or below) d's value
+//	ge, le: if any of their range is at or above (or below) d's range, or their range is within d's
+func BuildDecimalQuery(field string, op string, d *models.Decimal) bson.M {
+	from, to := field+".__from", field+".__to"
+	if field == "" {
+		from, to = "__from", "__to"
+	}
+
+	switch Prefix(op) {
+	case EQ:
+		return bson.M{
+			from: bson.M{"$gte": d.From},
+			to:   bson.M{"$lte": d.To},
+		}
+	case NE:
+		// the negation of eq, but written without $not so that values without the field don't match
+		return bson.M{
+			"$or": []bson.M{
+				bson.M{from: bson.M{"$lt": d.From}},
+				bson.M{to: bson.M{"$gt": d.To}},
+			},
+		}
+	case LT:
+		return bson.M{
+			from: bson.M{"$lt": d.Num},
+		}
+	case GT:
+		return bson.M{
+			to: bson.M{"$gt": d.Num},
+		}
+	case GE:
+		return bson.M{
+			"$or": []bson.M{
+				// "the range above the search value intersects (i.e. overlaps) with the range of the target value"
+				bson.M{to: bson.M{"$gte": d.To}},
+				// "or the range of the search value fully contains the range of the target value"
+				bson.M{from: bson.M{"$gte": d.From}},
+			},
+		}
+	case LE:
+		return bson.M{
+			"$or": []bson.M{
+				// "the range below the search value intersects (i.e. overlaps) with the range of the target value"
+				bson.M{from: bson.M{"$lte": d.From}},
+				// "or the range of the search value fully contains the range of the target value"
+				bson.M{to: bson.M{"$lte": d.To}},
+			},
+		}
+	}
+	return nil
+}
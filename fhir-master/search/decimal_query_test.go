@@ -0,0 +1,60 @@
+package search
+
+import (
+	"github.com/eug48/fhir/models"
+	"github.com/pebbe/util"
+	"go.mongodb.org/mongo-driver/bson"
+	. "gopkg.in/check.v1"
+)
+
+type DecimalQuerySuite struct{}
+
+var _ = Suite(&DecimalQuerySuite{})
+
+func (s *DecimalQuerySuite) TestBuildDecimalQuery(c *C) {
+	d, err := models.NewDecimal("100")
+	util.CheckErr(err)
+
+	c.Assert(BuildDecimalQuery("valueQuantity.value", "eq", d), DeepEquals, bson.M{
+		"valueQuantity.value.__from": bson.M{"$gte": 99.5},
+		"valueQuantity.value.__to":   bson.M{"$lte": 100.5},
+	})
+	c.Assert(BuildDecimalQuery("valueQuantity.value", "gt", d), DeepEquals, bson.M{
+		"valueQuantity.value.__to": bson.M{"$gt": 100.0},
+	})
+	c.Assert(BuildDecimalQuery("valueQuantity.value", "lt", d), DeepEquals, bson.M{
+		"valueQuantity.value.__from": bson.M{"$lt": 100.0},
+	})
+	c.Assert(BuildDecimalQuery("valueQuantity.value", "ge", d), DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"valueQuantity.value.__to": bson.M{"$gte": 100.5}},
+			bson.M{"valueQuantity.value.__from": bson.M{"$gte": 99.5}},
+		},
+	})
+	c.Assert(BuildDecimalQuery("valueQuantity.value", "le", d), DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"valueQuantity.value.__from": bson.M{"$lte": 99.5}},
+			bson.M{"valueQuantity.value.__to": bson.M{"$lte": 100.5}},
+		},
+	})
+
+	// ne is the opposite of eq: the stored range sticks out of the searched one at either end.
+	// Using $or rather than $not means documents without a value don't match.
+	c.Assert(BuildDecimalQuery("valueQuantity.value", "ne", d), DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"valueQuantity.value.__from": bson.M{"$lt": 99.5}},
+			bson.M{"valueQuantity.value.__to": bson.M{"$gt": 100.5}},
+		},
+	})
+
+	// the precision of the search value sets the width of the range
+	precise, err := models.NewDecimal("100.00")
+	util.CheckErr(err)
+	c.Assert(BuildDecimalQuery("", "eq", precise), DeepEquals, bson.M{
+		"__from": bson.M{"$gte": 99.995},
+		"__to":   bson.M{"$lte": 100.005},
+	})
+
+	c.Assert(BuildDecimalQuery("valueQuantity.value", "sa", d), IsNil)
+	c.Assert(BuildDecimalQuery("valueQuantity.value", "ap", d), IsNil)
+}
@@ -1136,63 +1136,9 @@ func (m *MongoSearcher) createQuantityQueryObject(q *QuantityParam) bson.M {
 		h, _ := q.Number.RangeHighExcl().Float64()
 		exact, _ := q.Number.Value.Float64()
 
-		var criteria bson.M
-
-		switch q.Prefix {
-		case EQ:
-			criteria = bson.M{
-				"value.__from": bson.M{
-					"$gte": l,
-				},
-				"value.__to": bson.M{
-					"$lte": h,
-				},
-			}
-
-		case LT:
-			criteria = bson.M{
-				"value.__from": bson.M{"$lt": exact},
-			}
-		case GT:
-			criteria = bson.M{
-				"value.__to": bson.M{"$gt": exact},
-			}
-		case GE:
-			criteria = bson.M{
-				"$or": []bson.M{
-					bson.M{
-						// "the range above the search value intersects (i.e. overlaps) with the range of the target value"
-						"value.__to": bson.M{
-							"$gte": h,
-						},
-					},
-					bson.M{
-						// "or the range of the search value fully contains the range of the target value"
-						"value.__from": bson.M{
-							"$gte": l,
-						},
-					},
-				},
-			}
-		case LE:
-			criteria = bson.M{
-				"$or": []bson.M{
-					bson.M{
-						// "the range below the search value intersects (i.e. overlaps) with the range of the target value"
-						"value.__from": bson.M{
-							"$lte": l,
-						},
-					},
-					bson.M{
-						// "or the range of the search value fully contains the range of the target value"
-						"value.__to": bson.M{
-							"$lte": h,
-						},
-					},
-				},
-			}
-		default:
-			// NE, SA, EB are not supported for Quantity queries
+		criteria := BuildDecimalQuery("value", string(q.Prefix), &models.Decimal{From: l, To: h, Num: exact})
+		if criteria == nil {
+			// SA, EB are not supported for Quantity queries
 			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", q.Name)))
 		}
 
@@ -1,6 +1,7 @@
 package search
 
 import (
+	"github.com/eug48/fhir/models2"
 	"github.com/eug48/fhir/utils"
 	"fmt"
 	"net/url"
@@ -1021,7 +1022,7 @@ func ParseTokenParam(paramString string, info SearchParamInfo) *TokenParam {
 
 	splitCode := escapeFriendlySplit(paramString, '|')
 	if len(splitCode) == 2 {
-		t.System = unescape(splitCode[0])
+		t.System = models2.CanonicalCodingSystem(unescape(splitCode[0]))
 		t.Code = unescape(splitCode[1])
 		if t.System == "" && t.Code == "" {
 			panic(createInternalServerError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", info.Name)))
@@ -1,6 +1,7 @@
 package search
 
 import (
+	"github.com/eug48/fhir/models2"
 	"github.com/eug48/fhir/utils"
 	. "github.com/eug48/fhir/utils"
 	"fmt"
@@ -1376,6 +1377,21 @@ func (s *SearchPTSuite) TestTokenParamSystemAndCode(c *C) {
 	c.Assert(t.System, Equals, "http://hl7.org/fhir/v2/0001")
 }
 
+func (s *SearchPTSuite) TestTokenParamCanonicalSystem(c *C) {
+	models2.SetCodingSystemCanonicalization(map[string]string{"https://loinc.org": "http://loinc.org"}, false)
+	defer models2.SetCodingSystemCanonicalization(nil, false)
+
+	for _, system := range []string{"http://loinc.org", "https://loinc.org", "https://loinc.org/"} {
+		t := ParseTokenParam(system+"|2951-2", tokenParamInfo)
+		c.Assert(t.AnySystem, Equals, false)
+		c.Assert(t.Code, Equals, "2951-2")
+		c.Assert(t.System, Equals, "http://loinc.org")
+	}
+
+	t := ParseTokenParam("http://hl7.org/fhir/v2/0001|M", tokenParamInfo)
+	c.Assert(t.System, Equals, "http://hl7.org/fhir/v2/0001")
+}
+
 func (s *SearchPTSuite) TestTokenParamSystemlessCode(c *C) {
 	t := ParseTokenParam("|M", tokenParamInfo)
 
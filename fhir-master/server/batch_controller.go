@@ -102,6 +102,7 @@ func (b *BatchController) Post(c *gin.Context) {
 	bundleResource, err := FHIRBind(c, b.Config.ValidatorURL)
 	if err != nil {
 		response := badStructure(err)
+		response.errOutcome.Issue[0].Location = jsonSyntaxLocation(err)
 		c.AbortWithStatusJSON(response.httpStatus, response.errOutcome)
 		return
 	}
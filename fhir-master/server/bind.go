@@ -11,6 +11,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/gin-gonic/gin"
+	"github.com/eug48/fhir/models"
 	"github.com/eug48/fhir/models2"
 )
 
@@ -54,6 +55,9 @@ func FHIRBind(c *gin.Context, validatorURL string) (resource *models2.Resource,
 
 	// JSON
 	if strings.Contains(contentType, "json") {
+		if err = models2.CheckJsonSyntax(bodyBytes); err != nil {
+			return nil, err
+		}
 		resource, err = models2.NewResourceFromJsonBytes(bodyBytes)
 		if encryptPatientDetails && resource != nil {
 			resource.SetWhatToEncrypt(models2.WhatToEncrypt { PatientDetails: true })
@@ -92,4 +96,21 @@ func shouldEncryptPatientDetails(c *gin.Context) bool {
 	default:
 		return false
 	}
-}
\ No newline at end of file
+}
+
+// bindErrorOutcome creates the OperationOutcome returned when FHIRBind fails
+func bindErrorOutcome(err error) *models.OperationOutcome {
+	outcome := models.NewOperationOutcome("fatal", "structure", err.Error())
+	outcome.Issue[0].Location = jsonSyntaxLocation(err)
+	return outcome
+}
+
+// jsonSyntaxLocation returns where a malformed JSON request body failed to parse
+// (for OperationOutcome.issue.location), or nil for other errors
+func jsonSyntaxLocation(err error) []string {
+	syntaxErr, isSyntaxError := errors.Cause(err).(models2.JsonSyntaxError)
+	if !isSyntaxError {
+		return nil
+	}
+	return []string{fmt.Sprintf("line %d, column %d", syntaxErr.Line, syntaxErr.Column)}
+}
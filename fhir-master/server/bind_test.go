@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -60,3 +61,25 @@ func testBinding(c *C, contentType string) {
 	c.Assert(condition.OnsetDateTime.Time.Equal(time.Date(2012, time.March, 1, 7, 0, 0, 0, tz)), Equals, true)
 	c.Assert(condition.OnsetDateTime.Precision, Equals, models.Precision(models.Timestamp))
 }
+
+func (b *BindSuite) TestMalformedJSONBinding(c *C) {
+	body := "{\n  \"resourceType\": \"Condition\",\n  \"verificationStatus\": \"confirmed\"\n  \"clinicalStatus\": \"active\"\n}"
+	r, _ := http.NewRequest("POST", "/Condition", strings.NewReader(body))
+	r.Header.Add("Content-Type", "application/fhir+json")
+	rw := httptest.NewRecorder()
+
+	var bindErr error
+	e := gin.New()
+	e.POST("/Condition", func(ctx *gin.Context) {
+		_, bindErr = FHIRBind(ctx, "")
+	})
+
+	e.ServeHTTP(rw, r)
+
+	c.Assert(bindErr, NotNil)
+	outcome := bindErrorOutcome(bindErr)
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Code, Equals, "structure")
+	c.Assert(outcome.Issue[0].Location, DeepEquals, []string{"line 4, column 3"})
+	c.Assert(strings.Contains(outcome.Issue[0].Diagnostics, `"clinicalStatus"`), Equals, true)
+}
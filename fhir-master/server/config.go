@@ -51,9 +51,42 @@ type Config struct {
 	// database process. This defaults to a reasonable upper bound for slow, pipelined queries: 30s.
 	DatabaseOpTimeout time.Duration
 
-	// DatabaseKillOpPeriod is the length of time between scans of the database to kill long-running ops.
+	// DatabaseOpTimeoutByCollection overrides DatabaseOpTimeout for ops on particular collections
+	// (e.g. "Observation"), such as ones used for analytics whose queries legitimately run longer
+	DatabaseOpTimeoutByCollection map[string]time.Duration
+
+	// DatabaseOpGrace is extra time given to ops that have run for DatabaseOpTimeout before
+	// they are killed, so that ops which only just reach the timeout (e.g. a commit) can finish.
+	// The default of 0 kills them as soon as they reach it.
+	DatabaseOpGrace time.Duration
+
+	// DatabaseOpPollInterval is the length of time between scans of the database for long-running ops
+	// to kill, which can be much shorter than DatabaseOpTimeout. Must be positive.
+	DatabaseOpPollInterval time.Duration
+
+	// DatabaseKillOpPeriod is the length of time between scans of the database to kill long-running ops,
+	// used if DatabaseOpPollInterval isn't set.
+	//
+	// Deprecated: use DatabaseOpPollInterval.
 	DatabaseKillOpPeriod time.Duration
 
+	// MonitoredNamespaces are the databases (e.g. "fhir_prod", "fhir_staging") whose long-running ops
+	// are killed. If empty, databases ending with DatabaseSuffix are monitored.
+	MonitoredNamespaces []string
+
+	// DatabaseOpSpareLockWaiters stops long-running ops that are waiting for a lock from being
+	// killed, as they're often cheap ops that will finish as soon as the lock is released.
+	DatabaseOpSpareLockWaiters bool
+
+	// DatabaseOpDryRun makes the long-running op monitor only log the operations it would
+	// have killed, e.g. to check the timeout before enabling it in production.
+	DatabaseOpDryRun bool
+
+	// KillLongRunningOps starts the monitor that kills long-running database ops, configured by the
+	// DatabaseOp* options and MonitoredNamespaces above, which have no effect without it. It is off by
+	// default because the database user needs the inprog and killop privileges.
+	KillLongRunningOps bool
+
 	// CountTotalResults toggles whether the searcher should also get a total
 	// count of the total results of a search. In practice this is a performance hit
 	// for large datasets.
@@ -68,6 +101,28 @@ type Config struct {
 	// R4 leans towards case-sensitive, whereas STU3 text suggests case-insensitive (https://github.com/HL7/fhir/commit/13fb1c1f102caf7de7266d6e78ab261efac06a1f)
 	TokenParametersCaseSensitive bool
 
+	// CodingSystemCanonicalization maps alternative spellings of Coding.system URLs
+	// (e.g. "https://loinc.org/") to a canonical URL (e.g. "http://loinc.org") that is
+	// stored on write and used for token searches. http/https and trailing slash
+	// variants of each entry are matched automatically.
+	CodingSystemCanonicalization map[string]string
+
+	// Whether to also store the original Coding.system URL when it is canonicalized
+	PreserveOriginalCodingSystem bool
+
+	// ExtensionBaseURL (e.g. "http://example.org/fhir/extensions/") is left off the urls of
+	// extensions that start with it when they're stored, and added back when they're read.
+	// It shouldn't be changed once extensions have been stored with it.
+	ExtensionBaseURL string
+
+	// ExtensionKeyFunc, if set, derives the names extensions are stored under from their urls
+	// instead of using the last segment of the url, e.g. to store a hash rather than a readable name
+	ExtensionKeyFunc func(url string) string
+
+	// MaxExtensionDepth limits how deeply extensions can be nested within the values of other
+	// extensions, so that a very deep tree can't exhaust the stack (default 20)
+	MaxExtensionDepth int
+
 	// Whether to support storing previous versions of each resource
 	EnableHistory bool
 
@@ -92,6 +147,10 @@ type Config struct {
 	// Debug toggles debug-level logging.
 	Debug bool
 
+	// Logger receives the log messages of background tasks such as the long-running op monitor.
+	// If nil they are written to the standard log package.
+	Logger Logger
+
 	// Where to dump failed requests for debugging
 	FailedRequestsDir string
 }
@@ -104,7 +163,8 @@ var DefaultConfig = Config{
 	DatabaseSuffix:               "_fhir",
 	DatabaseSocketTimeout:        2 * time.Minute,
 	DatabaseOpTimeout:            90 * time.Second,
-	DatabaseKillOpPeriod:         10 * time.Second,
+	DatabaseOpPollInterval:       10 * time.Second,
+	MaxExtensionDepth:            20,
 	Auth:                         auth.None(),
 	EnableCISearches:             true,
 	TokenParametersCaseSensitive: false,
@@ -51,6 +51,10 @@ type DataAccessSession interface {
 	FindIDs(searchQuery search.Query) (result []string, err error)
 	// History executes the history operation (partial support)
 	History(baseURL url.URL, resoureType string, id string) (bundle *models2.ShallowBundle, err error)
+	// Merge re-points references to the source resource at the target, links the two resources and
+	// marks the source as inactive (replaced-by the target). Returns the number of re-pointed resources by type.
+	// Absolute references are only re-pointed if they start with serverBase, the URL of this server.
+	Merge(serverBase url.URL, resourceType, sourceId, targetId string) (repointed map[string]int, err error)
 }
 
 // ErrNotFound indicates that the resource was not found (HTTP 404)
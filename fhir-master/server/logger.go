@@ -0,0 +1,36 @@
+package server
+
+import (
+	"log"
+)
+
+// LogFields are the details of a log message as key/value pairs (e.g. "opid": 123),
+// for loggers that record them separately from the message
+type LogFields map[string]interface{}
+
+// Logger receives the log messages of the server's background tasks, such as the long-running op
+// monitor, so that they can be routed into another logging pipeline (e.g. one that writes JSON).
+// The message already includes the details in fields, so loggers can ignore them.
+type Logger interface {
+	Info(msg string, fields LogFields)
+	Error(msg string, fields LogFields)
+}
+
+// StandardLogger is the default Logger, which writes messages to the standard log package
+type StandardLogger struct{}
+
+func (StandardLogger) Info(msg string, fields LogFields) {
+	log.Printf("%s\n", msg)
+}
+
+func (StandardLogger) Error(msg string, fields LogFields) {
+	log.Printf("%s\n", msg)
+}
+
+// logger returns config.Logger, or a StandardLogger if it isn't set
+func (config Config) logger() Logger {
+	if config.Logger == nil {
+		return StandardLogger{}
+	}
+	return config.Logger
+}
@@ -1,12 +1,13 @@
 package server
 
 import (
-	"errors"
 	"fmt"
-	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -34,13 +35,141 @@ type CurrentOp struct {
 	OpType           string `bson:"op" json:"op"`
 	Namespace        string `bson:"ns" json:"ns"`
 	KillPending      bool   `bson:"killPending" json:"killPending"`
+	WaitingForLock   bool   `bson:"waitingForLock" json:"waitingForLock"` // blocked, so its running time may not be its own
 	Query            bson.D `bson:"query" json:"query"`
+	Client           string `bson:"client,omitempty" json:"client,omitempty"` // host:port, missing for internal ops
+	ClientMetadata   bson.M `bson:"clientMetadata,omitempty" json:"clientMetadata,omitempty"`
+}
+
+// ClientSummary describes the client that issued the op for logging, e.g. "10.1.2.3:51234 (fhir-ingest)"
+// using the application name from its metadata, or "" if currentOp didn't report a client
+func (op CurrentOp) ClientSummary() string {
+	client := op.Client
+	if application, ok := op.ClientMetadata["application"].(bson.M); ok {
+		if name, ok := application["name"].(string); ok && name != "" {
+			if client == "" {
+				return name
+			}
+			client += " (" + name + ")"
+		}
+	}
+	return client
+}
+
+// QuerySummary renders the whole query document on one line for logging,
+// e.g. {find: "Patient", filter: {name: "alex"}}
+func (op CurrentOp) QuerySummary() string {
+	var summary strings.Builder
+	writeQueryValue(&summary, op.Query, 0)
+	return summary.String()
+}
+
+// Documents nested deeper than this are summarised as {...}
+const maxQuerySummaryDepth = 8
+
+func writeQueryValue(summary *strings.Builder, value interface{}, depth int) {
+	switch v := value.(type) {
+	case bson.D:
+		if depth >= maxQuerySummaryDepth {
+			summary.WriteString("{...}")
+			return
+		}
+		summary.WriteString("{")
+		for i, elem := range v {
+			if i > 0 {
+				summary.WriteString(", ")
+			}
+			summary.WriteString(elem.Name)
+			summary.WriteString(": ")
+			writeQueryValue(summary, elem.Value, depth+1)
+		}
+		summary.WriteString("}")
+	case bson.M:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		d := make(bson.D, 0, len(v))
+		for _, key := range keys {
+			d = append(d, bson.DocElem{Name: key, Value: v[key]})
+		}
+		writeQueryValue(summary, d, depth)
+	case []interface{}:
+		if depth >= maxQuerySummaryDepth {
+			summary.WriteString("[...]")
+			return
+		}
+		summary.WriteString("[")
+		for i, elem := range v {
+			if i > 0 {
+				summary.WriteString(", ")
+			}
+			writeQueryValue(summary, elem, depth+1)
+		}
+		summary.WriteString("]")
+	case string:
+		summary.WriteString(strconv.Quote(v))
+	default:
+		fmt.Fprint(summary, v)
+	}
 }
 
 // Reply is a response from a MongoDB command that doesn't return any results.
 type Reply struct {
-	Info string  `bson:"info,omitempty" json:"info,omitempty"`
-	Ok   float64 `bson:"ok" json:"ok"`
+	Info   string  `bson:"info,omitempty" json:"info,omitempty"`
+	Errmsg string  `bson:"errmsg,omitempty" json:"errmsg,omitempty"`
+	Code   int     `bson:"code,omitempty" json:"code,omitempty"`
+	Ok     float64 `bson:"ok" json:"ok"`
+}
+
+// Reasons killOp (and ListLongRunningOps) can fail. The errors returned keep MongoDB's message;
+// compare errors.Cause(err) (from github.com/pkg/errors) with these.
+var (
+	// ErrOpGone means the op finished (or was killed) before it could be killed
+	ErrOpGone = errors.New("op no longer exists")
+	// ErrNotAuthorized means the user lacks the privileges for currentOp or killOp
+	ErrNotAuthorized = errors.New("not authorized")
+	// ErrOpKillFailed is any other failure, including transient ones such as network errors
+	ErrOpKillFailed = errors.New("failed to kill op")
+)
+
+// MongoDB's error code for a command the user isn't allowed to run
+const unauthorizedCode = 13
+
+// opError is a MongoDB error classified as ErrOpGone, ErrNotAuthorized or ErrOpKillFailed
+type opError struct {
+	reason error
+	msg    string
+}
+
+func (e opError) Error() string {
+	return e.msg
+}
+
+// Cause lets errors.Cause find the reason
+func (e opError) Cause() error {
+	return e.reason
+}
+
+// classifyOpError works out why a command failed from MongoDB's error code and message
+func classifyOpError(code int, msg string) error {
+	lower := strings.ToLower(msg)
+	switch {
+	case code == unauthorizedCode || strings.Contains(lower, "not authorized") || strings.Contains(lower, "unauthorized"):
+		return opError{ErrNotAuthorized, msg}
+	case strings.Contains(lower, "no such op") || strings.Contains(lower, "op not found"):
+		return opError{ErrOpGone, msg}
+	}
+	return opError{ErrOpKillFailed, msg}
+}
+
+// commandError classifies an error returned by CommandRunner.Run
+func commandError(err error) error {
+	if queryErr, ok := err.(*mgo.QueryError); ok {
+		return classifyOpError(queryErr.Code, queryErr.Message)
+	}
+	return opError{ErrOpKillFailed, err.Error()}
 }
 
 // killLongRunningOps is intended to be run as a separate goroutine, off of
@@ -51,108 +180,388 @@ type Reply struct {
 // This is a common approach, similarly applied here:
 // 1. https://blog.mlab.com/2014/02/mongodb-currentop-killop
 // 2. https://dzone.com/articles/finding-and-terminating-long
+//
+// The server only starts it if Config.KillLongRunningOps is set, as it needs privileges
+// (inprog and killop) that the database user often doesn't have.
+func killLongRunningOps(connectionString string, dbname string, config Config) {
+	logger := config.logger()
+	pollInterval, err := killOpPollInterval(config)
+	if err != nil {
+		logKLROError(logger, nil, err.Error(), LogFields{"error": err})
+		return
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
 
-// TODO: disabled as requires high-grade permissions. Remove completely?
-func killLongRunningOps(ticker *time.Ticker, connectionString string, dbname string, config Config) {
-	logKLRO(nil, fmt.Sprintf("Monitoring databases %s for long-running operations", config.DatabaseSuffix))
+	monitored := config.DatabaseSuffix
+	if len(config.MonitoredNamespaces) > 0 {
+		monitored = strings.Join(config.MonitoredNamespaces, ", ")
+	}
+	logKLRO(logger, nil, fmt.Sprintf("Monitoring databases %s for long-running operations every %s", monitored, pollInterval),
+		LogFields{"databases": monitored, "pollInterval": pollInterval})
 
+	monitor := &opMonitor{
+		config: config,
+		dial: func() (adminConnection, error) {
+			return dialAdmin(connectionString, dbname)
+		},
+	}
+	defer monitor.close()
+
+	for now := range ticker.C {
+		monitor.tick(now)
+	}
+}
+
+// Limits of the delay before re-dialling after the connection fails
+const (
+	minKillOpsBackoff = time.Second
+	maxKillOpsBackoff = 5 * time.Minute
+)
+
+// adminConnection is a connection to the admin database
+type adminConnection interface {
+	CommandRunner
+	Close()
+}
+
+type mgoAdminConnection struct {
+	*mgo.Database
+}
+
+func (c mgoAdminConnection) Close() {
+	c.Session.Close()
+}
+
+func dialAdmin(connectionString string, dbname string) (adminConnection, error) {
 	session, err := mgo.Dial(connectionString)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer session.Close()
-	adminDB := session.DB(dbname)
+	return mgoAdminConnection{session.DB(dbname)}, nil
+}
 
-	for now := range ticker.C {
-		var err error
-		ops := CurrentOps{}
-		t := &now
+// opMonitor holds the state of killLongRunningOps between ticks: the connection, which
+// is re-dialled (backing off exponentially) whenever using it fails.
+type opMonitor struct {
+	config   Config
+	dial     func() (adminConnection, error)
+	conn     adminConnection
+	failures uint
+	nextDial time.Time
+}
 
-		// This will return a set of client-initiated currentOps ONLY. There are numerous
-		// more server operations that are returned when passed {"$all": true}.
-		// see: https://docs.mongodb.com/manual/reference/command/currentOp/
-		err = adminDB.Run("currentOp", &ops)
+// tick checks for and kills long-running ops once, logging rather than panicking on failure
+func (m *opMonitor) tick(now time.Time) {
+	t := &now
+	logger := m.config.logger()
+	defer func() {
+		if r := recover(); r != nil {
+			logKLROError(logger, t, fmt.Sprintf("recovered from panic: %v", r), LogFields{"panic": r})
+			m.dropConnection(now)
+		}
+	}()
 
+	if m.conn == nil {
+		if now.Before(m.nextDial) {
+			return
+		}
+		conn, err := m.dial()
 		if err != nil {
-			logKLRO(t, err.Error())
+			logKLROError(logger, t, "failed to connect: "+err.Error(), LogFields{"error": err})
+			m.backOff(now)
+			return
 		}
+		m.conn = conn
+	}
+
+	ops, err := ListLongRunningOps(m.conn, m.config)
+	if err != nil {
+		logKLROError(logger, t, err.Error(), LogFields{"error": err})
+		m.dropConnection(now)
+		return
+	}
+	m.failures = 0
+
+	killOps(t, ops, m.config, func(op CurrentOp) (KillResult, error) {
+		return killOp(m.conn, op)
+	})
+}
+
+func (m *opMonitor) dropConnection(now time.Time) {
+	m.close()
+	m.backOff(now)
+}
 
-		if ops.Ok != OK {
-			if ops.Info != "" {
-				logKLRO(t, "!OK: "+ops.Info)
-			} else {
-				logKLRO(t, "!OK: No additional information")
+func (m *opMonitor) backOff(now time.Time) {
+	delay := maxKillOpsBackoff
+	if m.failures < 16 && minKillOpsBackoff<<m.failures < maxKillOpsBackoff {
+		delay = minKillOpsBackoff << m.failures
+	}
+	m.failures++
+	m.nextDial = now.Add(delay)
+}
+
+func (m *opMonitor) close() {
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+}
+
+// killOpPollInterval returns how often killLongRunningOps checks for operations to kill,
+// falling back to the deprecated DatabaseKillOpPeriod if DatabaseOpPollInterval isn't set
+func killOpPollInterval(config Config) (time.Duration, error) {
+	interval := config.DatabaseOpPollInterval
+	if interval == 0 {
+		interval = config.DatabaseKillOpPeriod
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("Config.DatabaseOpPollInterval must be positive, not %s", interval)
+	}
+	return interval, nil
+}
+
+// CommandRunner runs MongoDB commands, like *mgo.Database
+type CommandRunner interface {
+	Run(cmd interface{}, result interface{}) error
+}
+
+// ListLongRunningOps returns the client-initiated operations on our databases that have been running
+// for longer than the timeout for their collection and which killLongRunningOps would kill.
+func ListLongRunningOps(adminDB CommandRunner, config Config) ([]CurrentOp, error) {
+	ops := CurrentOps{}
+
+	// This will return a set of client-initiated currentOps ONLY. There are numerous
+	// more server operations that are returned when passed {"$all": true}.
+	// see: https://docs.mongodb.com/manual/reference/command/currentOp/
+	err := adminDB.Run(currentOpCommand(config), &ops)
+	if err != nil {
+		if queryErr, ok := err.(*mgo.QueryError); ok && queryErr.Code == unauthorizedCode {
+			return nil, opError{ErrNotAuthorized, err.Error()}
+		}
+		return nil, err
+	}
+
+	if ops.Ok != OK {
+		if ops.Info != "" {
+			if classified := classifyOpError(0, ops.Info); errors.Cause(classified) == ErrNotAuthorized {
+				return nil, opError{ErrNotAuthorized, "!OK: " + ops.Info}
 			}
+			return nil, errors.New("!OK: " + ops.Info)
+		}
+		return nil, errors.New("!OK: No additional information")
+	}
+
+	return filterLongRunningOps(ops.InProg, config), nil
+}
+
+func filterLongRunningOps(inProg []CurrentOp, config Config) []CurrentOp {
+	var longRunning []CurrentOp
+
+	// The filter in currentOpCommand already narrows these down on the
+	// server, but the checks below are kept as a safety net.
+	for _, op := range inProg {
+
+		// Only evaluate active operations.
+		if !op.Active {
 			continue
 		}
 
-		for _, op := range ops.InProg {
+		// Don't retry kills.
+		if op.KillPending {
+			continue
+		}
 
-			// Only evaluate active operations.
-			if !op.Active {
-				continue
-			}
+		// Ops blocked on a lock are usually cheap and finish as soon as it's released.
+		if op.WaitingForLock && config.DatabaseOpSpareLockWaiters {
+			continue
+		}
 
-			// Don't retry kills.
-			if op.KillPending {
-				continue
-			}
+		// Only interfere with operations on our databases (e.g. "fhir").
+		if !isMonitoredNamespace(op.Namespace, config) {
+			continue
+		}
 
-			// Only interfere with operations on our database (e.g. "fhir").
-			if !strings.HasSuffix(op.Namespace, config.DatabaseSuffix) {
-				continue
-			}
+		// Check the current runtime.
+		if float64(op.SecsRunning) < killThreshold(config, opTimeout(op, config)).Seconds() {
+			continue
+		}
 
-			// Check the current runtime.
-			if float64(op.SecsRunning) < config.DatabaseOpTimeout.Seconds() {
+		// Operations that get here meet the following criteria:
+		// 1. Have a runtime exceeding the timeout for their collection (plus config.DatabaseOpGrace)
+		// 2. Are in the config.DatabaseName namespace.
+		switch op.OpType {
+		// To protect data integrity, only kill these types of operations.
+		// For a full list of command types, see:
+		// https://docs.mongodb.com/manual/reference/command/currentOp/#currentOp.op
+		case "command", "query", "getMore":
+			if len(op.Query) == 0 {
 				continue
 			}
+			longRunning = append(longRunning, op)
+		}
+	}
+	return longRunning
+}
 
-			// Operations that get here meet the following criteria:
-			// 1. Have a runtime exceeding the current config.DatabaseOpTimeout
-			// 2. Are in the config.DatabaseName namespace.
-			switch op.OpType {
-			// To protect data integrity, only kill these types of operations.
-			// For a full list of command types, see:
-			// https://docs.mongodb.com/manual/reference/command/currentOp/#currentOp.op
-			case "command", "query", "getMore":
-				if len(op.Query) == 0 {
-					continue
-				}
-
-				queryDoc := op.Query[0]
-				err = killOp(adminDB, op.OpID)
-				if err != nil {
-					logKLRO(t, err.Error())
-					continue
-				}
-
-				// Successfully killed the operation.
-				msg := fmt.Sprintf("killed op[%d] %s %s", op.OpID, queryDoc.Name, op.Namespace)
-				logKLRO(t, msg)
-			}
+// isMonitoredNamespace checks whether the database of namespace (e.g. "fhir_prod.Patient")
+// is in config.MonitoredNamespaces or, if there are none, ends with config.DatabaseSuffix
+func isMonitoredNamespace(namespace string, config Config) bool {
+	database := strings.SplitN(namespace, ".", 2)[0]
+	if len(config.MonitoredNamespaces) == 0 {
+		return strings.HasSuffix(database, config.DatabaseSuffix)
+	}
+	for _, monitored := range config.MonitoredNamespaces {
+		if database == monitored {
+			return true
+		}
+	}
+	return false
+}
+
+// killOps kills (using kill) the operations returned by ListLongRunningOps,
+// or with config.DatabaseOpDryRun only logs which ones it would kill.
+func killOps(t *time.Time, ops []CurrentOp, config Config, kill func(op CurrentOp) (KillResult, error)) {
+	logger := config.logger()
+	for _, op := range ops {
+		fields := LogFields{"opid": op.OpID, "ns": op.Namespace, "query": op.QuerySummary()}
+		from := ""
+		if client := op.ClientSummary(); client != "" {
+			from = " from " + client
+			fields["client"] = client
+		}
+		if config.DatabaseOpDryRun {
+			fields["dryRun"] = true
+			logKLRO(logger, t, fmt.Sprintf("would kill op[%d] %s %s%s", op.OpID, op.Namespace, op.QuerySummary(), from), fields)
+			continue
+		}
+
+		result, err := kill(op)
+		if err != nil {
+			fields["error"] = err
+			logKLROError(logger, t, err.Error(), fields)
+			continue
+		}
+
+		// Successfully killed the operation.
+		fields["runningTime"] = result.RunningTime
+		fields["killDuration"] = result.KillDuration
+		msg := fmt.Sprintf("killed op[%d] %s %s%s after %s (killOp took %s)", op.OpID, op.Namespace, op.QuerySummary(), from, result.RunningTime, result.KillDuration)
+		logKLRO(logger, t, msg, fields)
+	}
+}
+
+// currentOpCommand builds the currentOp command, filtering for active operations
+// that have been running long enough to kill so that MongoDB does the filtering
+// instead of returning every in-progress operation.
+func currentOpCommand(config Config) bson.D {
+	return bson.D{
+		{Name: "currentOp", Value: 1},
+		{Name: "active", Value: true},
+		{Name: "secs_running", Value: bson.M{"$gte": int64(killThreshold(config, shortestOpTimeout(config)) / time.Second)}},
+	}
+}
+
+// killThreshold is how long an op must have been running to be killed: its timeout
+// plus config.DatabaseOpGrace (if positive)
+func killThreshold(config Config, timeout time.Duration) time.Duration {
+	if config.DatabaseOpGrace > 0 {
+		return timeout + config.DatabaseOpGrace
+	}
+	return timeout
+}
+
+// opTimeout is the timeout for the op's collection in config.DatabaseOpTimeoutByCollection,
+// or config.DatabaseOpTimeout if it doesn't have one
+func opTimeout(op CurrentOp, config Config) time.Duration {
+	if timeout, found := config.DatabaseOpTimeoutByCollection[op.Collection()]; found {
+		return timeout
+	}
+	return config.DatabaseOpTimeout
+}
+
+// shortestOpTimeout is the shortest timeout of any collection, which currentOp filters on
+func shortestOpTimeout(config Config) time.Duration {
+	shortest := config.DatabaseOpTimeout
+	for _, timeout := range config.DatabaseOpTimeoutByCollection {
+		if timeout < shortest {
+			shortest = timeout
+		}
+	}
+	return shortest
+}
+
+// Collection is the collection part of the op's namespace, e.g. "Patient" for "fhir_prod.Patient".
+// For commands run against "fhir_prod.$cmd" it is the collection the command names, if any.
+func (op CurrentOp) Collection() string {
+	dot := strings.Index(op.Namespace, ".")
+	if dot < 0 {
+		return ""
+	}
+	collection := op.Namespace[dot+1:]
+	if collection == "$cmd" && len(op.Query) > 0 {
+		if name, ok := op.Query[0].Value.(string); ok {
+			return name
 		}
 	}
+	return collection
+}
+
+// KillResult records how long a killed operation had been running when it was chosen to be
+// killed and how long the killOp command took
+type KillResult struct {
+	OpID         uint32
+	RunningTime  time.Duration
+	KillDuration time.Duration
 }
 
-func killOp(adminDB *mgo.Database, opID uint32) error {
-	var err error
+// RunningTime is how long the operation had been running when currentOp was run
+func (op CurrentOp) RunningTime() time.Duration {
+	if op.MicrosecsRunning > 0 {
+		return time.Duration(op.MicrosecsRunning) * time.Microsecond
+	}
+	return time.Duration(op.SecsRunning) * time.Second
+}
+
+func killOp(adminDB CommandRunner, op CurrentOp) (KillResult, error) {
+	result := KillResult{OpID: op.OpID, RunningTime: op.RunningTime()}
 	reply := Reply{}
+	start := time.Now()
 	// see: https://docs.mongodb.com/manual/reference/command/killOp/
-	err = adminDB.Run(bson.D{{Name: "killOp", Value: 1}, {Name: "op", Value: opID}}, &reply)
+	err := adminDB.Run(bson.D{{Name: "killOp", Value: 1}, {Name: "op", Value: op.OpID}}, &reply)
+	result.KillDuration = time.Since(start)
+	if err != nil {
+		return result, commandError(err)
+	}
 	if reply.Ok != OK {
-		if reply.Info != "" {
-			return errors.New(reply.Info)
+		msg := reply.Errmsg
+		if msg == "" {
+			msg = reply.Info
 		}
-		return fmt.Errorf("Failed to kill op[%d]", opID)
+		if msg == "" {
+			msg = fmt.Sprintf("Failed to kill op[%d]", op.OpID)
+		}
+		return result, classifyOpError(reply.Code, msg)
 	}
-	return err
+	return result, nil
 }
 
-func logKLRO(t *time.Time, msg string) {
+// logKLRO logs an event of killLongRunningOps, adding t (the time of the tick, if any) to its fields
+func logKLRO(logger Logger, t *time.Time, msg string, fields LogFields) {
+	logger.Info(klroMessage(t, msg, fields))
+}
+
+// logKLROError is like logKLRO for failures
+func logKLROError(logger Logger, t *time.Time, msg string, fields LogFields) {
+	logger.Error(klroMessage(t, msg, fields))
+}
+
+func klroMessage(t *time.Time, msg string, fields LogFields) (string, LogFields) {
+	fields["task"] = "KillLongRunningOps"
 	if t != nil {
-		log.Printf("%v KillLongRunningOps: %s\n", t, msg)
-		return
+		fields["tick"] = *t
+		return fmt.Sprintf("%v KillLongRunningOps: %s", t, msg), fields
 	}
-	log.Printf("KillLongRunningOps: %s\n", msg)
+	return "KillLongRunningOps: " + msg, fields
 }
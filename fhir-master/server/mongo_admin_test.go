@@ -0,0 +1,593 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/suite"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type MongoAdminTestSuite struct {
+	suite.Suite
+}
+
+func TestMongoAdminTestSuite(t *testing.T) {
+	suite.Run(t, new(MongoAdminTestSuite))
+}
+
+func (s *MongoAdminTestSuite) TestCurrentOpCommandFiltersOnTimeout() {
+	config := DefaultConfig
+	config.DatabaseOpTimeout = 45 * time.Second
+
+	expected := bson.D{
+		{Name: "currentOp", Value: 1},
+		{Name: "active", Value: true},
+		{Name: "secs_running", Value: bson.M{"$gte": int64(45)}},
+	}
+	s.Equal(expected, currentOpCommand(config))
+
+	config.DatabaseOpTimeout = 2 * time.Minute
+	s.Equal(bson.M{"$gte": int64(120)}, currentOpCommand(config)[2].Value)
+}
+
+// mockCommandRunner returns canned currentOp results instead of running commands
+type mockCommandRunner struct {
+	ops      CurrentOps
+	reply    *Reply // killOp's reply, OK if nil
+	err      error
+	delay    time.Duration
+	commands []interface{}
+}
+
+func (r *mockCommandRunner) Run(cmd interface{}, result interface{}) error {
+	r.commands = append(r.commands, cmd)
+	time.Sleep(r.delay)
+	if r.err != nil {
+		return r.err
+	}
+	switch res := result.(type) {
+	case *CurrentOps:
+		*res = r.ops
+	case *Reply:
+		*res = Reply{Ok: OK}
+		if r.reply != nil {
+			*res = *r.reply
+		}
+	}
+	return nil
+}
+
+func longRunningOpsTestConfig() Config {
+	config := DefaultConfig
+	config.DatabaseSuffix = "_fhir"
+	config.DatabaseOpTimeout = 60 * time.Second
+	return config
+}
+
+func longRunningOpsTestRunner() *mockCommandRunner {
+	find := bson.D{{Name: "find", Value: "Patient"}}
+	return &mockCommandRunner{ops: CurrentOps{Ok: OK, InProg: []CurrentOp{
+		{Active: true, OpID: 1, SecsRunning: 90, OpType: "query", Namespace: "test_fhir", Query: find},
+		{Active: true, OpID: 2, SecsRunning: 30, OpType: "query", Namespace: "test_fhir", Query: find},
+		{Active: true, OpID: 3, SecsRunning: 90, OpType: "insert", Namespace: "test_fhir", Query: bson.D{{Name: "insert", Value: "Patient"}}},
+		{Active: true, OpID: 4, SecsRunning: 90, OpType: "query", Namespace: "other", Query: find},
+		{Active: false, OpID: 5, SecsRunning: 90, OpType: "query", Namespace: "test_fhir", Query: find},
+		{Active: true, OpID: 6, SecsRunning: 90, OpType: "query", Namespace: "test_fhir", Query: find, KillPending: true},
+		{Active: true, OpID: 7, SecsRunning: 120, OpType: "getMore", Namespace: "test_fhir", Query: bson.D{{Name: "getMore", Value: 123}}},
+		{Active: true, OpID: 8, SecsRunning: 120, OpType: "command", Namespace: "test_fhir"},
+	}}}
+}
+
+func (s *MongoAdminTestSuite) TestListLongRunningOps() {
+	config := longRunningOpsTestConfig()
+	runner := longRunningOpsTestRunner()
+
+	ops, err := ListLongRunningOps(runner, config)
+	s.NoError(err)
+	var opIDs []uint32
+	for _, op := range ops {
+		opIDs = append(opIDs, op.OpID)
+	}
+	s.Equal([]uint32{1, 7}, opIDs)
+	s.Equal([]interface{}{currentOpCommand(config)}, runner.commands)
+
+	runner.ops.Ok = 0
+	runner.ops.Info = "not authorized"
+	_, err = ListLongRunningOps(runner, config)
+	s.EqualError(err, "!OK: not authorized")
+
+	runner.err = errors.New("connection refused")
+	_, err = ListLongRunningOps(runner, config)
+	s.EqualError(err, "connection refused")
+}
+
+func (s *MongoAdminTestSuite) TestListLongRunningOpsWithGrace() {
+	find := bson.D{{Name: "find", Value: "Patient"}}
+	runner := &mockCommandRunner{ops: CurrentOps{Ok: OK, InProg: []CurrentOp{
+		{Active: true, OpID: 1, SecsRunning: 60, OpType: "query", Namespace: "test_fhir", Query: find},
+		{Active: true, OpID: 2, SecsRunning: 64, OpType: "query", Namespace: "test_fhir", Query: find},
+		{Active: true, OpID: 3, SecsRunning: 65, OpType: "query", Namespace: "test_fhir", Query: find},
+	}}}
+	opIDs := func(config Config) []uint32 {
+		ops, err := ListLongRunningOps(runner, config)
+		s.NoError(err)
+		var ids []uint32
+		for _, op := range ops {
+			ids = append(ids, op.OpID)
+		}
+		return ids
+	}
+
+	// without a grace period an op is killed as soon as it reaches the timeout
+	config := longRunningOpsTestConfig()
+	s.Equal([]uint32{1, 2, 3}, opIDs(config))
+
+	// with one, ops at the timeout are spared until it has passed too
+	config.DatabaseOpGrace = 5 * time.Second
+	s.Equal([]uint32{3}, opIDs(config))
+	s.Equal(bson.M{"$gte": int64(65)}, currentOpCommand(config)[2].Value)
+
+	config.DatabaseOpGrace = -5 * time.Second
+	s.Equal([]uint32{1, 2, 3}, opIDs(config))
+}
+
+func (s *MongoAdminTestSuite) TestListLongRunningOpsSparingLockWaiters() {
+	data, err := bson.Marshal(bson.M{
+		"active": true, "opid": 2, "secs_running": 90, "op": "query", "ns": "test_fhir",
+		"query":          bson.D{{Name: "find", Value: "Patient"}},
+		"waitingForLock": true,
+	})
+	s.NoError(err)
+	var waiting CurrentOp
+	s.NoError(bson.Unmarshal(data, &waiting))
+	s.True(waiting.WaitingForLock)
+
+	runner := longRunningOpsTestRunner()
+	runner.ops.InProg = []CurrentOp{runner.ops.InProg[0], waiting}
+	opIDs := func(config Config) []uint32 {
+		ops, err := ListLongRunningOps(runner, config)
+		s.NoError(err)
+		var ids []uint32
+		for _, op := range ops {
+			ids = append(ids, op.OpID)
+		}
+		return ids
+	}
+
+	config := longRunningOpsTestConfig()
+	s.Equal([]uint32{1, 2}, opIDs(config))
+	config.DatabaseOpSpareLockWaiters = true
+	s.Equal([]uint32{1}, opIDs(config))
+}
+
+func (s *MongoAdminTestSuite) TestListLongRunningOpsWithCollectionTimeouts() {
+	runner := &mockCommandRunner{ops: CurrentOps{Ok: OK, InProg: []CurrentOp{
+		{Active: true, OpID: 1, SecsRunning: 90, OpType: "query", Namespace: "test_fhir.Patient", Query: bson.D{{Name: "find", Value: "Patient"}}},
+		{Active: true, OpID: 2, SecsRunning: 90, OpType: "query", Namespace: "test_fhir.Observation", Query: bson.D{{Name: "find", Value: "Observation"}}},
+		{Active: true, OpID: 3, SecsRunning: 400, OpType: "command", Namespace: "test_fhir.$cmd", Query: bson.D{{Name: "aggregate", Value: "Observation"}}},
+		{Active: true, OpID: 4, SecsRunning: 40, OpType: "query", Namespace: "test_fhir.Appointment", Query: bson.D{{Name: "find", Value: "Appointment"}}},
+	}}}
+	config := longRunningOpsTestConfig()
+	config.DatabaseOpTimeoutByCollection = map[string]time.Duration{
+		"Observation": 5 * time.Minute,
+		"Appointment": 30 * time.Second,
+	}
+
+	ops, err := ListLongRunningOps(runner, config)
+	s.NoError(err)
+	var opIDs []uint32
+	for _, op := range ops {
+		opIDs = append(opIDs, op.OpID)
+	}
+	// Patient uses the default timeout (60s) and Observation's ops are spared until 5 minutes
+	s.Equal([]uint32{1, 3, 4}, opIDs)
+
+	// currentOp is asked for ops that have reached the shortest timeout
+	s.Equal(bson.M{"$gte": int64(30)}, currentOpCommand(config)[2].Value)
+
+	s.Equal("Patient", CurrentOp{Namespace: "test_fhir.Patient"}.Collection())
+	s.Equal("Observation", runner.ops.InProg[2].Collection())
+	s.Equal("", CurrentOp{Namespace: "test_fhir"}.Collection())
+}
+
+func (s *MongoAdminTestSuite) TestKillOpsDryRun() {
+	config := longRunningOpsTestConfig()
+	ops, err := ListLongRunningOps(longRunningOpsTestRunner(), config)
+	s.NoError(err)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var killed []uint32
+	kill := func(op CurrentOp) (KillResult, error) {
+		killed = append(killed, op.OpID)
+		return KillResult{OpID: op.OpID, RunningTime: op.RunningTime(), KillDuration: 3 * time.Millisecond}, nil
+	}
+
+	config.DatabaseOpDryRun = true
+	killOps(nil, ops, config, kill)
+	s.Empty(killed)
+	s.Contains(logged.String(), "would kill op[1] test_fhir {find: \"Patient\"}")
+	s.Contains(logged.String(), "would kill op[7] test_fhir {getMore: 123}")
+	s.NotContains(logged.String(), "op[2]")
+	s.NotContains(logged.String(), "op[3]")
+
+	// the same operations are killed for real
+	logged.Reset()
+	config.DatabaseOpDryRun = false
+	killOps(nil, ops, config, kill)
+	s.Equal([]uint32{1, 7}, killed)
+	s.Contains(logged.String(), "killed op[1] test_fhir {find: \"Patient\"} after 1m30s (killOp took 3ms)")
+	s.NotContains(logged.String(), "would kill")
+}
+
+func (s *MongoAdminTestSuite) TestKillOpsLogsClient() {
+	// as reported by currentOp
+	data, err := bson.Marshal(bson.M{
+		"active": true, "opid": 9, "secs_running": 95, "op": "query", "ns": "test_fhir",
+		"query":  bson.D{{Name: "find", Value: "Observation"}},
+		"client": "10.1.2.3:51234",
+		"clientMetadata": bson.M{
+			"application": bson.M{"name": "fhir-ingest"},
+			"driver":      bson.M{"name": "mgo", "version": "r2016.08.01"},
+		},
+	})
+	s.NoError(err)
+	var op CurrentOp
+	s.NoError(bson.Unmarshal(data, &op))
+	s.Equal("10.1.2.3:51234", op.Client)
+	s.Equal("10.1.2.3:51234 (fhir-ingest)", op.ClientSummary())
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	config := longRunningOpsTestConfig()
+	kill := func(op CurrentOp) (KillResult, error) {
+		return KillResult{OpID: op.OpID, RunningTime: op.RunningTime(), KillDuration: 3 * time.Millisecond}, nil
+	}
+	internal := CurrentOp{Active: true, OpID: 10, SecsRunning: 95, Namespace: "test_fhir", Query: bson.D{{Name: "getMore", Value: 1}}}
+	killOps(nil, []CurrentOp{op, internal}, config, kill)
+	s.Contains(logged.String(), `killed op[9] test_fhir {find: "Observation"} from 10.1.2.3:51234 (fhir-ingest) after 1m35s`)
+	s.Contains(logged.String(), `killed op[10] test_fhir {getMore: 1} after 1m35s`)
+
+	logged.Reset()
+	config.DatabaseOpDryRun = true
+	killOps(nil, []CurrentOp{op}, config, kill)
+	s.Contains(logged.String(), `would kill op[9] test_fhir {find: "Observation"} from 10.1.2.3:51234 (fhir-ingest)`)
+
+	// only some of the client details
+	s.Equal("10.1.2.3:51234", CurrentOp{Client: "10.1.2.3:51234", ClientMetadata: bson.M{"driver": bson.M{"name": "mgo"}}}.ClientSummary())
+	s.Equal("fhir-ingest", CurrentOp{ClientMetadata: bson.M{"application": bson.M{"name": "fhir-ingest"}}}.ClientSummary())
+	s.Equal("", CurrentOp{}.ClientSummary())
+}
+
+type loggedMessage struct {
+	level  string
+	msg    string
+	fields LogFields
+}
+
+// capturingLogger records the messages logged to it
+type capturingLogger struct {
+	messages []loggedMessage
+}
+
+func (l *capturingLogger) Info(msg string, fields LogFields) {
+	l.messages = append(l.messages, loggedMessage{"info", msg, fields})
+}
+
+func (l *capturingLogger) Error(msg string, fields LogFields) {
+	l.messages = append(l.messages, loggedMessage{"error", msg, fields})
+}
+
+func (s *MongoAdminTestSuite) TestKillOpsUsesConfigLogger() {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	logger := &capturingLogger{}
+	config := longRunningOpsTestConfig()
+	config.Logger = logger
+	op := CurrentOp{Active: true, OpID: 9, SecsRunning: 95, Namespace: "test_fhir.Observation", Query: bson.D{{Name: "find", Value: "Observation"}}, Client: "10.1.2.3:51234"}
+	failing := CurrentOp{Active: true, OpID: 10, SecsRunning: 95, Namespace: "test_fhir"}
+	kill := func(op CurrentOp) (KillResult, error) {
+		if op.OpID == 10 {
+			return KillResult{}, ErrOpGone
+		}
+		return KillResult{OpID: op.OpID, RunningTime: op.RunningTime(), KillDuration: 3 * time.Millisecond}, nil
+	}
+	tick := time.Date(2018, time.May, 2, 9, 0, 0, 0, time.UTC)
+	killOps(&tick, []CurrentOp{op, failing}, config, kill)
+
+	s.Empty(logged.String())
+	s.Require().Len(logger.messages, 2)
+	killed := logger.messages[0]
+	s.Equal("info", killed.level)
+	s.Contains(killed.msg, `KillLongRunningOps: killed op[9] test_fhir.Observation {find: "Observation"} from 10.1.2.3:51234 after 1m35s`)
+	s.Equal(LogFields{
+		"task":         "KillLongRunningOps",
+		"tick":         tick,
+		"opid":         uint32(9),
+		"ns":           "test_fhir.Observation",
+		"query":        `{find: "Observation"}`,
+		"client":       "10.1.2.3:51234",
+		"runningTime":  95 * time.Second,
+		"killDuration": 3 * time.Millisecond,
+	}, killed.fields)
+
+	failed := logger.messages[1]
+	s.Equal("error", failed.level)
+	s.Equal(uint32(10), failed.fields["opid"])
+	s.Equal(ErrOpGone, failed.fields["error"])
+
+	// dry runs are marked as such
+	logger.messages = nil
+	config.DatabaseOpDryRun = true
+	killOps(nil, []CurrentOp{op}, config, kill)
+	s.Require().Len(logger.messages, 1)
+	s.Equal(true, logger.messages[0].fields["dryRun"])
+	s.NotContains(logger.messages[0].fields, "tick")
+	s.Equal("KillLongRunningOps: would kill op[9] test_fhir.Observation {find: \"Observation\"} from 10.1.2.3:51234", logger.messages[0].msg)
+}
+
+func (s *MongoAdminTestSuite) TestKillOpPollInterval() {
+	config := DefaultConfig
+	config.DatabaseOpTimeout = 60 * time.Second
+	config.DatabaseOpPollInterval = 5 * time.Second
+
+	interval, err := killOpPollInterval(config)
+	s.NoError(err)
+	s.Equal(5*time.Second, interval)
+
+	interval, err = killOpPollInterval(DefaultConfig)
+	s.NoError(err)
+	s.Equal(10*time.Second, interval)
+
+	config.DatabaseOpPollInterval = 0
+	_, err = killOpPollInterval(config)
+	s.EqualError(err, "Config.DatabaseOpPollInterval must be positive, not 0s")
+
+	config.DatabaseOpPollInterval = -time.Second
+	_, err = killOpPollInterval(config)
+	s.Error(err)
+
+	// the deprecated DatabaseKillOpPeriod is used if DatabaseOpPollInterval isn't set
+	config.DatabaseOpPollInterval = 0
+	config.DatabaseKillOpPeriod = 3 * time.Second
+	interval, err = killOpPollInterval(config)
+	s.NoError(err)
+	s.Equal(3*time.Second, interval)
+
+	config.DatabaseOpPollInterval = 5 * time.Second
+	interval, err = killOpPollInterval(config)
+	s.NoError(err)
+	s.Equal(5*time.Second, interval)
+}
+
+func (s *MongoAdminTestSuite) TestCurrentOpQuerySummary() {
+	op := CurrentOp{Query: bson.D{{Name: "find", Value: "Patient"}}}
+	s.Equal(`{find: "Patient"}`, op.QuerySummary())
+
+	op.Query = bson.D{
+		{Name: "find", Value: "Observation"},
+		{Name: "filter", Value: bson.D{
+			{Name: "subject.reference__id", Value: "123"},
+			{Name: "$or", Value: []interface{}{
+				bson.M{"status": "final", "code.coding.code": "8867-4"},
+				bson.M{"status": "amended"},
+			}},
+		}},
+		{Name: "limit", Value: 100},
+	}
+	s.Equal(`{find: "Observation", filter: {subject.reference__id: "123", $or: [{code.coding.code: "8867-4", status: "final"}, {status: "amended"}]}, limit: 100}`, op.QuerySummary())
+
+	op.Query = nil
+	s.Equal("{}", op.QuerySummary())
+
+	// deeply nested documents are cut off
+	nested := bson.D{{Name: "x", Value: 1}}
+	for i := 0; i < 100; i++ {
+		nested = bson.D{{Name: "a", Value: nested}}
+	}
+	op.Query = nested
+	summary := op.QuerySummary()
+	s.Contains(summary, "{...}")
+	s.NotContains(summary, "x: 1")
+}
+
+// mockAdminConnection fails or panics when running commands if told to
+type mockAdminConnection struct {
+	*mockCommandRunner
+	panics bool
+	closed bool
+}
+
+func (c *mockAdminConnection) Run(cmd interface{}, result interface{}) error {
+	if c.panics {
+		panic("session closed")
+	}
+	return c.mockCommandRunner.Run(cmd, result)
+}
+
+func (c *mockAdminConnection) Close() {
+	c.closed = true
+}
+
+func (s *MongoAdminTestSuite) TestOpMonitorRecoversFromSessionErrors() {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	dropped := &mockAdminConnection{mockCommandRunner: &mockCommandRunner{err: errors.New("EOF")}}
+	panicking := &mockAdminConnection{mockCommandRunner: &mockCommandRunner{}, panics: true}
+	working := &mockAdminConnection{mockCommandRunner: longRunningOpsTestRunner()}
+	connections := []*mockAdminConnection{dropped, panicking, working}
+	var dialErr error
+	dials := 0
+	monitor := &opMonitor{
+		config: longRunningOpsTestConfig(),
+		dial: func() (adminConnection, error) {
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			conn := connections[dials]
+			dials++
+			return conn, nil
+		},
+	}
+
+	start := time.Date(2018, time.May, 2, 9, 0, 0, 0, time.UTC)
+
+	// a failing session is closed and re-dialled after a delay
+	s.NotPanics(func() { monitor.tick(start) })
+	s.Equal(1, dials)
+	s.True(dropped.closed)
+	s.Contains(logged.String(), "EOF")
+
+	s.NotPanics(func() { monitor.tick(start.Add(500 * time.Millisecond)) })
+	s.Equal(1, dials)
+
+	// a panic is recovered from in the same way, with a longer delay
+	s.NotPanics(func() { monitor.tick(start.Add(time.Second)) })
+	s.Equal(2, dials)
+	s.True(panicking.closed)
+	s.Contains(logged.String(), "recovered from panic: session closed")
+	s.Equal(start.Add(3*time.Second), monitor.nextDial)
+
+	s.NotPanics(func() { monitor.tick(start.Add(3 * time.Second)) })
+	s.Equal(3, dials)
+	s.False(working.closed)
+	s.Contains(logged.String(), "killed op[1]")
+	s.Contains(logged.String(), "killed op[7]")
+	s.Equal(uint(0), monitor.failures)
+
+	// the working connection is kept
+	s.NotPanics(func() { monitor.tick(start.Add(4 * time.Second)) })
+	s.Equal(3, dials)
+
+	// failing to dial backs off too, up to a limit
+	monitor.close()
+	dialErr = errors.New("no reachable servers")
+	now := start.Add(5 * time.Second)
+	var delays []time.Duration
+	for i := 0; i < 12; i++ {
+		s.NotPanics(func() { monitor.tick(now) })
+		delays = append(delays, monitor.nextDial.Sub(now))
+		now = monitor.nextDial
+	}
+	s.Contains(logged.String(), "failed to connect: no reachable servers")
+	s.Equal(time.Second, delays[0])
+	s.Equal(2*time.Second, delays[1])
+	s.Equal(4*time.Second, delays[2])
+	s.Equal(maxKillOpsBackoff, delays[11])
+}
+
+func (s *MongoAdminTestSuite) TestListLongRunningOpsInMonitoredNamespaces() {
+	config := longRunningOpsTestConfig()
+	config.MonitoredNamespaces = []string{"fhir_prod", "fhir_staging"}
+
+	find := bson.D{{Name: "find", Value: "Patient"}}
+	runner := &mockCommandRunner{ops: CurrentOps{Ok: OK, InProg: []CurrentOp{
+		{Active: true, OpID: 1, SecsRunning: 90, OpType: "query", Namespace: "fhir_prod.Patient", Query: find},
+		{Active: true, OpID: 2, SecsRunning: 90, OpType: "query", Namespace: "fhir_staging.Observation", Query: find},
+		{Active: true, OpID: 3, SecsRunning: 90, OpType: "query", Namespace: "fhir_test.Patient", Query: find},
+		{Active: true, OpID: 4, SecsRunning: 90, OpType: "query", Namespace: "fhir_prod_old.Patient", Query: find},
+		{Active: true, OpID: 5, SecsRunning: 90, OpType: "command", Namespace: "fhir_staging.$cmd", Query: find},
+		{Active: true, OpID: 6, SecsRunning: 30, OpType: "query", Namespace: "fhir_prod.Patient", Query: find},
+	}}}
+
+	ops, err := ListLongRunningOps(runner, config)
+	s.NoError(err)
+	var opIDs []uint32
+	for _, op := range ops {
+		opIDs = append(opIDs, op.OpID)
+	}
+	s.Equal([]uint32{1, 2, 5}, opIDs)
+
+	s.True(isMonitoredNamespace("fhir_prod", config))
+	s.False(isMonitoredNamespace("fhir", config))
+
+	// without any, the database suffix is used
+	config.MonitoredNamespaces = nil
+	config.DatabaseSuffix = "_test"
+	s.True(isMonitoredNamespace("fhir_test", config))
+	s.False(isMonitoredNamespace("fhir_prod.Patient", config))
+}
+
+func (s *MongoAdminTestSuite) TestKillOpResult() {
+	runner := &mockCommandRunner{delay: 20 * time.Millisecond}
+
+	op := CurrentOp{OpID: 12, SecsRunning: 95, MicrosecsRunning: 95500000}
+	result, err := killOp(runner, op)
+	s.NoError(err)
+	s.Equal(uint32(12), result.OpID)
+	s.Equal(95500*time.Millisecond, result.RunningTime)
+	s.True(result.KillDuration >= 20*time.Millisecond, "killOp took %s", result.KillDuration)
+	s.Equal([]interface{}{bson.D{{Name: "killOp", Value: 1}, {Name: "op", Value: uint32(12)}}}, runner.commands)
+
+	// older versions of MongoDB only report seconds
+	op = CurrentOp{OpID: 13, SecsRunning: 95}
+	result, err = killOp(runner, op)
+	s.NoError(err)
+	s.Equal(95*time.Second, result.RunningTime)
+
+	runner.err = errors.New("connection reset")
+	result, err = killOp(runner, op)
+	s.Error(err)
+	s.Equal(95*time.Second, result.RunningTime)
+}
+
+func (s *MongoAdminTestSuite) TestKillOpErrors() {
+	op := CurrentOp{OpID: 12}
+	tests := []struct {
+		reply    *Reply
+		err      error
+		expected error
+		message  string
+	}{
+		{reply: &Reply{Ok: 0, Code: 13, Errmsg: "not authorized on admin to execute command { killOp: 1 }"},
+			expected: ErrNotAuthorized, message: "not authorized on admin to execute command { killOp: 1 }"},
+		{reply: &Reply{Ok: 0, Info: "unauthorized"}, expected: ErrNotAuthorized, message: "unauthorized"},
+		{err: &mgo.QueryError{Code: 13, Message: "command killOp requires authentication"},
+			expected: ErrNotAuthorized, message: "command killOp requires authentication"},
+		{reply: &Reply{Ok: 0, Errmsg: "no such op 12"}, expected: ErrOpGone, message: "no such op 12"},
+		{reply: &Reply{Ok: 0, Info: "op not found"}, expected: ErrOpGone, message: "op not found"},
+		{reply: &Reply{Ok: 0, Code: 2, Errmsg: "invalid op : 12"}, expected: ErrOpKillFailed, message: "invalid op : 12"},
+		{reply: &Reply{Ok: 0}, expected: ErrOpKillFailed, message: "Failed to kill op[12]"},
+		{err: errors.New("connection reset"), expected: ErrOpKillFailed, message: "connection reset"},
+	}
+	for _, test := range tests {
+		runner := &mockCommandRunner{reply: test.reply, err: test.err}
+		_, err := killOp(runner, op)
+		s.EqualError(err, test.message)
+		s.Equal(test.expected, errors.Cause(err), test.message)
+	}
+
+	_, err := killOp(&mockCommandRunner{reply: &Reply{Ok: OK, Info: "attempting to kill op"}}, op)
+	s.NoError(err)
+}
+
+func (s *MongoAdminTestSuite) TestListLongRunningOpsNotAuthorized() {
+	config := longRunningOpsTestConfig()
+
+	runner := &mockCommandRunner{ops: CurrentOps{Info: "not authorized on admin to execute command { currentOp: 1 }"}}
+	_, err := ListLongRunningOps(runner, config)
+	s.EqualError(err, "!OK: not authorized on admin to execute command { currentOp: 1 }")
+	s.Equal(ErrNotAuthorized, errors.Cause(err))
+
+	runner = &mockCommandRunner{err: &mgo.QueryError{Code: 13, Message: "unauthorized"}}
+	_, err = ListLongRunningOps(runner, config)
+	s.Equal(ErrNotAuthorized, errors.Cause(err))
+
+	runner = &mockCommandRunner{err: errors.New("connection refused")}
+	_, err = ListLongRunningOps(runner, config)
+	s.NotEqual(ErrNotAuthorized, errors.Cause(err))
+}
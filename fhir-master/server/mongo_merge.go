@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// Merge re-points references from the source resource to the target across all resource types
+// that have reference search parameters able to target resourceType. The source is then linked
+// to the target (replaced-by) and made inactive, and the target linked back to it (replaces).
+// Call within a transaction so that a failure part-way through leaves nothing changed.
+// Only relative references and absolute ones starting with serverBase (the URL of this server) are re-pointed.
+func (ms *mongoSession) Merge(serverBase url.URL, resourceType, sourceId, targetId string) (repointed map[string]int, err error) {
+	if sourceId == targetId {
+		return nil, errors.Errorf("cannot merge %s/%s into itself", resourceType, sourceId)
+	}
+
+	// check both exist before changing anything
+	if _, err = ms.Get(sourceId, resourceType); err != nil {
+		return nil, err
+	}
+	if _, err = ms.Get(targetId, resourceType); err != nil {
+		return nil, err
+	}
+
+	repointed = map[string]int{}
+	sourceRef := resourceType + "/" + sourceId
+	targetRef := resourceType + "/" + targetId
+
+	for _, referrer := range referringSearchParams(resourceType) {
+		seen := map[string]bool{}
+		for {
+			// FindIDs returns at most a page of results, but re-pointed resources
+			// stop matching so keep going until nothing new turns up
+			query := search.Query{Resource: referrer.Resource, Query: referrer.Name + "=" + sourceRef}
+			ids, err := ms.FindIDs(query)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Merge: failed to find %s resources referring to %s", referrer.Resource, sourceRef)
+			}
+
+			newInBatch := 0
+			for _, id := range ids {
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				newInBatch++
+
+				updated, err := ms.repointReferences(referrer.Resource, id, serverBase, sourceRef, targetRef)
+				if err != nil {
+					return nil, err
+				}
+				if updated {
+					repointed[referrer.Resource]++
+				}
+			}
+			if newInBatch == 0 {
+				break
+			}
+		}
+	}
+
+	// read them now as re-pointing may have changed them, e.g. a link from the target to the source
+	source, err := ms.Get(sourceId, resourceType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Merge: failed to get %s", sourceRef)
+	}
+	target, err := ms.Get(targetId, resourceType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Merge: failed to get %s", targetRef)
+	}
+
+	source, err = linkResource(source, serverBase.String(), targetRef, "replaced-by", true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Merge: failed to link %s", sourceRef)
+	}
+	if _, err = ms.Put(sourceId, "", source); err != nil {
+		return nil, errors.Wrapf(err, "Merge: failed to update %s", sourceRef)
+	}
+
+	target, err = linkResource(target, serverBase.String(), sourceRef, "replaces", false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Merge: failed to link %s", targetRef)
+	}
+	if _, err = ms.Put(targetId, "", target); err != nil {
+		return nil, errors.Wrapf(err, "Merge: failed to update %s", targetRef)
+	}
+
+	glog.V(3).Infof("Merge: %s --> %s re-pointed %v", sourceRef, targetRef, repointed)
+	return repointed, nil
+}
+
+// repointReferences rewrites a single resource's references from oldRef to newRef, storing it as a new version
+func (ms *mongoSession) repointReferences(resourceType, id string, serverBase url.URL, oldRef, newRef string) (updated bool, err error) {
+	resource, err := ms.Get(id, resourceType)
+	if err != nil {
+		return false, errors.Wrapf(err, "Merge: failed to get %s/%s", resourceType, id)
+	}
+
+	jsonBytes, count, versioned := replaceReferences(resource.JsonBytes(), serverBase.String(), oldRef, newRef)
+	if versioned > 0 {
+		glog.Warningf("Merge: left %d versioned references to %s in %s/%s", versioned, oldRef, resourceType, id)
+	}
+	if count == 0 {
+		// e.g. a reference matched by search that isn't stored in the usual form
+		glog.Warningf("Merge: %s/%s matched a search for %s but no references were replaced", resourceType, id, oldRef)
+		return false, nil
+	}
+
+	updatedResource, err := models2.NewResourceFromJsonBytes(jsonBytes)
+	if err != nil {
+		return false, errors.Wrapf(err, "Merge: failed to parse re-pointed %s/%s", resourceType, id)
+	}
+	if _, err = ms.Put(id, "", updatedResource); err != nil {
+		return false, errors.Wrapf(err, "Merge: failed to update %s/%s", resourceType, id)
+	}
+	return true, nil
+}
+
+// referringSearchParams returns reference search parameters (of any resource type) that can refer to targetType
+func referringSearchParams(targetType string) []search.SearchParamInfo {
+	var resourceTypes []string
+	for resourceType := range search.SearchParameterDictionary {
+		resourceTypes = append(resourceTypes, resourceType)
+	}
+	sort.Strings(resourceTypes)
+
+	var params []search.SearchParamInfo
+	for _, resourceType := range resourceTypes {
+		var names []string
+		for name, info := range search.SearchParameterDictionary[resourceType] {
+			if info.Type != "reference" {
+				continue
+			}
+			for _, t := range info.Targets {
+				if t == targetType || t == "Any" {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			params = append(params, search.SearchParameterDictionary[resourceType][name])
+		}
+	}
+	return params
+}
+
+// replaceReferences replaces "reference" values of oldRef with newRef where they're relative or absolute
+// on this server, starting with serverBase (e.g. "http://example.com/fhir/"). References to other servers
+// are left alone, as are versioned references (e.g. Patient/123/_history/2), which are counted in versioned:
+// they point at a version of the old resource that stays as it was.
+// Works on the raw bytes so that everything else (key order, decimal precision) is left alone.
+func replaceReferences(jsonBytes []byte, serverBase, oldRef, newRef string) (replaced []byte, count int, versioned int) {
+	prefix := `"reference"\s*:\s*"`
+	if serverBase != "" {
+		prefix += `(?:` + regexp.QuoteMeta(strings.TrimSuffix(serverBase, "/")+"/") + `)?`
+	}
+	versionedRe := regexp.MustCompile(prefix + regexp.QuoteMeta(oldRef) + `/_history/[^"]*"`)
+	versioned = len(versionedRe.FindAll(jsonBytes, -1))
+
+	re := regexp.MustCompile(`(` + prefix + `)` + regexp.QuoteMeta(oldRef) + `"`)
+	replaced = re.ReplaceAllFunc(jsonBytes, func(match []byte) []byte {
+		count++
+		prefix := re.FindSubmatch(match)[1]
+		return append(append([]byte{}, prefix...), []byte(newRef+`"`)...)
+	})
+	return
+}
+
+// linkResource adds a link (as in Patient.link) to other and optionally marks the resource inactive.
+// Existing links to the resource itself are dropped; re-pointing leaves one where the target linked to the source.
+func linkResource(resource *models2.Resource, serverBase string, otherRef string, linkType string, deactivate bool) (*models2.Resource, error) {
+	decoder := json.NewDecoder(bytes.NewReader(resource.JsonBytes()))
+	decoder.UseNumber() // preserve decimals
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	selfRef := resource.ResourceType() + "/" + resource.Id()
+	var links []interface{}
+	if existing, found := fields["link"]; found {
+		existingLinks, isArray := existing.([]interface{})
+		if !isArray {
+			return nil, fmt.Errorf("link element is not an array")
+		}
+		for _, link := range existingLinks {
+			if !isLinkTo(link, serverBase, selfRef) {
+				links = append(links, link)
+			}
+		}
+	}
+	fields["link"] = append(links, map[string]interface{}{
+		"other": map[string]interface{}{"reference": otherRef},
+		"type":  linkType,
+	})
+	if deactivate {
+		fields["active"] = false
+	}
+
+	jsonBytes, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return models2.NewResourceFromJsonBytes(jsonBytes)
+}
+
+// isLinkTo returns whether a link element's other.reference is ref, relative or absolute on this server
+func isLinkTo(link interface{}, serverBase string, ref string) bool {
+	linkFields, _ := link.(map[string]interface{})
+	other, _ := linkFields["other"].(map[string]interface{})
+	reference, _ := other["reference"].(string)
+	if serverBase != "" {
+		reference = strings.TrimPrefix(reference, strings.TrimSuffix(serverBase, "/")+"/")
+	}
+	return reference == ref
+}
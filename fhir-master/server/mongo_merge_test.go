@@ -0,0 +1,66 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceReferences(t *testing.T) {
+	jsonBytes := []byte(`{"resourceType":"Observation","subject":{"reference":"Patient/123"},"performer":[{"reference" : "http://example.com/fhir/Patient/123"},{"reference":"Patient/1234"}],"valueQuantity":{"value":1.50}}`)
+
+	replaced, count, versioned := replaceReferences(jsonBytes, "http://example.com/fhir/", "Patient/123", "Patient/456")
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 0, versioned)
+	assert.Equal(t, `{"resourceType":"Observation","subject":{"reference":"Patient/456"},"performer":[{"reference" : "http://example.com/fhir/Patient/456"},{"reference":"Patient/1234"}],"valueQuantity":{"value":1.50}}`, string(replaced))
+}
+
+func TestReplaceReferencesOnlyOnThisServer(t *testing.T) {
+	jsonBytes := []byte(`{"subject":{"reference":"http://other.org/fhir/Patient/123"},"performer":[{"reference":"http://example.com/fhir/Patient/123"},{"reference":"http://example.com/fhirPatient/123"}]}`)
+
+	replaced, count, _ := replaceReferences(jsonBytes, "http://example.com/fhir", "Patient/123", "Patient/456")
+	assert.Equal(t, 1, count)
+	assert.Equal(t, `{"subject":{"reference":"http://other.org/fhir/Patient/123"},"performer":[{"reference":"http://example.com/fhir/Patient/456"},{"reference":"http://example.com/fhirPatient/123"}]}`, string(replaced))
+
+	// without a base only relative references are replaced
+	replaced, count, _ = replaceReferences(jsonBytes, "", "Patient/123", "Patient/456")
+	assert.Equal(t, 0, count)
+	assert.Equal(t, string(jsonBytes), string(replaced))
+}
+
+func TestReplaceReferencesSkipsVersionedReferences(t *testing.T) {
+	jsonBytes := []byte(`{"subject":{"reference":"Patient/123/_history/2"},"performer":[{"reference":"http://example.com/fhir/Patient/123/_history/1"},{"reference":"Patient/123"}]}`)
+
+	replaced, count, versioned := replaceReferences(jsonBytes, "http://example.com/fhir/", "Patient/123", "Patient/456")
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 2, versioned)
+	assert.Equal(t, `{"subject":{"reference":"Patient/123/_history/2"},"performer":[{"reference":"http://example.com/fhir/Patient/123/_history/1"},{"reference":"Patient/456"}]}`, string(replaced))
+}
+
+func TestLinkResourceDropsLinksToItself(t *testing.T) {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(`{"resourceType":"Patient","id":"456","link":[` +
+		`{"other":{"reference":"Patient/456"},"type":"seealso"},` +
+		`{"other":{"reference":"http://example.com/fhir/Patient/456"},"type":"seealso"},` +
+		`{"other":{"reference":"Patient/789"},"type":"seealso"}]}`))
+	assert.Nil(t, err)
+
+	linked, err := linkResource(resource, "http://example.com/fhir/", "Patient/123", "replaces", false)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"resourceType":"Patient","id":"456","link":[`+
+		`{"other":{"reference":"Patient/789"},"type":"seealso"},`+
+		`{"other":{"reference":"Patient/123"},"type":"replaces"}]}`, string(linked.JsonBytes()))
+}
+
+func TestReferringSearchParams(t *testing.T) {
+	var observationParams []string
+	for _, param := range referringSearchParams("Patient") {
+		assert.Equal(t, "reference", param.Type)
+		if param.Resource == "Observation" {
+			observationParams = append(observationParams, param.Name)
+		}
+	}
+	assert.Contains(t, observationParams, "subject")
+	assert.Contains(t, observationParams, "patient")
+	assert.NotContains(t, observationParams, "encounter")
+}
@@ -8,6 +8,8 @@ import (
 	"mime"
 	"net/http"
 	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/eug48/fhir/utils"
 
@@ -186,7 +188,7 @@ func (rc *ResourceController) CreateHandler(c *gin.Context) {
 
 	resource, err := FHIRBind(c, rc.Config.ValidatorURL)
 	if err != nil {
-		oo := models.NewOperationOutcome("fatal", "structure", err.Error())
+		oo := bindErrorOutcome(err)
 		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
 		return
 	}
@@ -229,7 +231,7 @@ func (rc *ResourceController) UpdateHandler(c *gin.Context) {
 
 	resource, err := FHIRBind(c, rc.Config.ValidatorURL)
 	if err != nil {
-		oo := models.NewOperationOutcome("fatal", "structure", err.Error())
+		oo := bindErrorOutcome(err)
 		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
 		return
 	}
@@ -280,7 +282,7 @@ func (rc *ResourceController) ConditionalUpdateHandler(c *gin.Context) {
 
 	resource, err := FHIRBind(c, rc.Config.ValidatorURL)
 	if err != nil {
-		oo := models.NewOperationOutcome("fatal", "structure", err.Error())
+		oo := bindErrorOutcome(err)
 		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
 		return
 	}
@@ -365,6 +367,116 @@ func (rc *ResourceController) ConditionalDeleteHandler(c *gin.Context) {
 	c.Status(http.StatusNoContent)
 }
 
+// MergeHandler handles $merge requests that fold a duplicate (source) resource into the target.
+// The ids are taken from source and target query parameters or from a Parameters resource in the body.
+func (rc *ResourceController) MergeHandler(c *gin.Context) {
+	defer handlePanics(c)
+	c.Set("Resource", rc.Name)
+	c.Set("Action", "merge")
+
+	sourceId, targetId, err := rc.mergeParameters(c)
+	if err != nil {
+		outcome := models.NewOperationOutcome("fatal", "invalid", err.Error())
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+		return
+	}
+
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	err = session.StartTransaction()
+	if err != nil {
+		panic(errors.Wrap(err, "failed to start transaction for $merge"))
+	}
+
+	repointed, err := session.Merge(*rc.Config.responseURL(c.Request), rc.Name, sourceId, targetId)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		outcome := models.NewOperationOutcome("error", "not-found", "source or target not found")
+		c.Render(http.StatusNotFound, CustomFhirRenderer{outcome, c})
+		return
+	case ErrDeleted:
+		outcome := models.NewOperationOutcome("error", "deleted", "source or target has been deleted")
+		c.Render(http.StatusGone, CustomFhirRenderer{outcome, c})
+		return
+	default:
+		panic(errors.Wrap(err, "Merge failed"))
+	}
+
+	err = session.CommmitIfTransaction()
+	if err != nil {
+		panic(errors.Wrap(err, "failed to commit $merge"))
+	}
+
+	c.Render(http.StatusOK, CustomFhirRenderer{mergeResult(rc.Name, sourceId, targetId, repointed), c})
+}
+
+func (rc *ResourceController) mergeParameters(c *gin.Context) (sourceId string, targetId string, err error) {
+	sourceId = c.Query("source")
+	targetId = c.Query("target")
+
+	if c.Request.ContentLength != 0 {
+		var parameters models.Parameters
+		err = json.NewDecoder(c.Request.Body).Decode(&parameters)
+		if err != nil {
+			return "", "", errors.Wrap(err, "failed to parse $merge Parameters")
+		}
+		for _, param := range parameters.Parameter {
+			id := param.ValueId
+			if id == "" {
+				id = param.ValueString
+			}
+			if param.ValueReference != nil {
+				id = strings.TrimPrefix(param.ValueReference.Reference, rc.Name+"/")
+			}
+
+			switch param.Name {
+			case "source":
+				sourceId = id
+			case "target":
+				targetId = id
+			}
+		}
+	}
+
+	if sourceId == "" || targetId == "" {
+		return "", "", errors.New("$merge requires both source and target")
+	}
+	if sourceId == targetId {
+		return "", "", errors.New("$merge source and target must be different resources")
+	}
+	return
+}
+
+func mergeResult(resourceType, sourceId, targetId string, repointed map[string]int) *models.Parameters {
+	var resourceTypes []string
+	total := int32(0)
+	for repointedType, count := range repointed {
+		resourceTypes = append(resourceTypes, repointedType)
+		total += int32(count)
+	}
+	sort.Strings(resourceTypes)
+
+	var counts []models.ParametersParameterComponent
+	for _, repointedType := range resourceTypes {
+		count := int32(repointed[repointedType])
+		counts = append(counts, models.ParametersParameterComponent{Name: repointedType, ValueInteger: &count})
+	}
+
+	result := &models.Parameters{
+		Parameter: []models.ParametersParameterComponent{
+			{Name: "source", ValueReference: &models.Reference{Reference: resourceType + "/" + sourceId}},
+			{Name: "target", ValueReference: &models.Reference{Reference: resourceType + "/" + targetId}},
+			{Name: "total", ValueInteger: &total},
+		},
+	}
+	if len(counts) > 0 {
+		result.Parameter = append(result.Parameter, models.ParametersParameterComponent{Name: "repointed", Part: counts})
+	}
+	return result
+}
+
 func setHeaders(c *gin.Context, rc *ResourceController, setLocationHeader bool, resource *models2.Resource, id string) error {
 	lastUpdated := resource.LastUpdated()
 	if lastUpdated != "" {
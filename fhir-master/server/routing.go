@@ -46,6 +46,10 @@ func RegisterController(name string, e *gin.Engine, m []gin.HandlerFunc, dal Dat
 	rcItem.PUT("", rc.UpdateHandler)
 	rcItem.DELETE("", rc.DeleteHandler)
 
+	if name == "Patient" {
+		rcBase.POST("/$merge", rc.MergeHandler)
+	}
+
 	if name == "Patient" || name == "Encounter" {
 		everythingItem := rcItem.Group("/$everything")
 		everythingItem.GET("", rc.EverythingHandler)
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/eug48/fhir/models"
 	"github.com/eug48/fhir/models2"
 	"github.com/gin-gonic/gin"
 	cors "github.com/itsjamie/gin-cors"
@@ -63,6 +64,11 @@ func NewServer(config Config) *FHIRServer {
 	}
 	gin.DisableConsoleColor()
 
+	models2.SetCodingSystemCanonicalization(config.CodingSystemCanonicalization, config.PreserveOriginalCodingSystem)
+	models.SetExtensionBaseURL(config.ExtensionBaseURL)
+	models.SetExtensionKeyFunc(config.ExtensionKeyFunc)
+	models.SetMaxExtensionDepth(config.MaxExtensionDepth)
+
 	server.Engine.Use(cors.Middleware(cors.Config{
 		Origins:         "*",
 		Methods:         "GET, PUT, POST, DELETE",
@@ -135,13 +141,12 @@ func (f *FHIRServer) InitEngine() {
 		NewIndexer(f.Config.DefaultDatabaseName, f.Config).ConfigureIndexes(db)
 	}
 
-	// Kick off the database op monitoring routine. This periodically checks db.currentOp() and
+	// Kick off the database op monitoring routine if enabled. This periodically checks db.currentOp() and
 	// kills client-initiated operations exceeding the configurable timeout. Do this AFTER the index
 	// build to ensure no index build processes are killed unintentionally.
-
-	// ticker := time.NewTicker(f.Config.DatabaseKillOpPeriod)
-	// TODO: disabled as requires high-grade permissions. Remove completely?
-	// go killLongRunningOps(ticker, client.ConnectionString(), "admin", f.Config)
+	if f.Config.KillLongRunningOps {
+		go killLongRunningOps(f.Config.DatabaseURI, "admin", f.Config)
+	}
 
 	// Register all API routes
 	RegisterRoutes(f.Engine, f.MiddlewareConfig, NewMongoDataAccessLayer(client, f.Config.DefaultDatabaseName, f.Config.EnableMultiDB, f.Config.DatabaseSuffix, f.Interceptors, f.Config), f.Config)
@@ -1207,6 +1207,106 @@ func (s *ServerSuite) TestPatientEverything(c *C) {
 	c.Assert(self.Url, Equals, s.Server.URL+"/Patient?_id="+createdPatientID+"&_include=*&_revinclude=*")
 }
 
+func (s *ServerSuite) TestPatientMerge(c *C) {
+	sourceID := s.FixtureID
+	targetID := s.insertPatientFromFixture("../fixtures/patient-example-b.json").Id
+
+	observationJSON := `{"resourceType":"Observation","status":"final","code":{"text":"weight"},"subject":{"reference":"Patient/` + sourceID + `"}}`
+	res, err := http.Post(s.Server.URL+"/Observation", "application/json", strings.NewReader(observationJSON))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	observationID := resourceIdFromLocation(res)
+
+	res, err = http.Post(s.Server.URL+"/Patient/$merge?source="+sourceID+"&target="+targetID, "application/json", nil)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	result := &models.Parameters{}
+	err = json.NewDecoder(res.Body).Decode(result)
+	util.CheckErr(err)
+	counts := map[string]int32{}
+	for _, param := range result.Parameter {
+		if param.Name == "total" {
+			counts["total"] = *param.ValueInteger
+		}
+		for _, part := range param.Part {
+			counts[part.Name] = *part.ValueInteger
+		}
+	}
+	c.Assert(counts["total"], Equals, int32(1))
+	c.Assert(counts["Observation"], Equals, int32(1))
+
+	// the Observation should now point at the target
+	res, err = http.Get(s.Server.URL + "/Observation/" + observationID)
+	util.CheckErr(err)
+	observation := &models.Observation{}
+	err = json.NewDecoder(res.Body).Decode(observation)
+	util.CheckErr(err)
+	c.Assert(observation.Subject.Reference, Equals, "Patient/"+targetID)
+
+	// the source should be linked to the target and inactive
+	res, err = http.Get(s.Server.URL + "/Patient/" + sourceID)
+	util.CheckErr(err)
+	source := &models.Patient{}
+	err = json.NewDecoder(res.Body).Decode(source)
+	util.CheckErr(err)
+	c.Assert(*source.Active, Equals, false)
+	c.Assert(source.Link, HasLen, 2) // fixture already has a seealso link
+	c.Assert(source.Link[1].Type, Equals, "replaced-by")
+	c.Assert(source.Link[1].Other.Reference, Equals, "Patient/"+targetID)
+
+	res, err = http.Get(s.Server.URL + "/Patient/" + targetID)
+	util.CheckErr(err)
+	target := &models.Patient{}
+	err = json.NewDecoder(res.Body).Decode(target)
+	util.CheckErr(err)
+	c.Assert(target.Link, HasLen, 2) // fixture already has a seealso link
+	c.Assert(target.Link[1].Type, Equals, "replaces")
+	c.Assert(target.Link[1].Other.Reference, Equals, "Patient/"+sourceID)
+}
+
+func (s *ServerSuite) TestPatientMergeKeepsRepointedTarget(c *C) {
+	sourceID := s.FixtureID
+	targetJSON := `{"resourceType":"Patient","active":true,"link":[{"other":{"reference":"Patient/` + sourceID + `"},"type":"seealso"}]}`
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", strings.NewReader(targetJSON))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	targetID := resourceIdFromLocation(res)
+
+	res, err = http.Post(s.Server.URL+"/Patient/$merge?source="+sourceID+"&target="+targetID, "application/json", nil)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	// the target's link to the source would point at itself once re-pointed so it's dropped,
+	// leaving the replaces link
+	res, err = http.Get(s.Server.URL + "/Patient/" + targetID)
+	util.CheckErr(err)
+	target := &models.Patient{}
+	err = json.NewDecoder(res.Body).Decode(target)
+	util.CheckErr(err)
+	c.Assert(target.Link, HasLen, 1)
+	c.Assert(target.Link[0].Type, Equals, "replaces")
+	c.Assert(target.Link[0].Other.Reference, Equals, "Patient/"+sourceID)
+}
+
+func (s *ServerSuite) TestPatientMergeRequiresSourceAndTarget(c *C) {
+	res, err := http.Post(s.Server.URL+"/Patient/$merge?source="+s.FixtureID, "application/json", nil)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *ServerSuite) TestPatientMergeRejectsSameSourceAndTarget(c *C) {
+	res, err := http.Post(s.Server.URL+"/Patient/$merge?source="+s.FixtureID+"&target="+s.FixtureID, "application/json", nil)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	outcome := &models.OperationOutcome{}
+	err = json.NewDecoder(res.Body).Decode(outcome)
+	util.CheckErr(err)
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Code, Equals, "invalid")
+}
+
 func performSearch(c *C, url string) *models.Bundle {
 	res, err := http.Get(url)
 	util.CheckErr(err)